@@ -1,18 +1,19 @@
 package main
 
 import (
-	"bytes"
-	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,6 +21,8 @@ import (
 
 	"sigsum.org/key-mgmt/internal/agent"
 	"sigsum.org/key-mgmt/internal/hsm"
+	"sigsum.org/key-mgmt/internal/manifest"
+	"sigsum.org/key-mgmt/internal/pubkey"
 )
 
 // Since we need to call os.Exit to pass an exit code, we need a
@@ -44,10 +47,94 @@ To use a yubihsm key, you need to specify both an authorization file
 file is a single line with the the authorization id (decimal number),
 and the corresponding passphrase, separated by a single ':' character.
 
+To avoid storing the passphrase in a plain file, the same
+authorization line can instead be read from a systemd credential
+(--auth-credential option, e.g., using LoadCredentialEncrypted), from
+a key of type "user" in the kernel keyring (--auth-keyring option,
+with the key description as argument), or from a file encrypted with
+age (--auth-age-file option, with the identity file given by the
+--age-identity option); each of these replaces the -a option. With
+the --auth-derived-key option, the secret part of the line is not
+the passphrase, but the 32-byte authentication key derived from it,
+hex encoded, as output by "sigsum-hsm derive-key". Then the
+passphrase itself need not be available to the agent at all.
+
 When using a yubihsm key, the agent needs a separate yubihsm-connector
 process to be running. By default, the connector is expected to
 listen on TCP port 12345 on localhost, but this can be changed with
-the -c option.
+the -c option. Alternatively, with "-c yhusb://", the agent accesses
+the device directly via usb (currently supported only on Linux),
+without any connector process; the agent then needs read and write
+access to the device node under /dev/bus/usb. If several devices are
+attached, select one by serial number, e.g., "yhusb://serial=123456".
+Only one process at a time can access the device this way, and no
+connector may be running.
+
+Since any local process that can reach the connector's TCP port can
+send commands to the device, the connector can also be reached in
+ways that restrict access: "-c unix:PATH" uses http over the unix
+socket PATH, where access is controlled by filesystem permissions,
+e.g., when the connector is behind a proxy listening on the socket.
+"-c https://host:port" uses https, and then the --connector-pin
+option is required, specifying the SHA-256 fingerprint of the
+connector's certificate (in hex, with or without ':' separators, as
+output by "openssl x509 -noout -fingerprint -sha256"). Only that
+certificate is accepted.
+
+By default, the agent uses a single session with the yubihsm, and
+sign requests are processed one at a time. With the --hsm-sessions
+option, the agent opens up to the given number of sessions (at most
+16, the device limit), and processes that many sign requests
+concurrently. Sessions are reused, and reopened if they have been
+closed by the device due to inactivity. Requests wait for an
+available session; the --hsm-queue-timeout option sets the max time
+to wait, after which the request is refused.
+
+At startup, the agent checks that the yubihsm key is an Ed25519 key.
+To detect a wrong or swapped device, the expected serial number of
+the device can be specified with the --hsm-serial option, and the
+expected label, domains and capabilities of the key with the
+--hsm-key-label, --hsm-key-domains and --hsm-key-capabilities
+options. Domains are specified as a comma separated list of numbers,
+and capabilities as a comma separated list of names, as used by
+yubihsm-shell; the key's domains and capabilities must match
+exactly. By default, the label and domains aren't checked, and the
+key must have the sign-eddsa capability only, and in particular, it
+must not be exportable. A wider set must be allowed explicitly: e.g.,
+keys created by the provisioning scripts have the capabilities
+sign-eddsa,exportable-under-wrap, to support backups, and using such
+a key requires the option "--hsm-key-capabilities
+sign-eddsa,exportable-under-wrap". If any check fails, the agent
+refuses to start. With the --hsm-health-interval option, the same
+checks, as well as a check that the public key is unchanged, are
+repeated periodically, and failures are logged.
+
+To rotate a signing key, the agent can serve several yubihsm keys at
+once, e.g., the old key and its successor during an overlap period.
+Pass a comma separated list of key ids, or repeat the -i option; the
+serial number and capabilities are checked for each key. The
+expected label and domains are then given per key, in the form
+ID=LABEL and ID=DOMAINS, e.g., "--hsm-key-label 600='Witness signing
+key' --hsm-key-domains 600=11"; these options may be repeated, and
+keys without them have no label or domains checked. (With a single
+key, the ID= prefix may be omitted, except for labels containing
+"=".) The --key-validity option, which may also be repeated,
+restricts when a key is available, in the form ID=FROM/UNTIL, where
+FROM and UNTIL are dates, either as YYYY-MM-DD (midnight UTC) or in
+RFC 3339 format, e.g., "600=/2026-07-01" and "601=2026-06-01/".
+Either side may be empty, meaning no limit, and UNTIL is exclusive.
+A key that is not yet valid isn't listed and can't be used for
+signing; when its validity ends, it is removed, and this is logged. A
+key whose validity has already ended at startup is not used at all.
+
+With the --print-public-keys option, the agent doesn't listen for
+connections. Instead, after the same startup checks, it prints the
+public keys of the configured keys, one per line, and exits. The
+format is one of "hex", as used in sigsum policy and configuration
+files, "openssh", as in authorized_keys files, "pem", for PEM encoded
+SubjectPublicKeyInfo, "base64", for the raw 32-byte key, or
+"key-hash", for the hex encoded SHA-256 hash of the key, as used by
+sigsum to identify keys.
 
 The agent listens for connections on a unix socket. By default, a
 random name is selected under /tmp (or ${TMPDIR}, if set), but it can
@@ -85,27 +172,140 @@ the following behavior: If "-" is used together with a command, stdout
 is closed after the pid file is written, and the command's stdout is
 redirected to /dev/null. If both pid and socket name are written to
 stdout, they are written as one line each, pid first.
+
+By default, the set of keys is fixed at startup. With the --allow-add
+option, clients may also add Ed25519 keys (e.g., using ssh-add),
+including lifetime and confirm constraints, and remove them again.
+With this option, the --key-id and --key-file options are optional.
+Keys configured at startup can't be removed.
+
+The agent supports the session-bind@openssh.com extension, used by
+ssh clients to bind agent connections to the host key of the server,
+and the corresponding destination constraints for added keys (ssh-add
+-h option). A key with destination constraints can only be used for
+ssh authentication towards the permitted hosts.
+
+With the --confirm option, each use of the key configured at startup
+must be confirmed; this applies also to keys added with a confirm
+constraint (ssh-add -c option). Confirmation is requested either by
+running an external program (--confirm-command option), which is
+invoked in the same way as ssh-agent invokes ssh-askpass, or by
+writing the request to a unix socket (--confirm-socket option). The
+approver is given the key fingerprint, message hash, namespace (when
+the data to sign is in SSHSIG format), and the pid, uid and command
+name of the requesting process. If no decision is made within the
+time specified by the --confirm-timeout option, the request is
+refused. Each decision is logged.
+
+The --rate-limit option limits the rate of sign requests per key,
+and the --uid-rate-limit option limits the rate of sign requests per
+uid of the requesting process. Limits are specified as
+COUNT/UNIT[:BURST], where UNIT is one of s, m, h or d, e.g., "10/m:20"
+allows on average 10 signatures per minute, with bursts of up to 20
+signatures. Requests exceeding the limits are refused. A log message
+is written when a limit is hit, and the USR1 signal makes the agent
+log the number of allowed and refused requests.
+
+With the --witness-logs option, the agent acts as a witness signing
+oracle: it signs only cosignature messages ("cosignature/v1", see
+https://c2sp.org/tlog-cosignature), for checkpoints of the logs whose
+origins are listed in the given file, one per line, e.g.,
+"sigsum.org/v1/tree/" followed by the hex key hash of a sigsum log's
+public key. The timestamp of the cosignature must be within the
+--witness-max-skew duration of the local clock. For each log, the
+agent records the largest cosigned tree size and its root hash in the
+state file given by the --witness-state option, which is required,
+and refuses to cosign a smaller tree, or a different root hash for
+the same tree size. Hence a compromised witness frontend can't get
+cosignatures of arbitrary messages, or of inconsistent checkpoints.
+The state file is updated before each new cosignature, and must not
+be shared with other agents.
+
+With the --note-name option, the agent signs only the text of signed
+notes (see https://c2sp.org/signed-note), e.g., checkpoints of a
+transparency log, using the given key name: the text must be valid
+UTF-8, end with a newline, and contain no other control characters.
+The agent logs the verifier key, NAME+KEYID+KEY, of each configured
+key at startup; with --print-public-keys, the format "note" prints
+the verifier keys. The key id is the first four bytes of the SHA-256
+hash of the name, a newline, the signature type (0x01), and the
+public key. The client forms the signature line from the key name, the
+key id, and the returned signature. With the --note-checkpoint-state
+option, each note must also be a checkpoint (see
+https://c2sp.org/tlog-checkpoint) whose origin line is the key name;
+the largest signed tree size and its root hash are recorded in the
+given state file, and a smaller tree, or a different root hash for
+the same size, is refused, as in the witness mode.
 `
 	// Default connector url
-	connector := "localhost:12345"
-	keyId := -1
-	authFile := ""
+	connectorURL := "localhost:12345"
+	connectorPin := ""
+	keyIds := []string{}
+	keyValidity := []string{}
+	var auth hsm.CredentialSource
 	keyFile := ""
 	socketName := ""
 	pidFile := ""
 	retry := false
+	hsmSessions := 1
+	hsmQueueTimeout := time.Duration(0)
+	hsmSerial := 0
+	hsmKeyLabels := []string{}
+	hsmKeyDomains := []string{}
+	hsmKeyCapabilities := ""
+	hsmHealthInterval := time.Duration(0)
+	allowAdd := false
+	confirm := false
+	confirmCommand := ""
+	confirmSocket := ""
+	confirmTimeout := 30 * time.Second
+	rateLimit := ""
+	uidRateLimit := ""
+	printFormat := ""
+	witnessLogs := ""
+	witnessState := ""
+	witnessMaxSkew := time.Minute
+	noteName := ""
+	noteCheckpointState := ""
 	help := false
 
 	set := getopt.New()
 	set.SetParameters("[cmd ...]")
 	set.SetUsage(func() { fmt.Print(usage) })
-	set.FlagLong(&connector, "connector", 'c', "host:port")
-	set.FlagLong(&keyId, "key-id", 'i', "yubihsm key id")
-	set.FlagLong(&authFile, "auth-file", 'a', "file with yubihsm auth-id:passphrase")
+	set.FlagLong(&connectorURL, "connector", 'c', "host:port, unix:path, https://host:port, or yhusb://")
+	set.FlagLong(&connectorPin, "connector-pin", 0, "sha256 fingerprint of the https connector's certificate")
+	set.FlagLong(&keyIds, "key-id", 'i', "yubihsm key ids, comma separated")
+	set.FlagLong(&keyValidity, "key-validity", 0, "validity of yubihsm key, ID=FROM/UNTIL")
+	set.FlagLong(&auth.File, "auth-file", 'a', "file with yubihsm auth-id:passphrase")
+	set.FlagLong(&auth.SystemdCredential, "auth-credential", 0, "systemd credential with yubihsm auth-id:passphrase")
+	set.FlagLong(&auth.Keyring, "auth-keyring", 0, "kernel keyring key with yubihsm auth-id:passphrase")
+	set.FlagLong(&auth.AgeFile, "auth-age-file", 0, "age encrypted file with yubihsm auth-id:passphrase")
+	set.FlagLong(&auth.AgeIdentity, "age-identity", 0, "age identity file, for --auth-age-file")
+	set.FlagLong(&auth.Derived, "auth-derived-key", 0, "auth secret is a derived key, not a passphrase")
 	set.FlagLong(&keyFile, "key-file", 'k', "private key file")
 	set.FlagLong(&socketName, "socket-name", 's', "name of unix socket")
 	set.FlagLong(&pidFile, "pid-file", 0, "for writing pid of agent or command, '-' means stdout")
 	set.FlagLong(&retry, "retry", 0, "retry a few times if connecting to the HSM fails at startup")
+	set.FlagLong(&hsmSessions, "hsm-sessions", 0, "number of concurrent yubihsm sessions, 1-16")
+	set.FlagLong(&hsmQueueTimeout, "hsm-queue-timeout", 0, "max time to wait for a yubihsm session, 0 means no limit")
+	set.FlagLong(&hsmSerial, "hsm-serial", 0, "expected yubihsm serial number")
+	set.FlagLong(&hsmKeyLabels, "hsm-key-label", 0, "expected label of yubihsm key, [ID=]LABEL")
+	set.FlagLong(&hsmKeyDomains, "hsm-key-domains", 0, "expected domains of yubihsm key, [ID=]DOMAINS")
+	set.FlagLong(&hsmKeyCapabilities, "hsm-key-capabilities", 0, "expected capabilities of yubihsm key (default sign-eddsa)")
+	set.FlagLong(&hsmHealthInterval, "hsm-health-interval", 0, "interval for yubihsm health checks, 0 means no checks")
+	set.FlagLong(&allowAdd, "allow-add", 0, "allow clients to add and remove keys")
+	set.FlagLong(&confirm, "confirm", 0, "require confirmation for each signature")
+	set.FlagLong(&confirmCommand, "confirm-command", 0, "program to run for confirmation")
+	set.FlagLong(&confirmSocket, "confirm-socket", 0, "unix socket to connect to for confirmation")
+	set.FlagLong(&confirmTimeout, "confirm-timeout", 0, "max time to wait for confirmation")
+	set.FlagLong(&rateLimit, "rate-limit", 0, "max rate of signatures per key, COUNT/UNIT[:BURST]")
+	set.FlagLong(&uidRateLimit, "uid-rate-limit", 0, "max rate of signatures per peer uid, COUNT/UNIT[:BURST]")
+	set.FlagLong(&printFormat, "print-public-keys", 0, "print public keys in the given format, and exit")
+	set.FlagLong(&witnessLogs, "witness-logs", 0, "file listing log origins, sign only cosignatures for these logs")
+	set.FlagLong(&witnessState, "witness-state", 0, "file with the largest cosigned tree of each log")
+	set.FlagLong(&witnessMaxSkew, "witness-max-skew", 0, "max difference between cosignature timestamp and local time")
+	set.FlagLong(&noteName, "note-name", 0, "key name, sign only signed note texts")
+	set.FlagLong(&noteCheckpointState, "note-checkpoint-state", 0, "sign only checkpoints, with the largest signed tree in this file")
 	set.FlagLong(&help, "help", 'h', "Display help")
 
 	err := set.Getopt(os.Args, nil)
@@ -121,11 +321,183 @@ stdout, they are written as one line each, pid first.
 		return 0, nil
 	}
 
-	if (keyId < 0 && len(keyFile) == 0) || (keyId >= 0 && len(keyFile) > 0) {
+	if len(keyIds) > 0 && len(keyFile) > 0 {
+		return 0, fmt.Errorf("At most one of the --key-id and --key-file options can be provided.")
+	}
+	if len(keyIds) == 0 && len(keyFile) == 0 && !allowAdd {
 		return 0, fmt.Errorf("Exactly one of the --key-id and --key-file options must be provided.")
 	}
-	if keyId >= 0 && len(authFile) == 0 {
-		return 0, fmt.Errorf("The --auth-file option is required with --key-id.")
+	if len(keyIds) > 0 && !auth.IsSet() {
+		return 0, fmt.Errorf("The --auth-file option, or another credential source, is required with --key-id.")
+	}
+	if hsmSessions < 1 || hsmSessions > hsm.MaxSessions {
+		return 0, fmt.Errorf("The number of hsm sessions must be between 1 and %d.", hsm.MaxSessions)
+	}
+	if len(printFormat) > 0 {
+		if printFormat == "note" {
+			if len(noteName) == 0 {
+				return 0, fmt.Errorf("The note format requires the --note-name option.")
+			}
+		} else if err := pubkey.CheckFormat(printFormat); err != nil {
+			return 0, err
+		}
+		if len(keyIds) == 0 && len(keyFile) == 0 {
+			return 0, fmt.Errorf("The --print-public-keys option requires --key-id or --key-file.")
+		}
+		if len(set.Args()) > 0 || len(socketName) > 0 || len(pidFile) > 0 {
+			return 0, fmt.Errorf("The --print-public-keys option can't be combined with a command, --socket-name or --pid-file.")
+		}
+	}
+	if len(confirmCommand) > 0 && len(confirmSocket) > 0 {
+		return 0, fmt.Errorf("At most one of the --confirm-command and --confirm-socket options can be provided.")
+	}
+	if confirm && len(confirmCommand) == 0 && len(confirmSocket) == 0 {
+		return 0, fmt.Errorf("The --confirm option requires --confirm-command or --confirm-socket.")
+	}
+
+	a := agent.Agent{Keys: agent.NewKeyStore(allowAdd)}
+	if len(confirmCommand) > 0 {
+		a.Confirm = agent.ConfirmCommand(confirmCommand, confirmTimeout)
+	} else if len(confirmSocket) > 0 {
+		a.Confirm = agent.ConfirmSocket(confirmSocket, confirmTimeout)
+	}
+	if len(rateLimit) > 0 || len(uidRateLimit) > 0 {
+		keyLimit, err := parseOptionalRateLimit(rateLimit)
+		if err != nil {
+			return 0, err
+		}
+		uidLimit, err := parseOptionalRateLimit(uidRateLimit)
+		if err != nil {
+			return 0, err
+		}
+		a.Limiter = agent.NewRateLimiter(keyLimit, uidLimit)
+		go func() {
+			ch := make(chan os.Signal, 1)
+			signal.Notify(ch, syscall.SIGUSR1)
+			for range ch {
+				for _, line := range a.Limiter.Stats() {
+					log.Print(line)
+				}
+			}
+		}()
+	}
+
+	if len(witnessLogs) > 0 {
+		if len(witnessState) == 0 {
+			return 0, fmt.Errorf("The --witness-logs option requires --witness-state.")
+		}
+		origins, err := agent.ReadOriginsFile(witnessLogs)
+		if err != nil {
+			return 0, err
+		}
+		state, err := agent.NewTreeState(witnessState)
+		if err != nil {
+			return 0, err
+		}
+		a.Policy = &agent.WitnessPolicy{Origins: origins, MaxSkew: witnessMaxSkew, State: state}
+	} else if len(witnessState) > 0 {
+		return 0, fmt.Errorf("The --witness-state option requires --witness-logs.")
+	}
+	if len(noteName) > 0 {
+		if a.Policy != nil {
+			return 0, fmt.Errorf("At most one of the --witness-logs and --note-name options can be provided.")
+		}
+		if err := agent.CheckNoteKeyName(noteName); err != nil {
+			return 0, err
+		}
+		policy := agent.NotePolicy{Name: noteName}
+		if len(noteCheckpointState) > 0 {
+			state, err := agent.NewTreeState(noteCheckpointState)
+			if err != nil {
+				return 0, err
+			}
+			policy.State = state
+		}
+		a.Policy = &policy
+	} else if len(noteCheckpointState) > 0 {
+		return 0, fmt.Errorf("The --note-checkpoint-state option requires --note-name.")
+	}
+
+	// Public keys of the keys configured at startup.
+	var publicKeys []ed25519.PublicKey
+	if len(keyFile) > 0 {
+		signer, err := agent.ReadPrivateKeyFile(keyFile)
+		if err != nil {
+			return 0, fmt.Errorf("Reading private key file %q failed: %v", keyFile, err)
+		}
+		sshKey, sshSign, err := agent.SSHFromEd25519(signer)
+		if err != nil {
+			return 0, fmt.Errorf("Internal error: %v", err)
+		}
+		a.Keys.AddStatic(sshKey, sshSign, confirm)
+		publicKeys = append(publicKeys, signer.Public().(ed25519.PublicKey))
+	} else if len(keyIds) > 0 {
+		keys, err := parseKeys(keyIds, keyValidity, hsmKeyLabels, hsmKeyDomains)
+		if err != nil {
+			return 0, err
+		}
+		credentials, err := auth.Read()
+		if err != nil {
+			return 0, err
+		}
+		expected, err := parseExpected(hsmSerial, hsmKeyCapabilities)
+		if err != nil {
+			return 0, err
+		}
+		device, err := openHSM(connectorURL, connectorPin, credentials,
+			hsmSessions, hsmQueueTimeout, retry)
+		if err != nil {
+			return 0, fmt.Errorf("Connecting to hsm failed: %v", err)
+		}
+		defer device.Close()
+		for _, key := range keys {
+			hsmSigner, err := hsm.NewYubiHSMSigner(device, key.id)
+			if err != nil {
+				return 0, fmt.Errorf("Using hsm key %d failed: %v", key.id, err)
+			}
+			keyExpected := *expected
+			keyExpected.Label = key.label
+			keyExpected.Domains = key.domains
+			if err := hsmSigner.Check(&keyExpected); err != nil {
+				return 0, fmt.Errorf("Checking hsm failed, refusing to start: %v", err)
+			}
+			if hsmHealthInterval > 0 {
+				go healthCheck(hsmSigner, &keyExpected, hsmHealthInterval)
+			}
+			sshKey, sshSign, err := agent.SSHFromEd25519(hsmSigner)
+			if err != nil {
+				return 0, fmt.Errorf("Internal error: %v", err)
+			}
+			if !key.notAfter.IsZero() && !time.Now().Before(key.notAfter) {
+				log.Printf("Validity of hsm key %d ended at %s, not using it", key.id, key.notAfter.Format(time.RFC3339))
+				continue
+			}
+			if len(keys) > 1 || !key.notBefore.IsZero() || !key.notAfter.IsZero() {
+				log.Printf("Using hsm key %d, %s, %s", key.id, agent.Fingerprint(sshKey), key.formatValidity())
+			}
+			a.Keys.AddStaticWithValidity(sshKey, sshSign, confirm, key.notBefore, key.notAfter)
+			publicKeys = append(publicKeys, hsmSigner.Public().(ed25519.PublicKey))
+		}
+	}
+
+	if len(printFormat) > 0 {
+		for _, pub := range publicKeys {
+			if printFormat == "note" {
+				fmt.Println(agent.NoteVerifierKey(noteName, pub))
+				continue
+			}
+			s, err := pubkey.Format(pub, printFormat)
+			if err != nil {
+				return 0, err
+			}
+			fmt.Println(s)
+		}
+		return 0, nil
+	}
+	if len(noteName) > 0 {
+		for _, pub := range publicKeys {
+			log.Printf("Note verifier key: %s", agent.NoteVerifierKey(noteName, pub))
+		}
 	}
 
 	printSocket := false
@@ -166,47 +538,9 @@ stdout, they are written as one line each, pid first.
 		defer socket.Close()
 		defer os.Remove(socketName)
 	}
-	var signer crypto.Signer
-	if len(keyFile) > 0 {
-		var err error
-		signer, err = agent.ReadPrivateKeyFile(keyFile)
-		if err != nil {
-			return 0, fmt.Errorf("Reading private key file %q failed: %v", keyFile, err)
-		}
-	} else {
-		if keyId >= 0x10000 {
-			return 0, fmt.Errorf("Key id %d out of range.", keyId)
-		}
-		buf, err := os.ReadFile(authFile)
-		if err != nil {
-			return 0, fmt.Errorf("Reading auth file %q failed: %v", authFile, err)
-		}
-		buf = bytes.TrimSpace(buf)
-		colon := bytes.Index(buf, []byte{':'})
-		if colon < 0 {
-			return 0, fmt.Errorf("Invalid auth file %q, missing ':'", authFile)
-		}
-		authId, err := strconv.ParseUint(string(buf[:colon]), 10, 16)
-		if err != nil {
-			return 0, fmt.Errorf("Invalid auth id in file %q: %v", authFile, err)
-		}
-		authPassword := string(buf[colon+1:])
-		hsmSigner, err := openHSM(connector, uint16(authId), authPassword, uint16(keyId), retry)
-		if err != nil {
-			return 0, fmt.Errorf("Connecting to hsm failed: %v", err)
-		}
-		defer hsmSigner.Close()
-		signer = hsmSigner
-	}
-
-	sshKey, sshSign, err := agent.SSHFromEd25519(signer)
-	if err != nil {
-		return 0, fmt.Errorf("Internal error: %v", err)
-	}
-	keys := map[string]agent.SSHSign{sshKey: sshSign}
 
 	if len(set.Args()) > 0 {
-		go runAgent(socket, keys)
+		go runAgent(socket, &a)
 
 		cmd := createCommand(socketName, pidFile != "-", set.Args())
 		if err := cmd.Start(); err != nil {
@@ -259,10 +593,168 @@ stdout, they are written as one line each, pid first.
 		<-ch
 		socket.Close()
 	}()
-	runAgent(socket, keys)
+	runAgent(socket, &a)
 	return 0, nil
 }
 
+// Parses the expectations common to all keys; the expected label and
+// domains are per key, see parseKeys.
+func parseExpected(serial int, capabilities string) (*hsm.Expected, error) {
+	if serial < 0 || serial > math.MaxUint32 {
+		return nil, fmt.Errorf("Invalid hsm serial number %d.", serial)
+	}
+	expected := hsm.Expected{Serial: uint32(serial)}
+	if len(capabilities) > 0 {
+		var err error
+		expected.Capabilities, err = hsm.ParseCapabilities(capabilities)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --hsm-key-capabilities: %v", err)
+		}
+	}
+	return &expected, nil
+}
+
+// Runs periodic health checks, logging failures, and logging when
+// checks succeed again after a failure.
+func healthCheck(signer *hsm.YubiHSMSigner, expected *hsm.Expected, interval time.Duration) {
+	failing := false
+	for range time.Tick(interval) {
+		if err := signer.Check(expected); err != nil {
+			log.Printf("HSM health check failed: %v", err)
+			failing = true
+		} else if failing {
+			log.Printf("HSM health check succeeded")
+			failing = false
+		}
+	}
+}
+
+// A yubihsm key to use, with optional validity period, and optional
+// expected label and domains.
+type hsmKey struct {
+	id        uint16
+	notBefore time.Time
+	notAfter  time.Time
+	label     string
+	domains   uint16
+}
+
+func (k *hsmKey) formatValidity() string {
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("valid from %s until %s", format(k.notBefore), format(k.notAfter))
+}
+
+// The empty string means no limit.
+func parseValidityTime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	return manifest.ParseTime(s)
+}
+
+// Parses key ids, validity periods of the form ID=FROM/UNTIL, and
+// expected labels and domains of the form [ID=]VALUE, where the id can
+// be omitted if there's a single key.
+func parseKeys(ids, validity, labels, domains []string) ([]*hsmKey, error) {
+	var keys []*hsmKey
+	find := func(id uint64) *hsmKey {
+		for _, key := range keys {
+			if uint64(key.id) == id {
+				return key
+			}
+		}
+		return nil
+	}
+	for _, s := range ids {
+		id, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key id %q.", s)
+		}
+		if find(id) != nil {
+			return nil, fmt.Errorf("Duplicate key id %d.", id)
+		}
+		keys = append(keys, &hsmKey{id: uint16(id)})
+	}
+	for _, s := range validity {
+		idString, period, ok := strings.Cut(s, "=")
+		from, until, ok2 := strings.Cut(period, "/")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("Invalid key validity %q, expected ID=FROM/UNTIL.", s)
+		}
+		id, err := strconv.ParseUint(idString, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key id in key validity %q.", s)
+		}
+		key := find(id)
+		if key == nil {
+			return nil, fmt.Errorf("Key validity %q for key not given with --key-id.", s)
+		}
+		if key.notBefore, err = parseValidityTime(from); err != nil {
+			return nil, fmt.Errorf("Invalid start time in key validity %q: %v", s, err)
+		}
+		if key.notAfter, err = parseValidityTime(until); err != nil {
+			return nil, fmt.Errorf("Invalid end time in key validity %q: %v", s, err)
+		}
+		if !key.notAfter.IsZero() && !key.notBefore.Before(key.notAfter) {
+			return nil, fmt.Errorf("Empty validity period in key validity %q.", s)
+		}
+	}
+	keyValue := func(option, s string) (*hsmKey, string, error) {
+		if idString, value, ok := strings.Cut(s, "="); ok {
+			if id, err := strconv.ParseUint(idString, 10, 16); err == nil {
+				key := find(id)
+				if key == nil {
+					return nil, "", fmt.Errorf("Option --%s %q for key not given with --key-id.", option, s)
+				}
+				return key, value, nil
+			}
+		}
+		if len(keys) != 1 {
+			return nil, "", fmt.Errorf("Invalid --%s %q, expected ID=VALUE when using several keys.", option, s)
+		}
+		return keys[0], s, nil
+	}
+	for _, s := range labels {
+		key, label, err := keyValue("hsm-key-label", s)
+		if err != nil {
+			return nil, err
+		}
+		if len(key.label) > 0 {
+			return nil, fmt.Errorf("Duplicate --hsm-key-label for key %d.", key.id)
+		}
+		key.label = label
+	}
+	for _, s := range domains {
+		key, value, err := keyValue("hsm-key-domains", s)
+		if err != nil {
+			return nil, err
+		}
+		if key.domains != 0 {
+			return nil, fmt.Errorf("Duplicate --hsm-key-domains for key %d.", key.id)
+		}
+		if key.domains, err = hsm.ParseDomains(value); err != nil {
+			return nil, fmt.Errorf("Invalid --hsm-key-domains %q: %v", s, err)
+		}
+	}
+	return keys, nil
+}
+
+func parseOptionalRateLimit(s string) (*agent.RateLimit, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	limit, err := agent.ParseRateLimit(s)
+	if err != nil {
+		return nil, err
+	}
+	return &limit, nil
+}
+
 // If the file isn't a listening socket, returns nil listener, no error.
 func inetdSocket(f *os.File) (net.Listener, error) {
 	acceptConn, err := syscall.GetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
@@ -280,12 +772,13 @@ func openSocket(socketName string) (net.Listener, error) {
 }
 
 // We need the connector to be up and running, to initialize and
-// retrieve the public key. Optionally retry a few times, in case the
+// retrieve the public keys. Optionally retry a few times, in case the
 // connector is just being started.
-func openHSM(connector string, authId uint16, authPassword string, keyId uint16, retry bool) (*hsm.YubiHSMSigner, error) {
-	hsmSigner, err := hsm.NewYubiHSMSigner(connector, authId, authPassword, keyId)
+func openHSM(connector, connectorPin string, credentials *hsm.Credentials,
+	sessions int, queueTimeout time.Duration, retry bool) (*hsm.Device, error) {
+	device, err := newHSMDevice(connector, connectorPin, credentials, sessions, queueTimeout)
 	if err == nil {
-		return hsmSigner, nil
+		return device, nil
 	}
 	if !retry {
 		return nil, err
@@ -293,23 +786,33 @@ func openHSM(connector string, authId uint16, authPassword string, keyId uint16,
 	for _, delay := range []int{1, 2, 4, 8} {
 		log.Printf("Connecting to HSM failed: %v, retrying in %d seconds", err, delay)
 		time.Sleep(time.Duration(delay) * time.Second)
-		hsmSigner, err = hsm.NewYubiHSMSigner(connector, authId, authPassword, keyId)
+		device, err = newHSMDevice(connector, connectorPin, credentials, sessions, queueTimeout)
 		if err == nil {
 			log.Printf("Connected to HSM")
-			return hsmSigner, nil
+			return device, nil
 		}
 	}
 	return nil, fmt.Errorf("Connecting to HSM failed: %v", err)
 }
 
-func serveAndClose(c net.Conn, keys map[string]agent.SSHSign) {
+func newHSMDevice(connectorURL, connectorPin string, credentials *hsm.Credentials,
+	sessions int, queueTimeout time.Duration) (*hsm.Device, error) {
+	conn, err := hsm.OpenConnector(connectorURL, connectorPin)
+	if err != nil {
+		return nil, err
+	}
+	return hsm.OpenDevice(conn,
+		credentials.AuthKeyId, credentials.Key, sessions, queueTimeout)
+}
+
+func serveAndClose(c net.Conn, a *agent.Agent) {
 	defer c.Close()
-	agent.ServeAgent(c, c, keys)
+	a.ServeAgent(c, c, agent.PeerCredentials(c))
 }
 
 // Accepts connections, and spawns a serving goroutine for each. Will
 // return when the listening socket is closed under its feet.
-func runAgent(socket net.Listener, keys map[string]agent.SSHSign) {
+func runAgent(socket net.Listener, a *agent.Agent) {
 	for {
 		c, err := socket.Accept()
 		if err != nil {
@@ -318,7 +821,7 @@ func runAgent(socket net.Listener, keys map[string]agent.SSHSign) {
 			// good way to check for that.
 			return
 		}
-		go serveAndClose(c, keys)
+		go serveAndClose(c, a)
 	}
 }
 
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/hsm"
+)
+
+func auditCommand(args []string) error {
+	const help = `
+Read the device's audit log, verify that the entries form a valid
+hash chain, continuing the chain of the entries in the log file,
+append the new entries to the log file, one line per entry, and then
+acknowledge them (set-log-index), so that the device can reuse the
+space. The authentication key must have the get-log-entries
+capability.
+
+With the --interval option, the log is read periodically, until the
+process is killed. Errors when accessing the device are logged, and
+retried at the next interval, but a broken hash chain is fatal.
+`
+	var opts deviceOptions
+	logFile := ""
+	interval := time.Duration(0)
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&logFile, "log-file", 'f', "file to append log entries to")
+	set.FlagLong(&interval, "interval", 0, "interval for reading the log, 0 means only once")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(logFile) == 0 {
+		return fmt.Errorf("the --log-file option is required")
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	if interval == 0 {
+		return pullAuditLog(device, logFile)
+	}
+	for {
+		err := pullAuditLog(device, logFile)
+		var chainErr *chainError
+		if errors.As(err, &chainErr) {
+			return err
+		}
+		if err != nil {
+			log.Printf("reading audit log failed: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Indicates that the device's log doesn't extend the archived log.
+type chainError struct {
+	err error
+}
+
+func (e *chainError) Error() string {
+	return e.err.Error()
+}
+
+// Reads and verifies the archived log, and returns its last entry,
+// or nil if the archive doesn't exist or is empty.
+func readLogArchive(logFile string) (*hsm.LogEntry, error) {
+	f, err := os.Open(logFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []hsm.LogEntry
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		e, err := hsm.ParseLogEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", logFile, lineno, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if err := hsm.VerifyLogChain(nil, entries); err != nil {
+		return nil, &chainError{fmt.Errorf("archived log %q is invalid: %v", logFile, err)}
+	}
+	return &entries[len(entries)-1], nil
+}
+
+func pullAuditLog(device *hsm.Device, logFile string) error {
+	prev, err := readLogArchive(logFile)
+	if err != nil {
+		return err
+	}
+	status, err := device.GetLogs()
+	if err != nil {
+		return err
+	}
+	if status.UnloggedBoots > 0 || status.UnloggedAuths > 0 {
+		log.Printf("warning: audit log was full, %d boot events and %d authentication events not logged",
+			status.UnloggedBoots, status.UnloggedAuths)
+	}
+	if len(status.Entries) == 0 {
+		return nil
+	}
+	entries := status.Entries
+	if prev != nil {
+		// Skip entries archived before, e.g., if acknowledging
+		// failed.
+		for i, e := range entries {
+			if e.Number == prev.Number {
+				if e != *prev {
+					return &chainError{fmt.Errorf("log entry %d differs from the archived entry", e.Number)}
+				}
+				entries = entries[i+1:]
+				break
+			}
+		}
+	} else {
+		log.Printf("starting new audit log archive at entry %d", entries[0].Number)
+	}
+	if err := hsm.VerifyLogChain(prev, entries); err != nil {
+		return &chainError{err}
+	}
+	if len(entries) > 0 {
+		if err := appendLogEntries(logFile, entries); err != nil {
+			return err
+		}
+	}
+	return device.SetLogIndex(status.Entries[len(status.Entries)-1].Number)
+}
+
+func appendLogEntries(logFile string, entries []hsm.LogEntry) error {
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		fmt.Fprintln(w, e.String())
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/pborman/getopt/v2"
+)
+
+func deriveKeyCommand(args []string) error {
+	const help = `
+Read a passphrase, as a single line on stdin, and write the derived
+32-byte authentication key, hex encoded, to stdout. The key can be
+used in place of the passphrase with the --auth-derived-key option.
+`
+	set := getopt.New()
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return fmt.Errorf("reading passphrase failed: %v", err)
+	}
+	passphrase := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	fmt.Printf("%x\n", []byte(authkey.NewFromPassword(passphrase)))
+	return nil
+}
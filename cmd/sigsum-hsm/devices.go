@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/hsm"
+)
+
+func listDevicesCommand(args []string) error {
+	const help = `
+Print the serial numbers of attached YubiHSMs, one per line, found by
+direct usb enumeration. With --connector, print instead the serial
+number of the device served by that connector, e.g., yubihsm-connector
+or yubihsm-sim. If the connector doesn't report the serial number, as
+yubihsm-connector without --serial, it is read from the device. No
+session is opened, so no credentials are needed.
+The provisioning scripts use this to select devices by serial number.
+`
+	url := ""
+	pin := ""
+
+	set := getopt.New()
+	set.FlagLong(&url, "connector", 'c', "host:port, unix:path, https://host:port, or yhusb://")
+	set.FlagLong(&pin, "connector-pin", 0, "sha256 fingerprint of the https connector's certificate")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(set.Args()) > 0 {
+		return fmt.Errorf("no arguments expected")
+	}
+	if len(url) == 0 {
+		serials, err := hsm.ListUSBDevices()
+		if err != nil {
+			return err
+		}
+		for _, serial := range serials {
+			fmt.Printf("%d\n", serial)
+		}
+		return nil
+	}
+	conn, err := hsm.OpenConnector(url, pin)
+	if err != nil {
+		return err
+	}
+	defer hsm.CloseConnector(conn)
+	status, err := conn.GetStatus()
+	if err != nil {
+		return err
+	}
+	// A yubihsm-connector started without --serial serves any
+	// device, and reports serial "*".
+	if status.Serial == "*" {
+		serial, err := hsm.ReadSerial(conn)
+		if err != nil {
+			return fmt.Errorf("reading serial number from device failed: %v", err)
+		}
+		fmt.Printf("%d\n", serial)
+		return nil
+	}
+	serial, err := strconv.ParseUint(status.Serial, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid serial number %q reported by connector: %v", status.Serial, err)
+	}
+	fmt.Printf("%d\n", serial)
+	return nil
+}
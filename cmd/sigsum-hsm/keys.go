@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/hsm"
+	"sigsum.org/key-mgmt/internal/pubkey"
+)
+
+// Options for the attributes of an object to be created.
+type attributeOptions struct {
+	id           uint16
+	label        string
+	domains      string
+	capabilities string
+	delegated    string
+}
+
+func (o *attributeOptions) register(set *getopt.Set, delegated bool) {
+	set.FlagLong(&o.id, "id", 0, "object id")
+	set.FlagLong(&o.label, "label", 0, "object label")
+	set.FlagLong(&o.domains, "domains", 0, "comma separated list of domains, or all")
+	set.FlagLong(&o.capabilities, "capabilities", 0, "comma separated list of capabilities")
+	if delegated {
+		set.FlagLong(&o.delegated, "delegated", 0, "comma separated list of delegated capabilities")
+	}
+}
+
+func (o *attributeOptions) parse() (*hsm.ObjectAttributes, error) {
+	if o.id == 0 {
+		return nil, fmt.Errorf("the --id option is required")
+	}
+	if len(o.domains) == 0 {
+		return nil, fmt.Errorf("the --domains option is required")
+	}
+	domains, err := hsm.ParseDomains(o.domains)
+	if err != nil {
+		return nil, err
+	}
+	capabilities, err := hsm.ParseCapabilities(o.capabilities)
+	if err != nil {
+		return nil, err
+	}
+	var delegated uint64
+	if len(o.delegated) > 0 {
+		delegated, err = hsm.ParseCapabilities(o.delegated)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &hsm.ObjectAttributes{
+		Id:           o.id,
+		Label:        o.label,
+		Domains:      domains,
+		Capabilities: capabilities,
+		Delegated:    delegated,
+	}, nil
+}
+
+func generateKeyCommand(args []string) error {
+	const help = `
+Generate an Ed25519 key on the device, with the given id, label,
+domains and capabilities, and write the public key to stdout, by
+default hex encoded; see the public-key command for other formats.
+By default, the key gets the capabilities needed for signing and for
+backup under wrap, as by the provisioning scripts.
+`
+	var opts deviceOptions
+	attributes := attributeOptions{capabilities: "exportable-under-wrap,sign-eddsa"}
+	format := pubkey.FormatHex
+
+	set := getopt.New()
+	opts.register(set)
+	attributes.register(set, false)
+	set.FlagLong(&format, "format", 0, "public key output format")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if err := pubkey.CheckFormat(format); err != nil {
+		return err
+	}
+	a, err := attributes.parse()
+	if err != nil {
+		return err
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	id, err := device.GenerateEd25519Key(a)
+	if err != nil {
+		return err
+	}
+	pub, err := device.GetPublicKey(id)
+	if err != nil {
+		return err
+	}
+	return printPublicKey(pub, format)
+}
+
+func publicKeyCommand(args []string) error {
+	const help = `
+Print an Ed25519 public key, read from the device, if --id is given,
+or else from FILE, or stdin. A key read from a file can be hex
+encoded, as used by sigsum, in OpenSSH format, PEM encoded, as
+written by openssl and yubihsm-shell, or base64 encoded. The output
+format (--format) is one of:
+
+  hex       Hex encoded, as used in sigsum policy and configuration
+            files (default).
+  openssh   OpenSSH format, as in authorized_keys files.
+  pem       PEM encoded SubjectPublicKeyInfo.
+  base64    The 32-byte key, base64 encoded.
+  key-hash  SHA-256 hash of the key, hex encoded, as used by sigsum
+            to identify keys.
+
+The --all option prints the key in each format, labeled by the
+format name.
+`
+	var opts deviceOptions
+	id := uint16(0)
+	format := pubkey.FormatHex
+	all := false
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&id, "id", 0, "id of the key on the device")
+	set.FlagLong(&format, "format", 0, "output format")
+	set.FlagLong(&all, "all", 0, "print the key in all formats")
+	if ok, err := parseOptions(set, args, "[FILE]", help); !ok {
+		return err
+	}
+	if err := pubkey.CheckFormat(format); err != nil {
+		return err
+	}
+	var pub ed25519.PublicKey
+	switch {
+	case id != 0:
+		if len(set.Args()) > 0 {
+			return fmt.Errorf("a FILE argument can't be combined with --id")
+		}
+		device, err := opts.open()
+		if err != nil {
+			return err
+		}
+		defer device.Close()
+		if pub, err = device.GetPublicKey(id); err != nil {
+			return err
+		}
+	case len(set.Args()) == 1:
+		var err error
+		if pub, err = readPublicKeyFile(set.Arg(0)); err != nil {
+			return err
+		}
+	case len(set.Args()) == 0:
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		if pub, err = pubkey.Parse(data); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("at most one FILE argument is allowed")
+	}
+	if !all {
+		return printPublicKey(pub, format)
+	}
+	for _, f := range pubkey.Formats {
+		s, err := pubkey.Format(pub, f)
+		if err != nil {
+			return err
+		}
+		if f == pubkey.FormatPEM {
+			fmt.Printf("%s:\n%s\n", f, s)
+		} else {
+			fmt.Printf("%s: %s\n", f, s)
+		}
+	}
+	return nil
+}
+
+// Writes a public key to stdout, in the given format.
+func printPublicKey(pub ed25519.PublicKey, format string) error {
+	s, err := pubkey.Format(pub, format)
+	if err != nil {
+		return err
+	}
+	fmt.Println(s)
+	return nil
+}
+
+func putWrapKeyCommand(args []string) error {
+	const help = `
+Read an AES wrap key (16, 24 or 32 bytes), hex encoded, as a single
+line on stdin, and store it on the device, with the given id, label,
+domains, capabilities and delegated capabilities. The defaults are
+the attributes used by the provisioning scripts. The key can be
+generated with "yubihsm-shell" ("get random 0 16").
+`
+	var opts deviceOptions
+	attributes := attributeOptions{
+		domains:      "all",
+		capabilities: "import-wrapped,export-wrapped",
+		delegated:    "exportable-under-wrap,sign-eddsa",
+	}
+
+	set := getopt.New()
+	opts.register(set)
+	attributes.register(set, true)
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	a, err := attributes.parse()
+	if err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return fmt.Errorf("reading wrap key failed: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return fmt.Errorf("invalid wrap key: %v", err)
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	_, err = device.PutWrapKey(a, key)
+	return err
+}
+
+func putAuthKeyCommand(args []string) error {
+	const help = `
+Store an authentication key on the device, with the given label,
+domains, capabilities and delegated capabilities. The id and
+passphrase are read from the file given with --new-auth-file, in the
+same format as the --auth-file.
+`
+	var opts deviceOptions
+	attributes := attributeOptions{}
+	newAuthFile := ""
+
+	set := getopt.New()
+	opts.register(set)
+	attributes.register(set, true)
+	set.FlagLong(&newAuthFile, "new-auth-file", 0, "file with the new key's credentials")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(newAuthFile) == 0 {
+		return fmt.Errorf("the --new-auth-file option is required")
+	}
+	source := hsm.CredentialSource{File: newAuthFile}
+	credentials, err := source.Read()
+	if err != nil {
+		return err
+	}
+	if attributes.id != 0 && attributes.id != credentials.AuthKeyId {
+		return fmt.Errorf("the --id option doesn't match the id in %q", newAuthFile)
+	}
+	attributes.id = credentials.AuthKeyId
+	a, err := attributes.parse()
+	if err != nil {
+		return err
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	_, err = device.PutAuthKey(a, credentials.Key)
+	return err
+}
+
+func exportWrappedCommand(args []string) error {
+	const help = `
+Export an Ed25519 key under wrap. The wrapped key is written, base64
+encoded as by "yubihsm-shell get wrapped", to the given file. The
+key's public key, hex encoded, is written to a second file, with
+".pub" appended to the name, and is used to verify the key after
+import. Existing files are not overwritten.
+`
+	var opts deviceOptions
+	wrapKeyId := uint16(0)
+	keyId := uint16(0)
+	file := ""
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&wrapKeyId, "wrap-key-id", 0, "id of the wrap key")
+	set.FlagLong(&keyId, "id", 0, "id of the key to export")
+	set.FlagLong(&file, "file", 'f', "output file for the wrapped key")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if wrapKeyId == 0 || keyId == 0 || len(file) == 0 {
+		return fmt.Errorf("the --wrap-key-id, --id and --file options are required")
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	pub, err := device.GetPublicKey(keyId)
+	if err != nil {
+		return err
+	}
+	wrapped, err := device.ExportWrapped(wrapKeyId, commands.ObjectTypeAsymmetricKey, keyId)
+	if err != nil {
+		return err
+	}
+	if err := writeNewFile(file, base64.StdEncoding.EncodeToString(wrapped)+"\n"); err != nil {
+		return err
+	}
+	return writeNewFile(file+".pub", hex.EncodeToString(pub)+"\n")
+}
+
+func importWrappedCommand(args []string) error {
+	const help = `
+Import an Ed25519 key under wrap, from a file written by the
+export-wrapped command, and verify that the imported key has the
+expected public key, read from the file with ".pub" appended to the
+name, unless another file is given with --public-key-file. If the
+public key doesn't match, the imported key is deleted again. On
+success, the key's id is written to stdout.
+`
+	var opts deviceOptions
+	wrapKeyId := uint16(0)
+	file := ""
+	pubFile := ""
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&wrapKeyId, "wrap-key-id", 0, "id of the wrap key")
+	set.FlagLong(&file, "file", 'f', "file with the wrapped key")
+	set.FlagLong(&pubFile, "public-key-file", 0, "file with the expected public key")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if wrapKeyId == 0 || len(file) == 0 {
+		return fmt.Errorf("the --wrap-key-id and --file options are required")
+	}
+	if len(pubFile) == 0 {
+		pubFile = file + ".pub"
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid wrapped key file %q: %v", file, err)
+	}
+	pub, err := readPublicKeyFile(pubFile)
+	if err != nil {
+		return err
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	id, err := device.ImportWrappedEd25519(wrapKeyId, wrapped, pub)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d\n", id)
+	return nil
+}
+
+// Reads an Ed25519 public key, hex encoded, or in any other format
+// supported by pubkey.Parse.
+func readPublicKeyFile(file string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := pubkey.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key file %q: %v", file, err)
+	}
+	return pub, nil
+}
+
+// Creates a file, failing if it already exists.
+func writeNewFile[T string | []byte](file string, contents T) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(contents)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/ledger"
+	"sigsum.org/key-mgmt/internal/manifest"
+)
+
+func ledgerRecordCommand(args []string) error {
+	const help = `
+Record an event in the ledger of tamper-evident bags and the devices
+stored in them, and append it to the ledger file, which is created if
+it doesn't exist. The EVENT is one of:
+
+  seal     A new bag (--bag) is sealed at a location (--location), with
+           devices inside (--hsm, --secrets).
+  open     A sealed bag (--bag) is opened; its devices must be
+           resealed in a new bag, or retired.
+  move     A sealed bag (--bag) is moved to a new location (--location).
+  retire   Devices (--hsm, --secrets), not in a sealed bag, are taken
+           out of use.
+
+YubiHSMs are named by --hsm, e.g., by serial number. USB thumb drives
+and paper printouts holding passphrases are named by --secrets, as
+NAME=HSM+HSM..., listing the YubiHSMs the passphrases are valid for;
+once recorded, the list can be omitted. The event is signed by the
+operator (--signing-key), and is refused if it is inconsistent with
+the ledger, e.g., if a device would be in two places, or passphrases
+would be stored at the same location as a YubiHSM they are valid
+for. With --force, an inconsistent event is recorded anyway, e.g., to
+document the actual state after a mistake.
+`
+	var e ledger.Event
+	file := ""
+	signingKey := ""
+	hsms := []string{}
+	secrets := []string{}
+	at := ""
+	force := false
+
+	set := getopt.New()
+	set.FlagLong(&file, "ledger", 0, "ledger file")
+	set.FlagLong(&signingKey, "signing-key", 0, "operator's OpenSSH private key file, or public key file for a key in ssh-agent")
+	set.FlagLong(&e.Bag, "bag", 0, "tamper-evident bag serial number")
+	set.FlagLong(&e.Location, "location", 0, "storage location")
+	set.FlagLong(&hsms, "hsm", 0, "YubiHSM names")
+	set.FlagLong(&secrets, "secrets", 0, "passphrase device names, as NAME=HSM+HSM...")
+	set.FlagLong(&e.Notes, "notes", 0, "free-form notes")
+	set.FlagLong(&at, "time", 0, "time of the event, YYYY-MM-DD or RFC 3339 (default now)")
+	set.FlagLong(&force, "force", 0, "record the event even if it is inconsistent")
+	if ok, err := parseOptions(set, args, "EVENT", help); !ok {
+		return err
+	}
+	if len(set.Args()) != 1 {
+		return fmt.Errorf("a single EVENT argument is required")
+	}
+	e.Type = set.Arg(0)
+	if len(file) == 0 || len(signingKey) == 0 {
+		return fmt.Errorf("the --ledger and --signing-key options are required")
+	}
+	switch e.Type {
+	case ledger.EventSeal, ledger.EventOpen, ledger.EventMove, ledger.EventRetire:
+	default:
+		return fmt.Errorf("invalid event %q, expected seal, open, move or retire", e.Type)
+	}
+	e.Time = time.Now().UTC().Truncate(time.Second)
+	if len(at) > 0 {
+		t, err := manifest.ParseTime(at)
+		if err != nil {
+			return err
+		}
+		e.Time = t.UTC()
+	}
+	for _, name := range hsms {
+		e.Devices = append(e.Devices, ledger.Device{Name: name, Kind: ledger.KindYubiHSM})
+	}
+	for _, s := range secrets {
+		name, unlocks, _ := strings.Cut(s, "=")
+		d := ledger.Device{Name: name, Kind: ledger.KindSecrets}
+		if len(unlocks) > 0 {
+			d.Unlocks = strings.Split(unlocks, "+")
+		}
+		e.Devices = append(e.Devices, d)
+	}
+
+	signer, err := readOperatorKey(signingKey)
+	if err != nil {
+		return err
+	}
+	l, err := ledger.ReadFile(file, nil)
+	if err != nil {
+		return err
+	}
+	if err := l.CheckEvent(&e); err != nil {
+		if !force {
+			return fmt.Errorf("inconsistent event, use --force to record it anyway:\n%v", err)
+		}
+		log.Printf("warning: recording inconsistent event:\n%v", err)
+	}
+	line, err := l.Sign(&e, signer)
+	if err != nil {
+		return err
+	}
+	if err := ledger.AppendFile(file, line); err != nil {
+		return err
+	}
+	fmt.Printf("event %d: %s\n", e.Seq, e.Type)
+	return nil
+}
+
+func ledgerCheckCommand(args []string) error {
+	const help = `
+Check the ledger written by ledger-record: that the events are linked
+by their hashes, and signed by operators listed in the signers file,
+which lists OpenSSH public keys, one per line. Then replay the events,
+and report each inconsistency, including devices taken out of an
+opened bag that have been neither resealed nor retired.
+`
+	file := ""
+	signersFile := ""
+
+	set := getopt.New()
+	set.FlagLong(&file, "ledger", 0, "ledger file")
+	set.FlagLong(&signersFile, "signers", 0, "file with allowed operators' OpenSSH public keys")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(file) == 0 || len(signersFile) == 0 {
+		return fmt.Errorf("the --ledger and --signers options are required")
+	}
+	l, err := readLedger(file, signersFile)
+	if err != nil {
+		return err
+	}
+	if err := l.Check(); err != nil {
+		return fmt.Errorf("ledger %q is inconsistent:\n%v", file, err)
+	}
+	return nil
+}
+
+func ledgerShowCommand(args []string) error {
+	const help = `
+Print the ledger written by ledger-record as a markdown table, one
+row per event, or, with --devices, the current place of each device.
+If a signers file is given, the operators are checked as for
+ledger-check.
+`
+	file := ""
+	signersFile := ""
+	devices := false
+
+	set := getopt.New()
+	set.FlagLong(&file, "ledger", 0, "ledger file")
+	set.FlagLong(&signersFile, "signers", 0, "file with allowed operators' OpenSSH public keys")
+	set.FlagLong(&devices, "devices", 0, "show the current place of each device")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(file) == 0 {
+		return fmt.Errorf("the --ledger option is required")
+	}
+	l, err := readLedger(file, signersFile)
+	if err != nil {
+		return err
+	}
+	if devices {
+		printTable([]string{"Device", "Kind", "Bag serial number", "Storage location", "Since"},
+			func(row func(...string)) {
+				for _, p := range l.Places() {
+					location := p.Location
+					switch {
+					case p.Retired:
+						location = "(retired)"
+					case len(p.Bag) == 0:
+						location = fmt.Sprintf("(out of bag %s)", p.Event.Bag)
+					}
+					row(p.Device.Name, p.Device.Kind, p.Bag, location, p.Event.Time.Format(time.DateOnly))
+				}
+			})
+		return nil
+	}
+	printTable([]string{"Date", "Event", "Storage location", "Devices", "Bag serial number", "Notes"},
+		func(row func(...string)) {
+			for _, e := range l.Events {
+				row(e.Time.Format(time.DateOnly), e.Type, e.Location,
+					strings.Join(e.DeviceNames(), ", "), e.Bag, e.Notes)
+			}
+		})
+	return nil
+}
+
+// Reads and verifies a ledger, with operators restricted to the
+// signers file, if one is given.
+func readLedger(file, signersFile string) (*ledger.Ledger, error) {
+	if len(signersFile) == 0 {
+		return ledger.ReadFile(file, nil)
+	}
+	signers, err := readSignersFile(signersFile)
+	if err != nil {
+		return nil, err
+	}
+	return ledger.ReadFile(file, signers)
+}
+
+// Prints a markdown table, with columns padded to equal width.
+func printTable(header []string, rows func(row func(...string))) {
+	table := [][]string{header}
+	rows(func(cells ...string) {
+		for i := range cells {
+			cells[i] = strings.ReplaceAll(cells[i], "|", `\|`)
+		}
+		table = append(table, cells)
+	})
+	widths := make([]int, len(header))
+	for _, cells := range table {
+		for i, cell := range cells {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+	line := func(cells []string) {
+		for i, cell := range cells {
+			fmt.Printf("| %-*s ", widths[i], cell)
+		}
+		fmt.Printf("|\n")
+	}
+	line(header)
+	var dashes []string
+	for _, w := range widths {
+		dashes = append(dashes, strings.Repeat("-", w))
+	}
+	line(dashes)
+	for _, cells := range table[1:] {
+		line(cells)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/manifest"
+	"sigsum.org/key-mgmt/internal/pubkey"
+)
+
+func generateSuccessorCommand(args []string) error {
+	const help = `
+Generate a successor for an Ed25519 signing key (--id), with the given
+id (--successor-id), and the same label, domains and capabilities as
+the old key. The overlap period, when both keys are valid, starts at
+--not-before, when the successor becomes valid, and ends at
+--not-after, when the old key's validity ends. Times are given as
+YYYY-MM-DD (midnight UTC) or in RFC 3339 format. The lifecycle file
+(--lifecycle) is updated accordingly, and created if it doesn't
+exist. The successor's public key is written to stdout, by default
+hex encoded; see the public-key command for other formats.
+`
+	var opts deviceOptions
+	keyId := uint16(0)
+	successorId := uint16(0)
+	notBefore := ""
+	notAfter := ""
+	lifecycleFile := ""
+	format := pubkey.FormatHex
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&keyId, "id", 0, "id of the old key")
+	set.FlagLong(&successorId, "successor-id", 0, "id of the successor key")
+	set.FlagLong(&notBefore, "not-before", 0, "start of the successor's validity")
+	set.FlagLong(&notAfter, "not-after", 0, "end of the old key's validity")
+	set.FlagLong(&lifecycleFile, "lifecycle", 0, "lifecycle file")
+	set.FlagLong(&format, "format", 0, "public key output format")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if err := pubkey.CheckFormat(format); err != nil {
+		return err
+	}
+	if keyId == 0 || successorId == 0 || len(notBefore) == 0 || len(notAfter) == 0 || len(lifecycleFile) == 0 {
+		return fmt.Errorf("the --id, --successor-id, --not-before, --not-after and --lifecycle options are required")
+	}
+	if keyId == successorId {
+		return fmt.Errorf("the successor must have a different id than the old key")
+	}
+	start, err := manifest.ParseTime(notBefore)
+	if err != nil {
+		return err
+	}
+	end, err := manifest.ParseTime(notAfter)
+	if err != nil {
+		return err
+	}
+	if !start.Before(end) {
+		return fmt.Errorf("empty overlap period, --not-before must be before --not-after")
+	}
+	lifecycle, err := manifest.ReadLifecycleFile(lifecycleFile)
+	if err != nil {
+		return err
+	}
+	old := lifecycle.Key(keyId)
+	if old != nil && (old.Retired != nil || old.Successor != 0) {
+		return fmt.Errorf("key %d is retired, or already has a successor", keyId)
+	}
+	if lifecycle.Key(successorId) != nil {
+		return fmt.Errorf("key %d is already listed in the lifecycle file", successorId)
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	info, err := device.ObjectInfo(keyId, commands.ObjectTypeAsymmetricKey)
+	if err != nil {
+		return err
+	}
+	if info.Algorithm != commands.AlgorithmED25519 {
+		return fmt.Errorf("key %d is not an Ed25519 key", keyId)
+	}
+	oldPub, err := device.GetPublicKey(keyId)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		lifecycle.Keys = append(lifecycle.Keys, manifest.KeyLifecycle{
+			KeyId: keyId, PublicKey: hex.EncodeToString(oldPub)})
+		old = lifecycle.Key(keyId)
+	} else if old.PublicKey != hex.EncodeToString(oldPub) {
+		return fmt.Errorf("public key of key %d doesn't match the lifecycle file", keyId)
+	}
+	if old.NotBefore != nil && !old.NotBefore.Before(end) {
+		return fmt.Errorf("the old key's validity starts at %s, after --not-after", old.NotBefore.Format(time.RFC3339))
+	}
+
+	a := info.Attributes()
+	a.Id = successorId
+	if _, err := device.GenerateEd25519Key(a); err != nil {
+		return err
+	}
+	pub, err := device.GetPublicKey(successorId)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	old.NotAfter = &end
+	old.Successor = successorId
+	lifecycle.Keys = append(lifecycle.Keys, manifest.KeyLifecycle{
+		KeyId:       successorId,
+		PublicKey:   hex.EncodeToString(pub),
+		Created:     &now,
+		NotBefore:   &start,
+		Predecessor: keyId,
+	})
+	if err := manifest.WriteLifecycleFile(lifecycleFile, lifecycle); err != nil {
+		return err
+	}
+	return printPublicKey(pub, format)
+}
+
+func retireKeyCommand(args []string) error {
+	const help = `
+Retire a signing key (--id) whose validity has ended, according to
+the lifecycle file (--lifecycle): the key is deleted from the device,
+and the lifecycle file is updated. Unless --force is given, the end
+of the key's validity must be in the past, and its successor must be
+present on the device.
+`
+	var opts deviceOptions
+	keyId := uint16(0)
+	lifecycleFile := ""
+	force := false
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&keyId, "id", 0, "id of the key to retire")
+	set.FlagLong(&lifecycleFile, "lifecycle", 0, "lifecycle file")
+	set.FlagLong(&force, "force", 0, "skip validity and successor checks")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if keyId == 0 || len(lifecycleFile) == 0 {
+		return fmt.Errorf("the --id and --lifecycle options are required")
+	}
+	lifecycle, err := manifest.ReadLifecycleFile(lifecycleFile)
+	if err != nil {
+		return err
+	}
+	key := lifecycle.Key(keyId)
+	if key == nil {
+		return fmt.Errorf("key %d is not listed in the lifecycle file", keyId)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if !force {
+		if key.NotAfter == nil || now.Before(*key.NotAfter) {
+			return fmt.Errorf("validity of key %d has not ended", keyId)
+		}
+		if key.Successor == 0 {
+			return fmt.Errorf("key %d has no successor", keyId)
+		}
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	pub, err := device.GetPublicKey(keyId)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(pub) != key.PublicKey {
+		return fmt.Errorf("public key of key %d doesn't match the lifecycle file", keyId)
+	}
+	if !force {
+		pub, err := device.GetPublicKey(key.Successor)
+		if err != nil {
+			return fmt.Errorf("successor key %d not available: %v", key.Successor, err)
+		}
+		if successor := lifecycle.Key(key.Successor); hex.EncodeToString(pub) != successor.PublicKey {
+			return fmt.Errorf("public key of successor key %d doesn't match the lifecycle file", key.Successor)
+		}
+	}
+	if err := device.DeleteObject(keyId, commands.ObjectTypeAsymmetricKey); err != nil {
+		return err
+	}
+	key.Retired = &now
+	if err := manifest.WriteLifecycleFile(lifecycleFile, lifecycle); err != nil {
+		return err
+	}
+	fmt.Printf("key %d retired\n", keyId)
+	return nil
+}
+
+// Reads the lifecycle file, if any, into the manifest.
+func addLifecycle(m *manifest.Manifest, lifecycleFile string) error {
+	if len(lifecycleFile) == 0 {
+		return nil
+	}
+	lifecycle, err := manifest.ReadLifecycleFile(lifecycleFile)
+	if err != nil {
+		return err
+	}
+	return m.SetLifecycle(lifecycle)
+}
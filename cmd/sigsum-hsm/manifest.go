@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/agent"
+	"sigsum.org/key-mgmt/internal/manifest"
+)
+
+func manifestCommand(args []string) error {
+	const help = `
+Record the state of the device after a provisioning step in a JSON
+manifest: the device serial number, the objects on the device, with
+attributes and public keys, and signatures on a test message by each
+signing key. The manifest is written to the given file, and is signed
+with the operator's OpenSSH Ed25519 private key (--signing-key), or,
+if a public key file is given instead, with the corresponding key
+held by the ssh-agent at $SSH_AUTH_SOCK, e.g., sigsum-agent. The
+signature, in "ssh-keygen -Y sign" format, is written to a second
+file, with ".sig" appended to the name. Existing files are not
+overwritten. With --lifecycle, the lifecycle of signing keys, as
+maintained by generate-successor and retire-key, is included, after
+checking that it is consistent with the keys on the device.
+`
+	var opts deviceOptions
+	step := ""
+	file := ""
+	signingKey := ""
+	lifecycleFile := ""
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&step, "step", 0, "name of the provisioning step")
+	set.FlagLong(&file, "output", 'o', "output file for the manifest")
+	set.FlagLong(&signingKey, "signing-key", 0, "operator's OpenSSH private key file, or public key file for a key in ssh-agent")
+	set.FlagLong(&lifecycleFile, "lifecycle", 0, "lifecycle file of signing keys")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(step) == 0 || len(file) == 0 || len(signingKey) == 0 {
+		return fmt.Errorf("the --step, --output and --signing-key options are required")
+	}
+	signer, err := readOperatorKey(signingKey)
+	if err != nil {
+		return err
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	m, err := manifest.Collect(device, step)
+	if err != nil {
+		return err
+	}
+	if err := addLifecycle(m, lifecycleFile); err != nil {
+		return err
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	signature, err := manifest.Sign(data, signer)
+	if err != nil {
+		return err
+	}
+	if err := writeNewFile(file, string(data)); err != nil {
+		return err
+	}
+	return writeNewFile(file+".sig", string(signature))
+}
+
+func verifyManifestCommand(args []string) error {
+	const help = `
+Verify a signed manifest, written by the manifest command, against
+the device. The manifest signature, read from the file with ".sig"
+appended to the name, must be made by one of the keys in the signers
+file, which lists OpenSSH public keys, one per line. The device must
+have the serial number and the objects listed in the manifest, and
+signing keys must reproduce the recorded test signatures. Each
+discrepancy is reported.
+`
+	var opts deviceOptions
+	file := ""
+	signersFile := ""
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&file, "file", 'f', "manifest file")
+	set.FlagLong(&signersFile, "signers", 0, "file with allowed signers' OpenSSH public keys")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(file) == 0 || len(signersFile) == 0 {
+		return fmt.Errorf("the --file and --signers options are required")
+	}
+	m, err := readSignedManifest(file, signersFile)
+	if err != nil {
+		return err
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	if err := m.Verify(device); err != nil {
+		return fmt.Errorf("device doesn't match manifest %q:\n%v", file, err)
+	}
+	return nil
+}
+
+// Reads a manifest, and verifies its signature.
+func readSignedManifest(file, signersFile string) (*manifest.Manifest, error) {
+	signers, err := readSignersFile(signersFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := os.ReadFile(file + ".sig")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := manifest.VerifySignature(data, signature, signers); err != nil {
+		return nil, fmt.Errorf("manifest %q: %v", file, err)
+	}
+	return manifest.Parse(data)
+}
+
+// Reads OpenSSH public keys, one per line. Empty lines and lines
+// starting with '#' are ignored.
+func readSignersFile(file string) ([]ed25519.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ed25519.PublicKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		pub, err := agent.ParsePublicKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, i+1, err)
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys in signers file %q", file)
+	}
+	return keys, nil
+}
+
+// Returns a signer for the operator's key: the file is either an
+// OpenSSH private key, or an OpenSSH public key, for a key held by the
+// ssh-agent at $SSH_AUTH_SOCK. In the latter case, the connection to
+// the agent is kept open until the process exits.
+func readOperatorKey(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := agent.ParsePublicKey(string(data))
+	if err != nil {
+		return agent.ReadPrivateKeyFile(file)
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if len(socket) == 0 {
+		return nil, fmt.Errorf("%q is a public key, but SSH_AUTH_SOCK is not set", file)
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to ssh-agent failed: %v", err)
+	}
+	signer, err := agent.NewClientSigner(conn, pub)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return signer, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/manifest"
+	"sigsum.org/key-mgmt/internal/paper"
+)
+
+func paperExportCommand(args []string) error {
+	const help = `
+Write a printable document with passphrases, and optionally wrapped
+keys, as a second backup medium, besides USB thumb drives. Passphrases
+are read from the --passphrases file ("-" for stdin), as lines of the
+form NAME=PASSPHRASE, e.g., as output by the provisioning scripts;
+empty lines and lines starting with '#' are ignored. Each --wrapped
+file, written by export-wrapped, is included too, together with its
+".pub" file, if it exists.
+
+Each item is printed as lines of base32 text with checksums, and as a
+QR code. The lines include parity lines, so that the item can be
+recovered even if some lines are damaged or mistyped. The document
+has fields for the YubiHSM serial number and the serial number of the
+tamper-evident bag it is stored in, filled in from --serial and
+--bag-serial, or left blank to be filled in by hand. The format is
+plain text (default), or HTML (--format html). The output file must
+not exist.
+`
+	output := ""
+	format := "text"
+	title := "Sigsum key-mgmt paper backup"
+	passphrases := ""
+	wrapped := []string{}
+	serial := ""
+	bagSerial := ""
+
+	set := getopt.New()
+	set.FlagLong(&output, "output", 'o', "output file")
+	set.FlagLong(&format, "format", 0, "output format, text or html")
+	set.FlagLong(&title, "title", 0, "document title")
+	set.FlagLong(&passphrases, "passphrases", 0, "file with NAME=PASSPHRASE lines, or - for stdin")
+	set.FlagLong(&wrapped, "wrapped", 0, "wrapped key files")
+	set.FlagLong(&serial, "serial", 0, "YubiHSM serial number")
+	set.FlagLong(&bagSerial, "bag-serial", 0, "tamper-evident bag serial number")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(output) == 0 {
+		return fmt.Errorf("the --output option is required")
+	}
+	if format != "text" && format != "html" {
+		return fmt.Errorf("invalid format %q, expected text or html", format)
+	}
+	doc := paper.Document{
+		Title:        title,
+		Date:         time.Now().UTC().Format(time.DateOnly),
+		DeviceSerial: serial,
+		BagSerial:    bagSerial,
+		ToolVersion:  manifest.ToolVersion(),
+	}
+	if len(passphrases) > 0 {
+		items, err := readPassphrases(passphrases)
+		if err != nil {
+			return err
+		}
+		doc.Items = append(doc.Items, items...)
+	}
+	for _, file := range wrapped {
+		items, err := readWrapped(file)
+		if err != nil {
+			return err
+		}
+		doc.Items = append(doc.Items, items...)
+	}
+	if len(doc.Items) == 0 {
+		return fmt.Errorf("nothing to export, use the --passphrases or --wrapped options")
+	}
+	var b bytes.Buffer
+	var err error
+	if format == "html" {
+		err = doc.WriteHTML(&b)
+	} else {
+		err = doc.WriteText(&b)
+	}
+	if err != nil {
+		return err
+	}
+	return writeNewFile(output, b.String())
+}
+
+func readPassphrases(file string) ([]*paper.Item, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var items []*paper.Item
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		name, passphrase, ok := strings.Cut(line, "=")
+		if !ok || len(name) == 0 || len(passphrase) == 0 {
+			return nil, fmt.Errorf("invalid passphrase line, expected NAME=PASSPHRASE")
+		}
+		items = append(items, &paper.Item{Name: name, Type: paper.TypePassphrase, Data: []byte(passphrase)})
+	}
+	return items, scanner.Err()
+}
+
+func readWrapped(file string) ([]*paper.Item, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key file %q: %v", file, err)
+	}
+	name := filepath.Base(file)
+	items := []*paper.Item{{Name: name, Type: paper.TypeWrapped, Data: wrapped}}
+	if _, err := os.Stat(file + ".pub"); err == nil {
+		pub, err := readPublicKeyFile(file + ".pub")
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, &paper.Item{Name: name + ".pub", Type: paper.TypePublicKey, Data: pub})
+	}
+	return items, nil
+}
+
+func paperImportCommand(args []string) error {
+	const help = `
+Read items written by paper-export, from the given files, or from
+stdin, either as the typed lines of the printed text, or as data
+decoded from the QR codes. An item ends at an empty line. Lines with
+invalid checksums are reported and skipped; the item is recovered if
+enough valid lines remain. Passphrases are written to stdout, as
+NAME=PASSPHRASE lines. Wrapped keys and their public keys are written
+to the --output-dir directory, with their original names, in the
+format used by export-wrapped and import-wrapped. Existing files are
+not overwritten.
+`
+	outputDir := ""
+
+	set := getopt.New()
+	set.FlagLong(&outputDir, "output-dir", 'o', "directory for wrapped keys")
+	if ok, err := parseOptions(set, args, "[FILE...]", help); !ok {
+		return err
+	}
+	warn := func(msg string) { log.Printf("warning: %s", msg) }
+	var items []*paper.Item
+	if len(set.Args()) == 0 {
+		var err error
+		if items, err = paper.Read(os.Stdin, warn); err != nil {
+			return err
+		}
+	}
+	for _, file := range set.Args() {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		fileItems, err := paper.Read(f, warn)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		items = append(items, fileItems...)
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("no items found")
+	}
+	for _, item := range items {
+		switch item.Type {
+		case paper.TypePassphrase:
+			fmt.Printf("%s=%s\n", item.Name, item.Data)
+			continue
+		case paper.TypeWrapped, paper.TypePublicKey:
+		default:
+			return fmt.Errorf("item %q has unknown type %q", item.Name, item.Type)
+		}
+		if len(outputDir) == 0 {
+			return fmt.Errorf("item %q is a key, the --output-dir option is required", item.Name)
+		}
+		if filepath.Base(item.Name) != item.Name || item.Name == ".." {
+			return fmt.Errorf("invalid item name %q", item.Name)
+		}
+		contents := hex.EncodeToString(item.Data)
+		if item.Type == paper.TypeWrapped {
+			contents = base64.StdEncoding.EncodeToString(item.Data)
+		}
+		if err := writeNewFile(filepath.Join(outputDir, item.Name), contents+"\n"); err != nil {
+			return err
+		}
+		log.Printf("wrote %s", filepath.Join(outputDir, item.Name))
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/hsm"
+)
+
+func planCommand(args []string) error {
+	const help = `
+Read yubihsm-shell commands, as run by the provisioning scripts, from
+the given file, or from stdin, and print a plan of the objects they
+create, delete, export and import, checked against the objects
+currently on the device. E.g., creating an object that already exists,
+or exporting, using or deleting an object that doesn't exist, are
+reported as problems, and then the command fails. Nothing on the
+device is modified.
+
+Unless an authorization file, or another credential source, is given,
+the session is opened with the credentials of the first "session
+open" command. Only the commands used by the provisioning scripts are
+supported: connect, session, put authkey, put wrapkey, put wrapped,
+generate asymmetric, get wrapped, get pubkey, get random, sign eddsa,
+delete and list objects.
+`
+	var opts deviceOptions
+
+	set := getopt.New()
+	opts.register(set)
+	if ok, err := parseOptions(set, args, "[FILE]", help); !ok {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	switch len(set.Args()) {
+	case 0:
+	case 1:
+		f, err := os.Open(set.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	default:
+		return fmt.Errorf("at most one FILE argument is allowed")
+	}
+	steps, err := readShellCommands(r)
+	if err != nil {
+		return err
+	}
+	credentials, err := planCredentials(&opts, steps)
+	if err != nil {
+		return err
+	}
+	device, err := opts.openCredentials(opts.connector, credentials)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	info, err := device.DeviceInfo()
+	if err != nil {
+		return err
+	}
+	objects, err := device.ListObjects()
+	if err != nil {
+		return err
+	}
+	p := newPlan(objects)
+	for _, step := range steps {
+		p.step(step)
+	}
+	fmt.Printf("YubiHSM serial %d, %d existing objects\n", info.SerialNumber, len(objects))
+	for _, action := range p.actions {
+		fmt.Printf("  %s\n", action)
+	}
+	if len(p.actions) == 0 {
+		fmt.Printf("  no objects are modified\n")
+	}
+	for _, problem := range p.problems {
+		fmt.Printf("  problem: %s\n", problem)
+	}
+	if len(p.problems) > 0 {
+		return fmt.Errorf("the plan can't be carried out, %d problems", len(p.problems))
+	}
+	return nil
+}
+
+// A yubihsm-shell command, split into words, and its line number.
+type shellCommand struct {
+	line  int
+	words []string
+}
+
+// Reads yubihsm-shell commands, one per line. Words are separated by
+// white space, and can be quoted with double quotes.
+func readShellCommands(r io.Reader) ([]shellCommand, error) {
+	var cmds []shellCommand
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		var words []string
+		var word strings.Builder
+		inWord, quoted := false, false
+		for _, c := range scanner.Text() {
+			switch {
+			case c == '"':
+				quoted = !quoted
+				inWord = true
+			case !quoted && (c == ' ' || c == '\t'):
+				if inWord {
+					words = append(words, word.String())
+					word.Reset()
+					inWord = false
+				}
+			default:
+				word.WriteRune(c)
+				inWord = true
+			}
+		}
+		if quoted {
+			return nil, fmt.Errorf("line %d: unterminated quote", n)
+		}
+		if inWord {
+			words = append(words, word.String())
+		}
+		if len(words) > 0 && !strings.HasPrefix(words[0], "#") {
+			cmds = append(cmds, shellCommand{line: n, words: words})
+		}
+	}
+	return cmds, scanner.Err()
+}
+
+// Returns the credentials from the options, if given, or else from
+// the first "session open" command.
+func planCredentials(opts *deviceOptions, steps []shellCommand) (*hsm.Credentials, error) {
+	if opts.auth.IsSet() {
+		return opts.auth.Read()
+	}
+	for _, step := range steps {
+		if w := step.words; len(w) == 4 && w[0] == "session" && w[1] == "open" {
+			return hsm.ParseCredentials([]byte(w[2]+":"+w[3]), false)
+		}
+	}
+	return nil, fmt.Errorf("no \"session open\" command, and no credentials given")
+}
+
+type planKey struct {
+	objectType uint8
+	id         uint16
+}
+
+type plan struct {
+	objects map[planKey]string // Labels of existing objects.
+	// Files imported by "put wrapped", where the key id is not
+	// known until the key is used. Indices into actions.
+	pendingImports []int
+	actions        []string
+	problems       []string
+}
+
+func newPlan(objects []*hsm.ObjectInfo) *plan {
+	p := plan{objects: make(map[planKey]string)}
+	for _, o := range objects {
+		p.objects[planKey{o.Type, o.Id}] = o.Label
+	}
+	return &p
+}
+
+func describeObject(objectType uint8, id uint16) string {
+	return fmt.Sprintf("%s %d", hsm.FormatObjectType(objectType), id)
+}
+
+func (p *plan) problem(step shellCommand, format string, args ...any) {
+	p.problems = append(p.problems, fmt.Sprintf("line %d: %s", step.line, fmt.Sprintf(format, args...)))
+}
+
+func (p *plan) create(step shellCommand, objectType uint8, id uint16, label, domains, capabilities string) {
+	if _, err := hsm.ParseDomains(domains); err != nil {
+		p.problem(step, "%v", err)
+	}
+	if _, err := hsm.ParseCapabilities(capabilities); err != nil {
+		p.problem(step, "%v", err)
+	}
+	key := planKey{objectType, id}
+	if _, ok := p.objects[key]; ok {
+		p.problem(step, "%s already exists", describeObject(objectType, id))
+	}
+	p.objects[key] = label
+	p.actions = append(p.actions, fmt.Sprintf("create %s %q, domains %s, capabilities %s",
+		describeObject(objectType, id), label, domains, capabilities))
+}
+
+// Checks that an object exists. An unknown asymmetric key is assumed
+// to be the key of the first pending import, if any.
+func (p *plan) require(step shellCommand, objectType uint8, id uint16) {
+	key := planKey{objectType, id}
+	if _, ok := p.objects[key]; ok {
+		return
+	}
+	if objectType == commands.ObjectTypeAsymmetricKey && len(p.pendingImports) > 0 {
+		i := p.pendingImports[0]
+		p.pendingImports = p.pendingImports[1:]
+		p.actions[i] = strings.Replace(p.actions[i], "import key", "import "+describeObject(objectType, id), 1)
+		p.objects[key] = ""
+		return
+	}
+	p.problem(step, "%s doesn't exist", describeObject(objectType, id))
+}
+
+// Number of words, minimum and maximum, of the supported commands
+// that take arguments.
+var shellCommandWords = map[string][2]int{
+	"session open":        {4, 4},
+	"put authkey":         {9, 9},
+	"put wrapkey":         {9, 9},
+	"put wrapped":         {5, 5},
+	"generate asymmetric": {8, 8},
+	// Optional format argument, before the file name.
+	"get wrapped": {7, 8},
+	// Optional object type, before the file name.
+	"get pubkey": {5, 6},
+	"sign eddsa": {7, 7},
+	"delete":     {4, 4},
+}
+
+func (p *plan) step(step shellCommand) {
+	w := step.words
+	name := w[0]
+	if len(w) > 1 && name != "connect" && name != "delete" {
+		name += " " + w[1]
+	}
+	if n, ok := shellCommandWords[name]; ok && (len(w) < n[0] || len(w) > n[1]) {
+		p.problem(step, "wrong number of arguments for %q", name)
+		return
+	}
+	// Argument number i, as an object id.
+	id := func(i int) uint16 {
+		n, err := strconv.ParseUint(w[i], 0, 16)
+		if err != nil {
+			p.problem(step, "invalid object id %q", w[i])
+		}
+		return uint16(n)
+	}
+	objectType := func(i int) uint8 {
+		t, err := hsm.ParseObjectType(w[i])
+		if err != nil {
+			p.problem(step, "%v", err)
+		}
+		return t
+	}
+	wrapKey := commands.ObjectTypeWrapKey
+	switch name {
+	case "connect", "session close", "list objects", "get random":
+	case "session open":
+		p.require(step, commands.ObjectTypeAuthenticationKey, id(2))
+	case "put authkey":
+		p.create(step, commands.ObjectTypeAuthenticationKey, id(3), w[4], w[5], w[6])
+	case "put wrapkey":
+		p.create(step, wrapKey, id(3), w[4], w[5], w[6])
+	case "generate asymmetric":
+		p.create(step, commands.ObjectTypeAsymmetricKey, id(3), w[4], w[5], w[6])
+	case "get wrapped":
+		t, oid := objectType(4), id(5)
+		p.require(step, wrapKey, id(3))
+		p.require(step, t, oid)
+		p.actions = append(p.actions, fmt.Sprintf("export %s under %s, to %s",
+			describeObject(t, oid), describeObject(wrapKey, id(3)), w[len(w)-1]))
+	case "put wrapped":
+		p.require(step, wrapKey, id(3))
+		if _, err := os.Stat(w[4]); err != nil {
+			p.problem(step, "%v", err)
+		}
+		p.pendingImports = append(p.pendingImports, len(p.actions))
+		p.actions = append(p.actions, fmt.Sprintf("import key under %s, from %s",
+			describeObject(wrapKey, id(3)), w[4]))
+	case "get pubkey", "sign eddsa":
+		p.require(step, commands.ObjectTypeAsymmetricKey, id(3))
+	case "delete":
+		key := planKey{objectType(3), id(2)}
+		p.require(step, key.objectType, key.id)
+		p.actions = append(p.actions, fmt.Sprintf("delete %s %q",
+			describeObject(key.objectType, key.id), p.objects[key]))
+		delete(p.objects, key)
+	default:
+		p.problem(step, "unsupported command %q", strings.Join(w, " "))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/manifest"
+)
+
+func checkReplicasCommand(args []string) error {
+	const help = `
+Check that devices, e.g., the backup devices, are complete replicas of
+each other. Each device is accessed in turn, using the given connector
+urls, and the same credentials. The object lists, with labels,
+domains, capabilities and public keys, are compared to the signed
+manifest given with --manifest, or, if no manifest is given, to the
+first device. A device with the default authentication key still in
+place is also reported.
+
+With --prompt, the command waits for ENTER before accessing each
+device, so that a single connector url, e.g., "yhusb://", can be
+repeated while devices are plugged in one at a time.
+`
+	var opts deviceOptions
+	manifestFile := ""
+	signersFile := ""
+	prompt := false
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&manifestFile, "manifest", 0, "signed manifest to compare with")
+	set.FlagLong(&signersFile, "signers", 0, "file with allowed signers' OpenSSH public keys")
+	set.FlagLong(&prompt, "prompt", 0, "wait for ENTER before accessing each device")
+	if ok, err := parseOptions(set, args, "CONNECTOR...", help); !ok {
+		return err
+	}
+	urls := set.Args()
+	if len(urls) == 0 || (len(urls) == 1 && len(manifestFile) == 0) {
+		return fmt.Errorf("at least two connector urls, or one and a --manifest, are required")
+	}
+	var reference *manifest.Manifest
+	if len(manifestFile) > 0 {
+		if len(signersFile) == 0 {
+			return fmt.Errorf("the --signers option is required with --manifest")
+		}
+		var err error
+		if reference, err = readSignedManifest(manifestFile, signersFile); err != nil {
+			return err
+		}
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	var replicas []*manifest.Manifest
+	for i, url := range urls {
+		if prompt {
+			fmt.Fprintf(os.Stderr, "Insert YubiHSM %d of %d, and press ENTER to continue: ", i+1, len(urls))
+			if _, err := stdin.ReadString('\n'); err != nil {
+				return err
+			}
+		}
+		m, err := collectManifest(&opts, url)
+		if err != nil {
+			return fmt.Errorf("device %d (%s): %v", i+1, url, err)
+		}
+		fmt.Printf("device %d: serial %d, %d objects\n", i+1, m.Device.Serial, len(m.Objects))
+		replicas = append(replicas, m)
+	}
+	diffs := manifest.CompareReplicas(replicas, reference)
+	for _, diff := range diffs {
+		fmt.Println(diff)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("found %d differences", len(diffs))
+	}
+	return nil
+}
+
+func collectManifest(opts *deviceOptions, url string) (*manifest.Manifest, error) {
+	device, err := opts.openURL(url)
+	if err != nil {
+		return nil, err
+	}
+	defer device.Close()
+	return manifest.Collect(device, "check-replicas")
+}
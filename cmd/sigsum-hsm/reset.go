@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/hsm"
+	"sigsum.org/key-mgmt/internal/manifest"
+)
+
+// Provisioning steps that produce backup devices.
+var backupSteps = []string{"keygen", "backup"}
+
+func factoryResetCommand(args []string) error {
+	const help = `
+Factory-reset the device, deleting all objects, and check that it is
+then in factory state. The session is opened with the given
+credentials, which need the reset capability, e.g., a backup
+authentication key. Before the reset, the serial number is printed,
+and the command waits for "yes" on stdin, unless --yes is given.
+After the reset, the device restarts; the command waits, up to
+--timeout, for it to reappear with the default authentication key.
+
+A device whose serial number is recorded as a backup device, by a
+keygen or backup step, in any of the manifests given with --manifest,
+is refused, unless --force is given.
+
+With --check, the device isn't reset, only checked: a session is
+opened with the default authentication key, id 1 and password
+"password", which must be the only object. The force-audit option
+must be off, and the firmware must support Ed25519.
+`
+	var opts deviceOptions
+	check := false
+	manifestFiles := []string{}
+	yes := false
+	force := false
+	timeout := time.Minute
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&check, "check", 0, "only check that the device is in factory state")
+	set.FlagLong(&manifestFiles, "manifest", 0, "manifests of provisioned devices, to refuse resetting backups")
+	set.FlagLong(&yes, "yes", 0, "don't ask for confirmation")
+	set.FlagLong(&force, "force", 0, "reset the device even if it's a backup device")
+	set.FlagLong(&timeout, "timeout", 0, "time to wait for the device to reappear after reset")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if check {
+		serial, err := checkFactoryState(&opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("YubiHSM serial %d is in factory state\n", serial)
+		return nil
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	info, err := device.DeviceInfo()
+	if err != nil {
+		return err
+	}
+	if err := checkNotBackup(info.SerialNumber, manifestFiles); err != nil {
+		if !force {
+			return fmt.Errorf("%v, use --force to reset it anyway", err)
+		}
+		log.Printf("warning: %v", err)
+	}
+	if !yes {
+		fmt.Fprintf(os.Stderr, "Type yes to factory-reset YubiHSM serial %d, deleting all its keys: ", info.SerialNumber)
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(answer) != "yes" {
+			return fmt.Errorf("reset not confirmed")
+		}
+	}
+	if err := device.Reset(); err != nil {
+		return fmt.Errorf("reset failed: %v", err)
+	}
+	device.Close()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		serial, err := checkFactoryState(&opts)
+		if err == nil {
+			if serial != info.SerialNumber {
+				return fmt.Errorf("a different device appeared after reset, serial %d", serial)
+			}
+			fmt.Printf("YubiHSM serial %d is in factory state\n", serial)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device not in factory state after reset: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Opens the device with the default authentication key, and checks
+// that it is in factory state. Returns the serial number.
+func checkFactoryState(opts *deviceOptions) (uint32, error) {
+	device, err := opts.openCredentials(opts.connector, &hsm.Credentials{
+		AuthKeyId: hsm.DefaultAuthKeyId,
+		Key:       authkey.NewFromPassword(hsm.DefaultAuthKeyPassword),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer device.Close()
+	info, err := device.DeviceInfo()
+	if err != nil {
+		return 0, err
+	}
+	if err := device.CheckFactoryState(); err != nil {
+		return 0, fmt.Errorf("YubiHSM serial %d is not in factory state:\n%v", info.SerialNumber, err)
+	}
+	return info.SerialNumber, nil
+}
+
+// Checks that the serial number isn't recorded as a backup device in
+// any of the manifests. Signatures are not checked, since a manifest
+// can only cause a reset to be refused.
+func checkNotBackup(serial uint32, manifestFiles []string) error {
+	for _, file := range manifestFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		m, err := manifest.Parse(data)
+		if err != nil {
+			return fmt.Errorf("manifest %q: %v", file, err)
+		}
+		for _, step := range backupSteps {
+			if m.Step == step && m.Device.Serial == serial {
+				return fmt.Errorf("YubiHSM serial %d is a backup device, according to manifest %q", serial, file)
+			}
+		}
+	}
+	return nil
+}
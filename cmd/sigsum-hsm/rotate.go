@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/hsm"
+)
+
+func rotateAuthKeyCommand(args []string) error {
+	const help = `
+Replace the passphrase of an authentication key, by default the one
+used to access the device. With --output, a new passphrase is
+generated on the device, and the new credentials, in the same format
+as the --auth-file, are written to the given file, which must not
+exist. With --new-auth-file, the credentials in that file are used
+instead, e.g., to give all backup devices the same new passphrase.
+Either way, the new passphrase, and the key derived from it, pass
+through the memory of this process, which clears them after use; run
+the command only on the provisioning machine.
+
+The device's own authentication key is changed in place, which
+requires the change-authentication-key capability. Another
+authentication key (--id) is deleted and imported again, with the
+same attributes. Afterwards, the command checks that the new
+credentials open a session, and that the old ones no longer do.
+`
+	var opts deviceOptions
+	keyId := uint16(0)
+	output := ""
+	newAuthFile := ""
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&keyId, "id", 0, "id of the authentication key, by default the one in the credentials")
+	set.FlagLong(&output, "output", 'o', "output file for new generated credentials")
+	set.FlagLong(&newAuthFile, "new-auth-file", 0, "file with the new credentials")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if (len(output) == 0) == (len(newAuthFile) == 0) {
+		return fmt.Errorf("exactly one of the --output and --new-auth-file options is required")
+	}
+	if !opts.auth.IsSet() {
+		return fmt.Errorf("the --auth-file option, or another credential source, is required")
+	}
+	oldCredentials, err := opts.auth.Read()
+	if err != nil {
+		return err
+	}
+	if keyId == 0 {
+		keyId = oldCredentials.AuthKeyId
+	}
+	var newCredentials *hsm.Credentials
+	defer func() {
+		if newCredentials != nil {
+			clear(newCredentials.Key)
+		}
+	}()
+	if len(newAuthFile) > 0 {
+		source := hsm.CredentialSource{File: newAuthFile}
+		if newCredentials, err = source.Read(); err != nil {
+			return err
+		}
+		if newCredentials.AuthKeyId != keyId {
+			return fmt.Errorf("new credentials are for authentication key %d, expected %d", newCredentials.AuthKeyId, keyId)
+		}
+	}
+
+	device, err := opts.openCredentials(opts.connector, oldCredentials)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		defer device.Close()
+		info, err := device.ObjectInfo(keyId, commands.ObjectTypeAuthenticationKey)
+		if err != nil {
+			return err
+		}
+		if keyId == device.AuthKeyId() && info.Capabilities&commands.CapabilityChangeAuthenticationKey == 0 {
+			return fmt.Errorf("authentication key %d lacks the change-authentication-key capability, "+
+				"replace it with --id from a session with another authentication key, "+
+				"or factory reset the device and provision it again", keyId)
+		}
+		if newCredentials == nil {
+			random, err := device.GetPseudoRandom(passphraseSize)
+			if err != nil {
+				return err
+			}
+			passphrase := make([]byte, hex.EncodedLen(len(random)))
+			hex.Encode(passphrase, random)
+			clear(random)
+			newCredentials = &hsm.Credentials{AuthKeyId: keyId, Key: hsm.DeriveAuthKey(passphrase)}
+			line := fmt.Appendf(nil, "%d:%s\n", keyId, passphrase)
+			clear(passphrase)
+			// Write the file first, so that the new passphrase isn't lost.
+			err = writeNewFile(output, line)
+			clear(line)
+			if err != nil {
+				return err
+			}
+		}
+		if keyId == device.AuthKeyId() {
+			err = device.ChangeAuthKey(newCredentials.Key)
+		} else {
+			if err := device.DeleteObject(keyId, commands.ObjectTypeAuthenticationKey); err != nil {
+				return err
+			}
+			if _, err = device.PutAuthKey(info.Attributes(), newCredentials.Key); err != nil {
+				err = fmt.Errorf("authentication key %d was deleted, but storing the new key failed: %v", keyId, err)
+			}
+		}
+		if err != nil && len(output) > 0 {
+			os.Remove(output)
+		}
+		return err
+	}()
+	if err != nil {
+		return err
+	}
+
+	// Check the result, using new sessions.
+	device, err = opts.openCredentials(opts.connector, newCredentials)
+	if err != nil {
+		return fmt.Errorf("opening a session with the new credentials failed: %v", err)
+	}
+	device.Close()
+	if keyId == oldCredentials.AuthKeyId {
+		device, err = opts.openCredentials(opts.connector, oldCredentials)
+		if err == nil {
+			device.Close()
+			return fmt.Errorf("the old credentials still open a session")
+		}
+		if !errors.Is(err, hsm.ErrAuthFailed) {
+			return fmt.Errorf("unexpected error when checking the old credentials: %v", err)
+		}
+	}
+	fmt.Printf("authentication key %d replaced, new credentials verified\n", keyId)
+	return nil
+}
+
+func rotateWrapKeyCommand(args []string) error {
+	const help = `
+Replace a wrap key with a new key of the same size, keeping its id
+and attributes. With --output, a new key is generated on the device,
+and written, hex encoded, to the given file, which must not exist.
+With --new-key-file, the hex encoded key in that file is used
+instead, e.g., to give all backup devices the same new wrap key.
+Either way, the new key passes through the memory of this process,
+which clears it after use; run the command only on the provisioning
+machine. If the replacement fails, the --output file is kept, since
+the new key may already be stored on the device.
+
+The new key is stored under a temporary id before the old key is
+deleted. Each key that is exportable under the wrap key is then
+exported under the new key, and written to the --export-dir, as
+KEY-ID.wrapped and KEY-ID.wrapped.pub, in the format used by
+export-wrapped; these files must not exist. Finally, the command
+checks that keys wrapped under the old key can no longer be
+imported.
+`
+	var opts deviceOptions
+	wrapKeyId := uint16(0)
+	output := ""
+	newKeyFile := ""
+	exportDir := ""
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&wrapKeyId, "wrap-key-id", 0, "id of the wrap key")
+	set.FlagLong(&output, "output", 'o', "output file for the new generated wrap key")
+	set.FlagLong(&newKeyFile, "new-key-file", 0, "file with the new wrap key")
+	set.FlagLong(&exportDir, "export-dir", 0, "directory for re-wrapped keys")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if wrapKeyId == 0 {
+		return fmt.Errorf("the --wrap-key-id option is required")
+	}
+	if (len(output) == 0) == (len(newKeyFile) == 0) {
+		return fmt.Errorf("exactly one of the --output and --new-key-file options is required")
+	}
+	if len(exportDir) == 0 {
+		return fmt.Errorf("the --export-dir option is required")
+	}
+	var newKey []byte
+	defer func() { clear(newKey) }()
+	if len(newKeyFile) > 0 {
+		data, err := os.ReadFile(newKeyFile)
+		if err != nil {
+			return err
+		}
+		hexKey := bytes.TrimSpace(data)
+		newKey = make([]byte, hex.DecodedLen(len(hexKey)))
+		_, err = hex.Decode(newKey, hexKey)
+		clear(data)
+		if err != nil {
+			return fmt.Errorf("invalid wrap key file %q: %v", newKeyFile, err)
+		}
+	}
+	device, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	info, err := device.ObjectInfo(wrapKeyId, commands.ObjectTypeWrapKey)
+	if err != nil {
+		return err
+	}
+	objects, err := device.ListObjects()
+	if err != nil {
+		return err
+	}
+	// Keys to re-wrap, and each key wrapped under the old key.
+	var keys []*hsm.ObjectInfo
+	var oldWrapped [][]byte
+	for _, o := range objects {
+		if o.Type == commands.ObjectTypeAsymmetricKey && o.Domains&info.Domains != 0 &&
+			o.Capabilities&commands.CapabilityExportableUnderWrap != 0 {
+			wrapped, err := device.ExportWrapped(wrapKeyId, o.Type, o.Id)
+			if err != nil {
+				return fmt.Errorf("exporting key %d under the old wrap key failed: %v", o.Id, err)
+			}
+			keys = append(keys, o)
+			oldWrapped = append(oldWrapped, wrapped)
+		}
+	}
+	// Check the export files before replacing the key, so that
+	// re-wrapped keys aren't left only on the device.
+	if fi, err := os.Stat(exportDir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory", exportDir)
+	}
+	for _, o := range keys {
+		file := filepath.Join(exportDir, fmt.Sprintf("%d.wrapped", o.Id))
+		for _, f := range []string{file, file + ".pub"} {
+			if _, err := os.Stat(f); !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("export file %q exists, or is inaccessible", f)
+			}
+		}
+	}
+
+	if newKey == nil {
+		if newKey, err = device.GetPseudoRandom(hsm.WrapKeySize(info.Algorithm)); err != nil {
+			return err
+		}
+		hexKey := make([]byte, hex.EncodedLen(len(newKey)), hex.EncodedLen(len(newKey))+1)
+		hex.Encode(hexKey, newKey)
+		hexKey = append(hexKey, '\n')
+		// Write the file first, so that the new key isn't lost.
+		err = writeNewFile(output, hexKey)
+		clear(hexKey)
+		if err != nil {
+			return err
+		}
+	}
+	if err := device.ReplaceWrapKey(wrapKeyId, newKey); err != nil {
+		return err
+	}
+
+	for _, o := range keys {
+		wrapped, err := device.ExportWrapped(wrapKeyId, o.Type, o.Id)
+		if err != nil {
+			return fmt.Errorf("exporting key %d under the new wrap key failed: %v", o.Id, err)
+		}
+		pub, err := device.GetPublicKey(o.Id)
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(exportDir, fmt.Sprintf("%d.wrapped", o.Id))
+		if err := writeNewFile(file, base64.StdEncoding.EncodeToString(wrapped)+"\n"); err != nil {
+			return err
+		}
+		if err := writeNewFile(file+".pub", hex.EncodeToString(pub)+"\n"); err != nil {
+			return err
+		}
+		fmt.Printf("key %d re-wrapped\n", o.Id)
+	}
+	// The keys exist, so if the old wrap key were still valid,
+	// the import would fail with ErrObjectExists.
+	for i, wrapped := range oldWrapped {
+		_, _, err := device.ImportWrapped(wrapKeyId, wrapped)
+		if err == nil || errors.Is(err, hsm.ErrObjectExists) {
+			return fmt.Errorf("key %d wrapped under the old wrap key is still accepted", keys[i].Id)
+		}
+	}
+	fmt.Printf("wrap key %d replaced, old wrapped keys rejected\n", wrapKeyId)
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/shamir"
+)
+
+// Size of passphrases generated by the provisioning scripts, using
+// yubihsm-shell's "get random 0 16".
+const passphraseSize = 16
+
+func splitPassphraseCommand(args []string) error {
+	const help = `
+Read a passphrase, 16 random bytes hex encoded as generated by the
+provisioning scripts, as a single line on stdin, and split it into
+shares, using Shamir secret sharing. Any THRESHOLD of the COUNT shares
+can recover the passphrase, while fewer shares give no information
+about it. The shares are written to stdout, one per line. Each share
+includes its index, an identifier of the set of shares, and a
+checksum to detect transcription errors. The shares include nothing
+derived from the passphrase as a whole, so the recovered passphrase
+can only be checked by using it.
+`
+	threshold, count := 0, 0
+	set := getopt.New()
+	set.FlagLong(&threshold, "threshold", 'k', "number of shares needed to recover the passphrase")
+	set.FlagLong(&count, "count", 'n', "number of shares")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if threshold < 1 || count < threshold || count > 255 {
+		return fmt.Errorf("the --threshold and --count options are required, with 1 <= threshold <= count <= 255")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return fmt.Errorf("reading passphrase failed: %v", err)
+	}
+	line = strings.TrimSpace(line)
+	passphrase, err := hex.DecodeString(line)
+	if err != nil || len(passphrase) != passphraseSize || line != hex.EncodeToString(passphrase) {
+		return fmt.Errorf("invalid passphrase, expected %d bytes, in lowercase hex", passphraseSize)
+	}
+	shares, err := shamir.SplitSecret(passphrase, threshold, count)
+	if err != nil {
+		return err
+	}
+	for _, s := range shares {
+		fmt.Println(s)
+	}
+	return nil
+}
+
+func combinePassphraseCommand(args []string) error {
+	const help = `
+Read shares, as written by split-passphrase, one per line on stdin,
+and write the recovered passphrase, hex encoded, to stdout. Empty
+lines and lines starting with '#' are ignored. Reading stops when
+enough distinct shares are available, or at end of input. Shares of
+different splits are refused, but a share with a valid checksum and
+a wrong value, e.g., a forged share, gives a wrong passphrase, which
+is detected only when it's used, e.g., when authenticating to the
+YubiHSM.
+`
+	set := getopt.New()
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	var shares []*shamir.Share
+	indices := make(map[int]bool)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		share, err := shamir.ParseShare(line)
+		if err != nil {
+			return err
+		}
+		shares = append(shares, share)
+		indices[share.Index] = true
+		if len(indices) >= share.Threshold {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	passphrase, err := shamir.CombineShares(shares)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%x\n", passphrase)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/hsm"
+)
+
+const usage = `
+Usage: sigsum-hsm COMMAND [options]
+
+Tool for managing the YubiHSM devices holding Sigsum keys. The device
+is accessed through a yubihsm-connector process (or a yubihsm-sim
+simulator), by default expected to listen on localhost:12345, or,
+with "-c yhusb://", directly via usb. The other connector urls
+supported by sigsum-agent, and the --connector-pin option, can be
+used too. The authorization file (-a option) has the same format as
+for sigsum-agent: a single line with the authorization id and
+passphrase, separated by a ':' character. The same alternative
+credential sources as for sigsum-agent are supported.
+
+Commands:
+`
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commandList = []command{
+	{"list-devices", "Print serial numbers of attached devices", listDevicesCommand},
+	{"audit", "Pull, verify and archive the device's audit log", auditCommand},
+	{"derive-key", "Derive an authentication key from a passphrase", deriveKeyCommand},
+	{"generate-key", "Generate an Ed25519 key", generateKeyCommand},
+	{"public-key", "Print a public key, in sigsum, OpenSSH or PEM format", publicKeyCommand},
+	{"put-auth-key", "Store an authentication key", putAuthKeyCommand},
+	{"put-wrap-key", "Store a wrap key", putWrapKeyCommand},
+	{"export-wrapped", "Export a key under wrap, to a file", exportWrappedCommand},
+	{"import-wrapped", "Import a key under wrap, from a file", importWrappedCommand},
+	{"factory-reset", "Factory-reset the device, or check factory state", factoryResetCommand},
+	{"plan", "Check yubihsm-shell commands against the device", planCommand},
+	{"manifest", "Write a signed manifest of the device's objects", manifestCommand},
+	{"verify-manifest", "Verify a device against a signed manifest", verifyManifestCommand},
+	{"transcript-add", "Add a provisioning step to a ceremony transcript", transcriptAddCommand},
+	{"transcript-sign", "Co-sign a ceremony transcript", transcriptSignCommand},
+	{"transcript-verify", "Verify a ceremony transcript and its co-signatures", transcriptVerifyCommand},
+	{"check-replicas", "Check that backup devices are replicas of each other", checkReplicasCommand},
+	{"split-passphrase", "Split a passphrase into k-of-n shares", splitPassphraseCommand},
+	{"combine-passphrase", "Recover a passphrase from shares", combinePassphraseCommand},
+	{"rotate-auth-key", "Replace an authentication key's passphrase", rotateAuthKeyCommand},
+	{"rotate-wrap-key", "Replace a wrap key, and re-wrap keys", rotateWrapKeyCommand},
+	{"generate-successor", "Generate a successor for a signing key", generateSuccessorCommand},
+	{"retire-key", "Delete a signing key whose validity has ended", retireKeyCommand},
+	{"paper-export", "Write passphrases and wrapped keys for printing", paperExportCommand},
+	{"paper-import", "Read passphrases and wrapped keys from paper", paperImportCommand},
+	{"ledger-record", "Record a tamper-evident bag event in the ledger", ledgerRecordCommand},
+	{"ledger-check", "Check the ledger's signatures and consistency", ledgerCheckCommand},
+	{"ledger-show", "Print the ledger as a table", ledgerShowCommand},
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(1)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "--help" || name == "-h" {
+		printUsage()
+		return
+	}
+	for _, c := range commandList {
+		if c.name == name {
+			if err := c.run(os.Args[1:]); err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			return
+		}
+	}
+	log.Printf("Unknown command %q", name)
+	printUsage()
+	os.Exit(1)
+}
+
+func printUsage() {
+	fmt.Print(usage)
+	for _, c := range commandList {
+		fmt.Printf("  %-18s %s\n", c.name, c.summary)
+	}
+	fmt.Printf("\nUse \"sigsum-hsm COMMAND --help\" for help on a command.\n")
+}
+
+// Options for accessing a device, common for all commands.
+type deviceOptions struct {
+	connector    string
+	connectorPin string
+	auth         hsm.CredentialSource
+}
+
+func (o *deviceOptions) register(set *getopt.Set) {
+	o.connector = "localhost:12345"
+	set.FlagLong(&o.connector, "connector", 'c', "host:port, unix:path, https://host:port, or yhusb://")
+	set.FlagLong(&o.connectorPin, "connector-pin", 0, "sha256 fingerprint of the https connector's certificate")
+	set.FlagLong(&o.auth.File, "auth-file", 'a', "file with yubihsm auth-id:passphrase")
+	set.FlagLong(&o.auth.SystemdCredential, "auth-credential", 0, "systemd credential with yubihsm auth-id:passphrase")
+	set.FlagLong(&o.auth.Keyring, "auth-keyring", 0, "kernel keyring key with yubihsm auth-id:passphrase")
+	set.FlagLong(&o.auth.AgeFile, "auth-age-file", 0, "age encrypted file with yubihsm auth-id:passphrase")
+	set.FlagLong(&o.auth.AgeIdentity, "age-identity", 0, "age identity file, for --auth-age-file")
+	set.FlagLong(&o.auth.Derived, "auth-derived-key", 0, "auth secret is a derived key, not a passphrase")
+}
+
+func (o *deviceOptions) open() (*hsm.Device, error) {
+	return o.openURL(o.connector)
+}
+
+// Opens a device using the given connector url, instead of the
+// --connector option.
+func (o *deviceOptions) openURL(url string) (*hsm.Device, error) {
+	if !o.auth.IsSet() {
+		return nil, fmt.Errorf("the --auth-file option, or another credential source, is required")
+	}
+	credentials, err := o.auth.Read()
+	if err != nil {
+		return nil, err
+	}
+	return o.openCredentials(url, credentials)
+}
+
+// Opens a device using the given connector url and credentials.
+func (o *deviceOptions) openCredentials(url string, credentials *hsm.Credentials) (*hsm.Device, error) {
+	conn, err := hsm.OpenConnector(url, o.connectorPin)
+	if err != nil {
+		return nil, err
+	}
+	return hsm.OpenDevice(conn, credentials.AuthKeyId, credentials.Key, 1, 0)
+}
+
+// Parses options for a command. Returns false if the command should
+// exit after displaying help.
+func parseOptions(set *getopt.Set, args []string, params, help string) (bool, error) {
+	showHelp := false
+	set.SetParameters(params)
+	set.FlagLong(&showHelp, "help", 'h', "Display help")
+	if err := set.Getopt(args, nil); err != nil {
+		set.PrintUsage(log.Writer())
+		return false, err
+	}
+	if showHelp {
+		set.PrintUsage(os.Stdout)
+		fmt.Print(help)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/agent"
+	"sigsum.org/key-mgmt/internal/manifest"
+)
+
+func transcriptAddCommand(args []string) error {
+	const help = `
+Add a provisioning step to the transcript of a key ceremony: the
+device's serial number, objects and public keys, and test signatures
+by each signing key, as recorded by the manifest command. With
+--manifest, the step is instead read from a manifest file written by
+the manifest command. The transcript file is created if it doesn't
+exist. Once the transcript has been co-signed, see transcript-sign,
+no more steps can be added.
+`
+	var opts deviceOptions
+	file := ""
+	step := ""
+	ceremony := ""
+	manifestFile := ""
+
+	set := getopt.New()
+	opts.register(set)
+	set.FlagLong(&file, "transcript", 0, "transcript file")
+	set.FlagLong(&step, "step", 0, "name of the provisioning step")
+	set.FlagLong(&ceremony, "ceremony", 0, "description of the ceremony, for a new transcript")
+	set.FlagLong(&manifestFile, "manifest", 0, "manifest file to add, instead of reading the device")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(file) == 0 {
+		return fmt.Errorf("the --transcript option is required")
+	}
+	if len(step) == 0 && len(manifestFile) == 0 {
+		return fmt.Errorf("the --step option is required, unless --manifest is given")
+	}
+	if _, err := os.Stat(file + ".sig"); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("transcript %q is already co-signed, or %q is inaccessible", file, file+".sig")
+	}
+	t, err := manifest.ReadTranscriptFile(file)
+	if err != nil {
+		return err
+	}
+	if len(ceremony) > 0 {
+		if len(t.Ceremony) > 0 && t.Ceremony != ceremony {
+			return fmt.Errorf("transcript %q is for another ceremony, %q", file, t.Ceremony)
+		}
+		t.Ceremony = ceremony
+	}
+	var m *manifest.Manifest
+	if len(manifestFile) > 0 {
+		data, err := os.ReadFile(manifestFile)
+		if err != nil {
+			return err
+		}
+		if m, err = manifest.Parse(data); err != nil {
+			return fmt.Errorf("manifest %q: %v", manifestFile, err)
+		}
+		if len(step) > 0 && m.Step != step {
+			return fmt.Errorf("manifest %q is for step %q", manifestFile, m.Step)
+		}
+	} else {
+		device, err := opts.open()
+		if err != nil {
+			return err
+		}
+		defer device.Close()
+		if m, err = manifest.Collect(device, step); err != nil {
+			return err
+		}
+	}
+	t.Steps = append(t.Steps, *m)
+	if err := t.Check(); err != nil {
+		return fmt.Errorf("inconsistent transcript:\n%v", err)
+	}
+	if err := manifest.WriteTranscriptFile(file, t); err != nil {
+		return err
+	}
+	fmt.Printf("step %d: %s, YubiHSM serial %d\n", len(t.Steps), m.Step, m.Device.Serial)
+	return nil
+}
+
+func transcriptSignCommand(args []string) error {
+	const help = `
+Co-sign the transcript of a key ceremony, as an operator who witnessed
+it, with the operator's OpenSSH Ed25519 private key (--signing-key),
+or, if a public key file is given instead, with the corresponding key
+held by the ssh-agent at $SSH_AUTH_SOCK. The transcript is checked
+first, and the steps are printed, for review. The signature, in
+"ssh-keygen -Y sign" format, is appended to the file with ".sig"
+appended to the transcript name.
+`
+	file := ""
+	signingKey := ""
+
+	set := getopt.New()
+	set.FlagLong(&file, "transcript", 0, "transcript file")
+	set.FlagLong(&signingKey, "signing-key", 0, "operator's OpenSSH private key file, or public key file for a key in ssh-agent")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(file) == 0 || len(signingKey) == 0 {
+		return fmt.Errorf("the --transcript and --signing-key options are required")
+	}
+	data, t, err := readTranscript(file)
+	if err != nil {
+		return err
+	}
+	if err := t.Check(); err != nil {
+		return fmt.Errorf("transcript %q is inconsistent:\n%v", file, err)
+	}
+	signer, err := readOperatorKey(signingKey)
+	if err != nil {
+		return err
+	}
+	pub, ok := signer.Public().(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("not an Ed25519 key, type %T", signer.Public())
+	}
+	signatures, err := os.ReadFile(file + ".sig")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	cosigners, err := manifest.VerifyTranscriptSignatures(data, signatures, nil)
+	if err != nil {
+		return fmt.Errorf("transcript %q: %v", file, err)
+	}
+	for _, cosigner := range cosigners {
+		if cosigner.Equal(pub) {
+			return fmt.Errorf("transcript %q is already co-signed by %s", file, agent.FormatPublicKey(pub))
+		}
+	}
+	signature, err := manifest.SignTranscript(data, signer)
+	if err != nil {
+		return err
+	}
+	printTranscript(t)
+	f, err := os.OpenFile(file+".sig", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(signature); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func transcriptVerifyCommand(args []string) error {
+	const help = `
+Verify the transcript of a key ceremony, and its co-signatures, read
+from the file with ".sig" appended to the transcript name. Each
+co-signature must be valid, and made by an operator listed in the
+signers file, which lists OpenSSH public keys, one per line. By
+default, every listed operator must have co-signed; with --threshold,
+at least that many. The test signatures of each step must be valid,
+and a signing key must have the same public key in all steps. The
+steps are printed, with serial numbers and public keys.
+`
+	file := ""
+	signersFile := ""
+	threshold := 0
+
+	set := getopt.New()
+	set.FlagLong(&file, "transcript", 0, "transcript file")
+	set.FlagLong(&signersFile, "signers", 0, "file with the operators' OpenSSH public keys")
+	set.FlagLong(&threshold, "threshold", 0, "number of required co-signatures (default all signers)")
+	if ok, err := parseOptions(set, args, "", help); !ok {
+		return err
+	}
+	if len(file) == 0 || len(signersFile) == 0 {
+		return fmt.Errorf("the --transcript and --signers options are required")
+	}
+	signers, err := readSignersFile(signersFile)
+	if err != nil {
+		return err
+	}
+	if threshold == 0 {
+		threshold = len(signers)
+	}
+	if threshold < 1 || threshold > len(signers) {
+		return fmt.Errorf("invalid threshold %d, there are %d signers", threshold, len(signers))
+	}
+	data, t, err := readTranscript(file)
+	if err != nil {
+		return err
+	}
+	if err := t.Check(); err != nil {
+		return fmt.Errorf("transcript %q is inconsistent:\n%v", file, err)
+	}
+	signatures, err := os.ReadFile(file + ".sig")
+	if err != nil {
+		return err
+	}
+	cosigners, err := manifest.VerifyTranscriptSignatures(data, signatures, signers)
+	if err != nil {
+		return fmt.Errorf("transcript %q: %v", file, err)
+	}
+	printTranscript(t)
+	for _, pub := range cosigners {
+		fmt.Printf("co-signed by %s\n", agent.FormatPublicKey(pub))
+	}
+	if len(cosigners) < threshold {
+		return fmt.Errorf("transcript %q has %d co-signatures, %d required", file, len(cosigners), threshold)
+	}
+	return nil
+}
+
+// Reads a transcript, returning both the file contents, as signed,
+// and the parsed transcript.
+func readTranscript(file string) ([]byte, *manifest.Transcript, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := manifest.ParseTranscript(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("transcript %q: %v", file, err)
+	}
+	return data, t, nil
+}
+
+// Prints the steps of a transcript, with serial numbers, and the
+// public keys of signing keys.
+func printTranscript(t *manifest.Transcript) {
+	if len(t.Ceremony) > 0 {
+		fmt.Printf("ceremony: %s\n", t.Ceremony)
+	}
+	for i, m := range t.Steps {
+		fmt.Printf("step %d: %s, %s, YubiHSM serial %d, firmware %s, %d test signatures\n",
+			i+1, m.Step, m.Date.Format("2006-01-02 15:04:05Z"), m.Device.Serial, m.Device.Firmware, len(m.TestSignatures))
+		for _, o := range m.Objects {
+			if len(o.PublicKey) > 0 {
+				fmt.Printf("  key %d %q: %s\n", o.Id, o.Label, o.PublicKey)
+			}
+		}
+	}
+}
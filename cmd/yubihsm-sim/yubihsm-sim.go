@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/hsmsim"
+)
+
+func main() {
+	const usage = `
+Run a simulated YubiHSM 2, serving the same http api as
+yubihsm-connector. Intended for testing only: keys are stored in
+the clear, in the state file given by the --state option. If the
+state file doesn't exist, it is created with the factory reset state
+of the device, with the authentication key 1 and password "password".
+
+For convenience in tests, the --generate-key option adds an Ed25519
+signing key with the given id, with the sign-eddsa capability and
+all domains, if there's no such key already.
+
+The simulator closes stdout once it is ready to accept connections.
+To listen on a unix socket rather than on a TCP port, use
+"--listen unix:PATH". With the --tls option, the simulator serves
+https, using a newly generated self-signed certificate, and writes
+the certificate's SHA-256 fingerprint (hex) to stdout before closing
+it.
+
+With the --any-serial option, the connector status reports the
+serial number as "*", as yubihsm-connector does when started without
+--serial.
+
+With the --stdio option, the simulator instead serves a single
+client on stdin and stdout, using the message framing of the usb
+transport, as a stand-in for a device accessed directly via usb. It
+exits when stdin is closed.
+`
+	listen := "localhost:12345"
+	stateFile := ""
+	serial := uint32(1000000)
+	generateKey := -1
+	stdio := false
+	useTLS := false
+	anySerial := false
+	help := false
+
+	set := getopt.New()
+	set.SetUsage(func() { fmt.Print(usage) })
+	set.FlagLong(&listen, "listen", 'l', "host:port or unix:path to listen on")
+	set.FlagLong(&stateFile, "state", 0, "file with persistent device state")
+	set.FlagLong(&serial, "serial", 0, "serial number for a new device")
+	set.FlagLong(&generateKey, "generate-key", 0, "id of Ed25519 key to create")
+	set.FlagLong(&useTLS, "tls", 0, "serve https with a self-signed certificate")
+	set.FlagLong(&anySerial, "any-serial", 0, "report serial number \"*\" in the connector status")
+	set.FlagLong(&stdio, "stdio", 0, "serve usb framing on stdin/stdout")
+	set.FlagLong(&help, "help", 'h', "Display help")
+
+	err := set.Getopt(os.Args, nil)
+	if err != nil {
+		log.Printf("err: %v\n", err)
+		set.PrintUsage(log.Writer())
+		os.Exit(1)
+	}
+	if help {
+		set.PrintUsage(os.Stdout)
+		fmt.Print(usage)
+		os.Exit(0)
+	}
+	if len(stateFile) == 0 {
+		log.Fatal("The --state option is required.")
+	}
+	sim, err := hsmsim.OpenSimulator(stateFile, serial)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if generateKey >= 0 {
+		if generateKey == 0 || generateKey >= 0x10000 {
+			log.Fatalf("Key id %d out of range.", generateKey)
+		}
+		if _, err := sim.AddEd25519Key(uint16(generateKey), "Test Ed25519 signing key",
+			0xffff, commands.CapabilityAsymmetricSignEddsa); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if stdio {
+		if err := sim.ServeStream(os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	var l net.Listener
+	if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+		l, err = net.Listen("unix", path)
+	} else {
+		l, err = net.Listen("tcp", listen)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if useTLS {
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%x\n", sha256.Sum256(cert.Certificate[0]))
+		l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	os.Stdout.Close()
+
+	http.HandleFunc("/connector/api", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		msg, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(sim.Process(msg))
+	})
+	http.HandleFunc("/connector/status", func(w http.ResponseWriter, r *http.Request) {
+		status, _ := sim.GetStatus()
+		if anySerial {
+			status.Serial = "*"
+		}
+		fmt.Fprintf(w, "status=%s\nserial=%s\nversion=%s\npid=%s\naddress=%s\nport=%s\n",
+			status.Status, status.Serial, status.Version, status.Pid, status.Address, status.Port)
+	})
+	log.Fatal(http.Serve(l, nil))
+}
+
+func selfSignedCertificate() (tls.Certificate, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "yubihsm-sim"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, pub, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
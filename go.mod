@@ -4,11 +4,11 @@ module sigsum.org/key-mgmt
 go 1.22
 
 require (
+	filippo.io/age v1.2.1
 	github.com/certusone/yubihsm-go v0.3.0
+	github.com/enceve/crypto v0.0.0-20160707101852-34d48bb93815
 	github.com/pborman/getopt/v2 v2.1.0
-)
-
-require (
-	github.com/enceve/crypto v0.0.0-20160707101852-34d48bb93815 // indirect
-	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2 // indirect
+	golang.org/x/crypto v0.24.0
+	golang.org/x/sys v0.21.0
+	rsc.io/qr v0.2.0
 )
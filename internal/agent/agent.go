@@ -2,17 +2,28 @@ package agent
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"time"
 )
 
 const (
-	SSH_AGENT_FAILURE             = 5
-	SSH_AGENTC_REQUEST_IDENTITIES = 11
-	SSH_AGENT_IDENTITIES_ANSWER   = 12
-	SSH_AGENTC_SIGN_REQUEST       = 13
-	SSH_AGENT_SIGN_RESPONSE       = 14
+	SSH_AGENT_FAILURE                = 5
+	SSH_AGENT_SUCCESS                = 6
+	SSH_AGENTC_REQUEST_IDENTITIES    = 11
+	SSH_AGENT_IDENTITIES_ANSWER      = 12
+	SSH_AGENTC_SIGN_REQUEST          = 13
+	SSH_AGENT_SIGN_RESPONSE          = 14
+	SSH_AGENTC_ADD_IDENTITY          = 17
+	SSH_AGENTC_REMOVE_IDENTITY       = 18
+	SSH_AGENTC_REMOVE_ALL_IDENTITIES = 19
+	SSH_AGENTC_ADD_ID_CONSTRAINED    = 25
+
+	SSH_AGENT_CONSTRAIN_LIFETIME  = 1
+	SSH_AGENT_CONSTRAIN_CONFIRM   = 2
+	SSH_AGENT_CONSTRAIN_EXTENSION = 255
 	// Arbitrary maximum size of received agent messages.
 	maxSize = 10000
 )
@@ -40,8 +51,200 @@ func readSignRequest(r io.Reader) (req signRequest, err error) {
 	return
 }
 
-// The map keys are SSH public key blobs (without outer length field).
-func ServeAgent(r io.Reader, w io.Writer, keys map[string]SSHSign) error {
+type addRequest struct {
+	pubKey string
+	entry  keyEntry
+}
+
+func readConstraints(r io.Reader, e *keyEntry) error {
+	for {
+		t, err := readBytes(r, 1)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t[0] {
+		case SSH_AGENT_CONSTRAIN_LIFETIME:
+			seconds, err := readUint32(r)
+			if err != nil {
+				return err
+			}
+			e.expiry = time.Now().Add(time.Duration(seconds) * time.Second)
+		case SSH_AGENT_CONSTRAIN_CONFIRM:
+			e.confirm = true
+		case SSH_AGENT_CONSTRAIN_EXTENSION:
+			name, err := readString(r, maxSize)
+			if err != nil {
+				return err
+			}
+			if string(name) != restrictDestinationExtension {
+				return fmt.Errorf("unsupported constraint extension %q", name)
+			}
+			if e.destinations != nil {
+				return fmt.Errorf("duplicate destination constraint")
+			}
+			e.destinations, err = readDestConstraints(r)
+			if err != nil {
+				return fmt.Errorf("invalid destination constraint: %v", err)
+			}
+		default:
+			return fmt.Errorf("unsupported constraint type %d", t[0])
+		}
+	}
+}
+
+func readAddRequest(r io.Reader, constrained bool) (req addRequest, err error) {
+	keyType, err := readString(r, maxSize)
+	if err != nil {
+		return
+	}
+	if string(keyType) != "ssh-ed25519" {
+		err = fmt.Errorf("unsupported key type %q", keyType)
+		return
+	}
+	priv, err := readEd25519PrivateKey(r)
+	if err != nil {
+		return
+	}
+	comment, err := readString(r, maxSize)
+	if err != nil {
+		return
+	}
+	req.pubKey, req.entry.sign, err = SSHFromEd25519(priv)
+	if err != nil {
+		return
+	}
+	req.entry.comment = string(comment)
+	if constrained {
+		err = readConstraints(r, &req.entry)
+	}
+	return
+}
+
+// Handles requests to add or remove keys. Returns the response
+// message type.
+func updateKeys(t byte, msg []byte, keys *KeyStore) byte {
+	var err error
+	switch t {
+	case SSH_AGENTC_ADD_IDENTITY, SSH_AGENTC_ADD_ID_CONSTRAINED:
+		var req addRequest
+		req, err = parseBytes(msg, nil, func(r io.Reader) (addRequest, error) {
+			return readAddRequest(r, t == SSH_AGENTC_ADD_ID_CONSTRAINED)
+		})
+		if err == nil {
+			err = keys.add(req.pubKey, req.entry)
+		}
+	case SSH_AGENTC_REMOVE_IDENTITY:
+		var pubKey []byte
+		pubKey, err = parseBytes(msg, nil, func(r io.Reader) ([]byte, error) {
+			return readString(r, maxSize)
+		})
+		if err == nil {
+			err = keys.remove(string(pubKey))
+		}
+	case SSH_AGENTC_REMOVE_ALL_IDENTITIES:
+		if len(msg) > 0 {
+			err = fmt.Errorf("%d left-over bytes in remove all request", len(msg))
+		} else {
+			err = keys.removeAll()
+		}
+	default:
+		panic(fmt.Sprintf("internal error, unexpected message type %d", t))
+	}
+	if err != nil {
+		log.Printf("request %d failed: %v", t, err)
+		return SSH_AGENT_FAILURE
+	}
+	return SSH_AGENT_SUCCESS
+}
+
+// Handles an SSH_AGENTC_EXTENSION request. Returns the response
+// message type, and the updated session bindings.
+func handleExtension(msg []byte, bindings []sessionBinding) (byte, []sessionBinding) {
+	buf := bytes.NewBuffer(msg)
+	name, err := readString(buf, maxSize)
+	if err != nil {
+		log.Printf("invalid extension request: %v", err)
+		return SSH_AGENT_FAILURE, bindings
+	}
+	switch string(name) {
+	case sessionBindExtension:
+		newBindings, err := bindSession(bindings, buf.Bytes())
+		if err != nil {
+			log.Printf("session bind failed: %v", err)
+			return SSH_AGENT_EXTENSION_FAILURE, bindings
+		}
+		return SSH_AGENT_SUCCESS, newBindings
+	default:
+		return SSH_AGENT_FAILURE, bindings
+	}
+}
+
+// An Agent serves a set of keys over the ssh-agent protocol.
+type Agent struct {
+	Keys *KeyStore
+	// If non-nil, used to ask for confirmation of sign requests
+	// using keys that require it. If nil, such requests are
+	// refused.
+	Confirm ConfirmFunc
+	// If non-nil, applied to all sign requests.
+	Limiter *RateLimiter
+	// If non-nil, all sign requests must be allowed by the
+	// policy, e.g., a WitnessPolicy or a NotePolicy.
+	Policy SignPolicy
+}
+
+// A SignPolicy restricts the data that may be signed.
+type SignPolicy interface {
+	// Checks the data of a sign request, and, if it may be
+	// signed, updates any state of the policy.
+	check(data []byte, now time.Time) error
+}
+
+// Handles a sign request, returning the signature.
+func (a *Agent) sign(req signRequest, bindings []sessionBinding, peer *Peer) ([]byte, error) {
+	key, ok := a.Keys.lookup(string(req.pubKey))
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", Fingerprint(req.pubKey))
+	}
+	if len(key.destinations) > 0 {
+		if err := checkConstrainedSign(&key, req.pubKey, req.data, bindings); err != nil {
+			return nil, err
+		}
+	}
+	if a.Limiter != nil {
+		if err := a.Limiter.allow(string(req.pubKey), peer); err != nil {
+			return nil, err
+		}
+	}
+	if key.confirm {
+		if a.Confirm == nil {
+			return nil, fmt.Errorf("key %s requires confirmation, but no confirmation method is configured",
+				Fingerprint(req.pubKey))
+		}
+		signReq := SignRequest{PubKey: req.pubKey, Comment: key.comment, Data: req.data, Peer: peer}
+		if err := a.Confirm(&signReq); err != nil {
+			log.Printf("confirmation refused: %s: %v", &signReq, err)
+			return nil, fmt.Errorf("not confirmed")
+		}
+		log.Printf("confirmation approved: %s", &signReq)
+	}
+	if a.Policy != nil {
+		// Checked last, since the state is updated.
+		if err := a.Policy.check(req.data, time.Now()); err != nil {
+			return nil, fmt.Errorf("refused by policy: %v", err)
+		}
+	}
+	return key.sign(req.data)
+}
+
+// Serves requests on a connection. The peer, if non-nil, identifies
+// the process at the other end.
+func (a *Agent) ServeAgent(r io.Reader, w io.Writer, peer *Peer) error {
+	// Session bindings for this connection.
+	var bindings []sessionBinding
 	for {
 		data, err := readString(r, maxSize)
 		if err != nil {
@@ -61,24 +264,24 @@ func ServeAgent(r io.Reader, w io.Writer, keys map[string]SSHSign) error {
 				return fmt.Errorf("invalid message, %d left-over bytes in list request", len(msg))
 			}
 
+			var ids []identity
+			for _, id := range a.Keys.list() {
+				if permittedKey(&id.keyEntry, bindings, "") {
+					ids = append(ids, id)
+				}
+			}
 			rsp.WriteByte(SSH_AGENT_IDENTITIES_ANSWER)
-			writeUint32(&rsp, uint32(len(keys)))
-			for k, _ := range keys {
-				writeString(&rsp, k)
-				// Arbitrary comment
-				writeString(&rsp, "oracle key")
+			writeUint32(&rsp, uint32(len(ids)))
+			for _, id := range ids {
+				writeString(&rsp, id.pubKey)
+				writeString(&rsp, id.comment)
 			}
 		case SSH_AGENTC_SIGN_REQUEST:
 			req, err := parseBytes(msg, nil, readSignRequest)
 			if err != nil {
 				return err
 			}
-			signer, ok := keys[string(req.pubKey)]
-			if !ok {
-				rsp.WriteByte(SSH_AGENT_FAILURE)
-				break
-			}
-			sig, err := signer(req.data)
+			sig, err := a.sign(req, bindings, peer)
 			if err != nil {
 				log.Printf("signing failed: %v", err)
 				rsp.WriteByte(SSH_AGENT_FAILURE)
@@ -86,6 +289,13 @@ func ServeAgent(r io.Reader, w io.Writer, keys map[string]SSHSign) error {
 			}
 			rsp.WriteByte(SSH_AGENT_SIGN_RESPONSE)
 			writeString(&rsp, sig)
+		case SSH_AGENTC_ADD_IDENTITY, SSH_AGENTC_ADD_ID_CONSTRAINED,
+			SSH_AGENTC_REMOVE_IDENTITY, SSH_AGENTC_REMOVE_ALL_IDENTITIES:
+			rsp.WriteByte(updateKeys(t, msg, a.Keys))
+		case SSH_AGENTC_EXTENSION:
+			var status byte
+			status, bindings = handleExtension(msg, bindings)
+			rsp.WriteByte(status)
 		default:
 			rsp.WriteByte(SSH_AGENT_FAILURE)
 		}
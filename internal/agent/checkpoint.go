@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A checkpoint body, see https://c2sp.org/tlog-checkpoint: the
+// origin line, identifying the log, the tree size, and the root
+// hash, followed by optional extension lines.
+type Checkpoint struct {
+	Origin     string
+	Size       uint64
+	RootHash   [32]byte
+	Extensions []string
+}
+
+// Parses a checkpoint body. Each line, including the last, must be
+// terminated by a newline character, and empty lines are not
+// allowed.
+func ParseCheckpoint(data []byte) (*Checkpoint, error) {
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		return nil, fmt.Errorf("checkpoint not terminated by newline")
+	}
+	lines := strings.Split(string(data[:len(data)-1]), "\n")
+	if len(lines) < 3 {
+		return nil, fmt.Errorf("checkpoint has only %d lines", len(lines))
+	}
+	for _, line := range lines {
+		if len(line) == 0 {
+			return nil, fmt.Errorf("empty line in checkpoint")
+		}
+	}
+	size, err := strconv.ParseUint(lines[1], 10, 64)
+	if err != nil || strconv.FormatUint(size, 10) != lines[1] {
+		return nil, fmt.Errorf("invalid tree size %q", lines[1])
+	}
+	rootHash, err := base64.StdEncoding.Strict().DecodeString(lines[2])
+	if err != nil || len(rootHash) != 32 {
+		return nil, fmt.Errorf("invalid root hash %q", lines[2])
+	}
+	c := Checkpoint{Origin: lines[0], Size: size, Extensions: lines[3:]}
+	copy(c.RootHash[:], rootHash)
+	return &c, nil
+}
+
+type treeHead struct {
+	Size     uint64 `json:"size"`
+	RootHash []byte `json:"root-hash"`
+}
+
+// A TreeState records the largest signed tree head of each log, by
+// origin, to refuse signing a smaller tree, or a different root hash
+// for the same size. The state is kept in a file, so that it survives
+// restarts, and updated before each signature. It is safe for
+// concurrent use.
+type TreeState struct {
+	file string
+
+	mu    sync.Mutex
+	heads map[string]treeHead
+}
+
+// Reads the state file. If the file doesn't exist, the state is
+// empty, and the file is created on the first update.
+func NewTreeState(file string) (*TreeState, error) {
+	s := TreeState{file: file, heads: make(map[string]treeHead)}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s.heads); err != nil {
+		return nil, fmt.Errorf("invalid tree state file %q: %v", file, err)
+	}
+	for origin, head := range s.heads {
+		if len(head.RootHash) != 32 {
+			return nil, fmt.Errorf("invalid tree state file %q: invalid root hash for %q", file, origin)
+		}
+	}
+	return &s, nil
+}
+
+// Checks that the checkpoint is consistent with the state, i.e., the
+// tree is no smaller than the largest tree signed so far, and, if of
+// the same size, has the same root hash. If the tree is larger, the
+// state file is updated; the checkpoint must not be signed if that
+// fails.
+func (s *TreeState) Update(c *Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	head, ok := s.heads[c.Origin]
+	if ok {
+		if c.Size < head.Size {
+			return fmt.Errorf("tree size %d for %q is smaller than signed size %d", c.Size, c.Origin, head.Size)
+		}
+		if c.Size == head.Size {
+			if !bytes.Equal(c.RootHash[:], head.RootHash) {
+				return fmt.Errorf("root hash for %q, size %d, differs from signed root hash", c.Origin, c.Size)
+			}
+			return nil
+		}
+	}
+	s.heads[c.Origin] = treeHead{Size: c.Size, RootHash: bytes.Clone(c.RootHash[:])}
+	if err := s.write(); err != nil {
+		// Keep the previous state, consistent with the file.
+		if ok {
+			s.heads[c.Origin] = head
+		} else {
+			delete(s.heads, c.Origin)
+		}
+		return fmt.Errorf("updating tree state file failed: %v", err)
+	}
+	return nil
+}
+
+// Writes the state to a new file, synced to disk, and renames it
+// over the old file.
+func (s *TreeState) write() error {
+	data, err := json.MarshalIndent(s.heads, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".new"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
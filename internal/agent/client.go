@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+)
+
+// A crypto.Signer using an Ed25519 key held by an ssh-agent, e.g.,
+// sigsum-agent, over an established connection to the agent's
+// socket. Like with "ssh-keygen -Y sign -f PUBLIC-KEY", the private
+// key never leaves the agent.
+type ClientSigner struct {
+	conn    io.ReadWriter
+	pub     ed25519.PublicKey
+	keyBlob []byte
+}
+
+// Creates a signer for the given public key, and checks that the
+// agent holds the corresponding private key.
+func NewClientSigner(conn io.ReadWriter, pub ed25519.PublicKey) (*ClientSigner, error) {
+	s := ClientSigner{conn: conn, pub: pub, keyBlob: serializeEd25519(pub)}
+	rsp, err := s.request([]byte{SSH_AGENTC_REQUEST_IDENTITIES})
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseBytes(rsp, nil, func(r io.Reader) ([][]byte, error) {
+		if err := readSkip(r, []byte{SSH_AGENT_IDENTITIES_ANSWER}); err != nil {
+			return nil, err
+		}
+		n, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		var keys [][]byte
+		for i := uint32(0); i < n; i++ {
+			key, err := readString(r, maxSize)
+			if err != nil {
+				return nil, err
+			}
+			// Comment, ignored.
+			if _, err := readString(r, maxSize); err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		return keys, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid identities answer from agent: %v", err)
+	}
+	for _, key := range keys {
+		if bytes.Equal(key, s.keyBlob) {
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("key %s not available from agent", Fingerprint(s.keyBlob))
+}
+
+// Sends a request, and returns the response message.
+func (s *ClientSigner) request(msg []byte) ([]byte, error) {
+	if err := writeString(s.conn, msg); err != nil {
+		return nil, err
+	}
+	rsp, err := readString(s.conn, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp) == 0 {
+		return nil, fmt.Errorf("invalid empty agent message")
+	}
+	if rsp[0] == SSH_AGENT_FAILURE {
+		return nil, fmt.Errorf("agent request failed")
+	}
+	return rsp, nil
+}
+
+func (s *ClientSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *ClientSigner) Sign(_ io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("unsupported hash function %v, only pure Ed25519 is supported", opts.HashFunc())
+	}
+	req := bytes.Join([][]byte{
+		[]byte{SSH_AGENTC_SIGN_REQUEST},
+		serializeString(s.keyBlob),
+		serializeString(msg),
+		serializeUint32(0)},
+		nil)
+	rsp, err := s.request(req)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := parseBytes(rsp, nil, func(r io.Reader) ([]byte, error) {
+		if err := readSkip(r, []byte{SSH_AGENT_SIGN_RESPONSE}); err != nil {
+			return nil, err
+		}
+		blob, err := readString(r, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		return parseBytes(blob, nil, func(r io.Reader) ([]byte, error) {
+			if err := readSkip(r, serializeString("ssh-ed25519")); err != nil {
+				return nil, err
+			}
+			return readString(r, ed25519.SignatureSize)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid sign response from agent: %v", err)
+	}
+	if len(sig) != ed25519.SignatureSize || !ed25519.Verify(s.pub, msg, sig) {
+		return nil, fmt.Errorf("invalid signature from agent")
+	}
+	return sig, nil
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Process at the other end of an agent connection.
+type Peer struct {
+	Pid     int
+	Uid     int
+	Gid     int
+	Command string
+}
+
+func (p *Peer) String() string {
+	if p == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("pid %d (%s), uid %d", p.Pid, p.Command, p.Uid)
+}
+
+// Description of a sign request, as presented for confirmation.
+type SignRequest struct {
+	// SSH public key blob (without outer length field).
+	PubKey  []byte
+	Comment string
+	Data    []byte
+	Peer    *Peer
+}
+
+// Fingerprint of the key.
+func (req *SignRequest) KeyFingerprint() string {
+	return Fingerprint(req.PubKey)
+}
+
+// For data formatted according to the SSHSIG format, returns the
+// namespace and the message hash in the form "<hash
+// algorithm>:<hex>". For other data, returns an empty namespace and
+// the SHA256 hash of the data.
+func (req *SignRequest) NamespaceAndHash() (string, string) {
+	if sshsig, err := parseBytes(req.Data, nil, readSSHSIGSignedData); err == nil {
+		return sshsig.namespace, fmt.Sprintf("%s:%x", sshsig.hashAlg, sshsig.hash)
+	}
+	return "", fmt.Sprintf("sha256:%x", sha256.Sum256(req.Data))
+}
+
+func (req *SignRequest) String() string {
+	namespace, hash := req.NamespaceAndHash()
+	if namespace == "" {
+		namespace = "none"
+	}
+	return fmt.Sprintf("key %s (%s), hash %s, namespace %s, peer %s",
+		req.KeyFingerprint(), req.Comment, hash, namespace, req.Peer)
+}
+
+// Asks for confirmation of a sign request. A nil return value means
+// that the request is approved.
+type ConfirmFunc func(req *SignRequest) error
+
+// The data signed by an SSHSIG signature, see
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+type sshsigSignedData struct {
+	namespace string
+	hashAlg   string
+	hash      []byte
+}
+
+func readSSHSIGSignedData(r io.Reader) (data sshsigSignedData, err error) {
+	if err = readSkip(r, []byte("SSHSIG")); err != nil {
+		return
+	}
+	namespace, err := readString(r, 1000)
+	if err != nil {
+		return
+	}
+	// Reserved.
+	if _, err = readString(r, 1000); err != nil {
+		return
+	}
+	hashAlg, err := readString(r, 100)
+	if err != nil {
+		return
+	}
+	data.hash, err = readString(r, 100)
+	data.namespace, data.hashAlg = string(namespace), string(hashAlg)
+	return
+}
+
+// Returns a ConfirmFunc that runs an external program, in the same
+// way as ssh-agent runs ssh-askpass: The program is passed a
+// descriptive prompt as its only argument, and the environment
+// variable SSH_ASKPASS_PROMPT is set to "confirm". The request is
+// approved if the program exits successfully. Details of the request
+// are also passed in the environment variables SIGSUM_AGENT_KEY,
+// SIGSUM_AGENT_HASH, SIGSUM_AGENT_NAMESPACE, SIGSUM_AGENT_PEER_PID,
+// SIGSUM_AGENT_PEER_UID and SIGSUM_AGENT_PEER_COMMAND.
+func ConfirmCommand(program string, timeout time.Duration) ConfirmFunc {
+	return func(req *SignRequest) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		namespace, hash := req.NamespaceAndHash()
+		cmd := exec.CommandContext(ctx, program, "Allow use of key "+req.String()+"?")
+		cmd.Env = append(cmd.Environ(),
+			"SSH_ASKPASS_PROMPT=confirm",
+			"SIGSUM_AGENT_KEY="+req.KeyFingerprint(),
+			"SIGSUM_AGENT_HASH="+hash,
+			"SIGSUM_AGENT_NAMESPACE="+namespace)
+		if req.Peer != nil {
+			cmd.Env = append(cmd.Env,
+				fmt.Sprintf("SIGSUM_AGENT_PEER_PID=%d", req.Peer.Pid),
+				fmt.Sprintf("SIGSUM_AGENT_PEER_UID=%d", req.Peer.Uid),
+				"SIGSUM_AGENT_PEER_COMMAND="+req.Peer.Command)
+		}
+		cmd.Stdout = io.Discard
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("timeout waiting for confirmation")
+			}
+			return fmt.Errorf("confirmation program: %v", err)
+		}
+		return nil
+	}
+}
+
+// Returns a ConfirmFunc that connects to a unix socket, and writes a
+// description of the request, as lines of the form "key=value"
+// followed by an empty line. The request is approved if the other
+// end responds with a line "yes".
+func ConfirmSocket(socketName string, timeout time.Duration) ConfirmFunc {
+	return func(req *SignRequest) error {
+		deadline := time.Now().Add(timeout)
+		c, err := net.DialTimeout("unix", socketName, timeout)
+		if err != nil {
+			return fmt.Errorf("connecting to confirmation socket failed: %v", err)
+		}
+		defer c.Close()
+		if err := c.SetDeadline(deadline); err != nil {
+			return err
+		}
+
+		namespace, hash := req.NamespaceAndHash()
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "key=%s\ncomment=%s\nhash=%s\nnamespace=%s\n",
+			req.KeyFingerprint(), oneLine(req.Comment), hash, oneLine(namespace))
+		if req.Peer != nil {
+			fmt.Fprintf(&buf, "pid=%d\nuid=%d\ncommand=%s\n",
+				req.Peer.Pid, req.Peer.Uid, oneLine(req.Peer.Command))
+		}
+		buf.WriteString("\n")
+		if _, err := c.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("writing to confirmation socket failed: %v", err)
+		}
+		line, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reading from confirmation socket failed: %v", err)
+		}
+		if answer := strings.TrimSpace(line); answer != "yes" {
+			return fmt.Errorf("denied, answer %q", answer)
+		}
+		return nil
+	}
+}
+
+// Makes sure a value can't inject additional lines.
+func oneLine(s string) string {
+	return strings.NewReplacer("\n", " ", "\r", " ").Replace(s)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto"
 	"crypto/ed25519"
 	"fmt"
+	"io"
 )
 
 // Both keys and signatures are serialized in the same way.
@@ -40,3 +41,33 @@ func SSHFromEd25519(signer crypto.Signer) (string, SSHSign, error) {
 			return ed25519Sign(signer, msg)
 		}, nil
 }
+
+// Reads an Ed25519 private key in the format used by the
+// SSH_AGENTC_ADD_IDENTITY request, following the "ssh-ed25519" key
+// type string.
+func readEd25519PrivateKey(r io.Reader) (ed25519.PrivateKey, error) {
+	pub, err := readString(r, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("unexpected public key size: %d", len(pub))
+	}
+	// The private key blob consists of the 32-byte private key
+	// + 32 byte public key.
+	keys, err := readString(r, ed25519.PrivateKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	if len(keys) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("unexpected private key size: %d", len(keys))
+	}
+	if !bytes.Equal(pub, keys[32:]) {
+		return nil, fmt.Errorf("inconsistent public key")
+	}
+	priv := ed25519.NewKeyFromSeed(keys[:32])
+	if !bytes.Equal(priv.Public().(ed25519.PublicKey), pub) {
+		return nil, fmt.Errorf("public key doesn't match private key")
+	}
+	return priv, nil
+}
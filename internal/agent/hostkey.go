@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// Verification of signatures made by ssh host keys, as needed for
+// the session-bind@openssh.com extension. Supports the key and
+// signature types defined in RFC 5656 (ECDSA), RFC 8332 (RSA with
+// SHA-2) and RFC 8709 (Ed25519). Host certificates are not
+// supported.
+
+// Returns the OpenSSH style fingerprint of a public key blob.
+func Fingerprint[T bytesOrString](keyBlob T) string {
+	hash := sha256.Sum256([]byte(keyBlob))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+// Reads a non-negative mpint, as defined in RFC 4251.
+func readMpint(r io.Reader) (*big.Int, error) {
+	b, err := readString(r, 2048)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		return nil, fmt.Errorf("negative mpint")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+var ecdsaCurves = map[string]struct {
+	name  string
+	curve elliptic.Curve
+	hash  crypto.Hash
+}{
+	"ecdsa-sha2-nistp256": {"nistp256", elliptic.P256(), crypto.SHA256},
+	"ecdsa-sha2-nistp384": {"nistp384", elliptic.P384(), crypto.SHA384},
+	"ecdsa-sha2-nistp521": {"nistp521", elliptic.P521(), crypto.SHA512},
+}
+
+func hashData(h crypto.Hash, data []byte) []byte {
+	switch h {
+	case crypto.SHA256:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(data)
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+		return sum[:]
+	}
+	panic(fmt.Sprintf("internal error, unexpected hash %v", h))
+}
+
+func readSignatureBlob(sigBlob []byte) (string, []byte, error) {
+	return parseBytesPair(sigBlob, func(r io.Reader) (string, []byte, error) {
+		sigType, err := readString(r, 100)
+		if err != nil {
+			return "", nil, err
+		}
+		sig, err := readString(r, 1000)
+		return string(sigType), sig, err
+	})
+}
+
+// Like parseBytes, but for readers returning two values.
+func parseBytesPair[T, U any](blob []byte, reader func(io.Reader) (T, U, error)) (T, U, error) {
+	type pair struct {
+		t T
+		u U
+	}
+	p, err := parseBytes(blob, nil, func(r io.Reader) (pair, error) {
+		t, u, err := reader(r)
+		return pair{t, u}, err
+	})
+	return p.t, p.u, err
+}
+
+// Verifies an ssh signature blob (without outer length field) made
+// by the key represented by the given public key blob.
+func verifySSHSignature(keyBlob, sigBlob, data []byte) error {
+	sigType, sig, err := readSignatureBlob(sigBlob)
+	if err != nil {
+		return fmt.Errorf("invalid signature blob: %v", err)
+	}
+	keyType, keyData, err := parseBytesPair(keyBlob, func(r io.Reader) (string, []byte, error) {
+		keyType, err := readString(r, 100)
+		if err != nil {
+			return "", nil, err
+		}
+		// Leave the rest for type specific parsing.
+		rest, err := io.ReadAll(r)
+		return string(keyType), rest, err
+	})
+	if err != nil {
+		return fmt.Errorf("invalid public key blob: %v", err)
+	}
+
+	switch keyType {
+	case "ssh-ed25519":
+		if sigType != keyType {
+			return fmt.Errorf("unexpected signature type %q for key type %q", sigType, keyType)
+		}
+		pub, err := parseBytes(keyData, nil, func(r io.Reader) ([]byte, error) {
+			return readString(r, ed25519.PublicKeySize)
+		})
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid ed25519 public key")
+		}
+		if len(sig) != ed25519.SignatureSize || !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+			return fmt.Errorf("invalid ed25519 signature")
+		}
+		return nil
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		if sigType != keyType {
+			return fmt.Errorf("unexpected signature type %q for key type %q", sigType, keyType)
+		}
+		params := ecdsaCurves[keyType]
+		point, err := parseBytes(keyData, nil, func(r io.Reader) ([]byte, error) {
+			if err := readSkip(r, serializeString(params.name)); err != nil {
+				return nil, err
+			}
+			return readString(r, 200)
+		})
+		if err != nil {
+			return fmt.Errorf("invalid ecdsa public key: %v", err)
+		}
+		x, y := elliptic.Unmarshal(params.curve, point)
+		if x == nil {
+			return fmt.Errorf("invalid ecdsa public key point")
+		}
+		sigR, sigS, err := parseBytesPair(sig, func(r io.Reader) (*big.Int, *big.Int, error) {
+			sigR, err := readMpint(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			sigS, err := readMpint(r)
+			return sigR, sigS, err
+		})
+		if err != nil {
+			return fmt.Errorf("invalid ecdsa signature: %v", err)
+		}
+		pub := ecdsa.PublicKey{Curve: params.curve, X: x, Y: y}
+		if !ecdsa.Verify(&pub, hashData(params.hash, data), sigR, sigS) {
+			return fmt.Errorf("invalid ecdsa signature")
+		}
+		return nil
+	case "ssh-rsa":
+		var h crypto.Hash
+		switch sigType {
+		case "rsa-sha2-256":
+			h = crypto.SHA256
+		case "rsa-sha2-512":
+			h = crypto.SHA512
+		default:
+			return fmt.Errorf("unsupported rsa signature type %q", sigType)
+		}
+		e, n, err := parseBytesPair(keyData, func(r io.Reader) (*big.Int, *big.Int, error) {
+			e, err := readMpint(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			n, err := readMpint(r)
+			return e, n, err
+		})
+		if err != nil {
+			return fmt.Errorf("invalid rsa public key: %v", err)
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 || n.BitLen() < 2048 {
+			return fmt.Errorf("unsupported rsa public key")
+		}
+		pub := rsa.PublicKey{N: n, E: int(e.Int64())}
+		if err := rsa.VerifyPKCS1v15(&pub, h, hashData(h, data), sig); err != nil {
+			return fmt.Errorf("invalid rsa signature: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported host key type %q", keyType)
+}
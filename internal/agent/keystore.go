@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type keyEntry struct {
+	sign    SSHSign
+	comment string
+	// Zero value means that the key is valid immediately.
+	notBefore time.Time
+	// Zero value means that the key never expires.
+	expiry time.Time
+	// Require confirmation for each signature.
+	confirm bool
+	// If non-empty, the key can be used only towards these
+	// destinations.
+	destinations []destConstraint
+	// Static keys are configured at startup, and are never
+	// removed.
+	static bool
+}
+
+func (e *keyEntry) expired(now time.Time) bool {
+	return !e.expiry.IsZero() && !now.Before(e.expiry)
+}
+
+func (e *keyEntry) pending(now time.Time) bool {
+	return now.Before(e.notBefore)
+}
+
+type identity struct {
+	pubKey string
+	keyEntry
+}
+
+// A KeyStore is the set of keys served by the agent. It is safe
+// for concurrent use by multiple connections. Keys passed to
+// AddStatic are always available. If the store is created as
+// mutable, clients may also add and remove keys using the
+// corresponding agent requests.
+type KeyStore struct {
+	mutable bool
+
+	mu   sync.Mutex
+	keys map[string]*keyEntry
+}
+
+func NewKeyStore(mutable bool) *KeyStore {
+	return &KeyStore{mutable: mutable, keys: make(map[string]*keyEntry)}
+}
+
+// Adds a key that is available for the lifetime of the agent. The
+// pubKey is an SSH public key blob (without outer length field). If
+// confirm is true, each use of the key must be confirmed.
+func (ks *KeyStore) AddStatic(pubKey string, sign SSHSign, confirm bool) {
+	ks.AddStaticWithValidity(pubKey, sign, confirm, time.Time{}, time.Time{})
+}
+
+// Like AddStatic, but the key is available only from notBefore, and
+// until (not including) notAfter. Zero values mean no limit. When
+// the validity ends, the key is removed.
+func (ks *KeyStore) AddStaticWithValidity(pubKey string, sign SSHSign, confirm bool, notBefore, notAfter time.Time) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[pubKey] = &keyEntry{sign: sign, comment: "oracle key", confirm: confirm, static: true,
+		notBefore: notBefore, expiry: notAfter}
+}
+
+// Deletes expired keys. Must be called with the lock held.
+func (ks *KeyStore) expire() {
+	now := time.Now()
+	for k, e := range ks.keys {
+		if e.expired(now) {
+			if e.static {
+				log.Printf("Validity of key %s ended, key removed", Fingerprint(k))
+			}
+			delete(ks.keys, k)
+		}
+	}
+}
+
+func (ks *KeyStore) list() []identity {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.expire()
+
+	now := time.Now()
+	ids := make([]identity, 0, len(ks.keys))
+	for k, e := range ks.keys {
+		if !e.pending(now) {
+			ids = append(ids, identity{pubKey: k, keyEntry: *e})
+		}
+	}
+	return ids
+}
+
+func (ks *KeyStore) lookup(pubKey string) (keyEntry, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.expire()
+
+	e, ok := ks.keys[pubKey]
+	if !ok || e.pending(time.Now()) {
+		return keyEntry{}, false
+	}
+	return *e, true
+}
+
+func (ks *KeyStore) add(pubKey string, e keyEntry) error {
+	if !ks.mutable {
+		return fmt.Errorf("adding keys is not enabled")
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if old, ok := ks.keys[pubKey]; ok && old.static {
+		return fmt.Errorf("key is already configured as a static key")
+	}
+	ks.keys[pubKey] = &e
+	return nil
+}
+
+func (ks *KeyStore) remove(pubKey string) error {
+	if !ks.mutable {
+		return fmt.Errorf("removing keys is not enabled")
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	e, ok := ks.keys[pubKey]
+	if !ok {
+		return fmt.Errorf("key not found")
+	}
+	if e.static {
+		return fmt.Errorf("static keys can't be removed")
+	}
+	delete(ks.keys, pubKey)
+	return nil
+}
+
+// Removes all keys except the static ones.
+func (ks *KeyStore) removeAll() error {
+	if !ks.mutable {
+		return fmt.Errorf("removing keys is not enabled")
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for k, e := range ks.keys {
+		if !e.static {
+			delete(ks.keys, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Signature type of Ed25519 keys in signed notes, see
+// https://c2sp.org/signed-note.
+const noteSignatureTypeEd25519 = 0x01
+
+// Checks that the name is valid as the key name of a signed note:
+// non-empty, and without white space or "+" characters.
+func CheckNoteKeyName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("empty note key name")
+	}
+	if !utf8.ValidString(name) || strings.ContainsFunc(name, func(r rune) bool {
+		return r == '+' || unicode.IsSpace(r) || unicode.IsControl(r)
+	}) {
+		return fmt.Errorf("invalid note key name %q", name)
+	}
+	return nil
+}
+
+// Returns the key ID of an Ed25519 key in signed notes: the first
+// four bytes of the SHA-256 hash of the key name, a newline, the
+// signature type and the public key.
+func NoteKeyId(name string, pub ed25519.PublicKey) uint32 {
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte{'\n', noteSignatureTypeEd25519})
+	h.Write(pub)
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+// Returns the verifier key, "NAME+KEYID+KEY", where KEYID is hex,
+// and KEY is the base64 encoding of the signature type and the public
+// key, as used to configure verifiers of signed notes.
+func NoteVerifierKey(name string, pub ed25519.PublicKey) string {
+	key := append([]byte{noteSignatureTypeEd25519}, pub...)
+	return fmt.Sprintf("%s+%08x+%s", name, NoteKeyId(name, pub), base64.StdEncoding.EncodeToString(key))
+}
+
+// Checks that data is a valid note text: non-empty UTF-8, ending
+// with a newline, and without control characters other than newline.
+func checkNoteText(data []byte) error {
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		return fmt.Errorf("note text not terminated by newline")
+	}
+	if !utf8.Valid(data) {
+		return fmt.Errorf("note text is not valid UTF-8")
+	}
+	for _, r := range string(data) {
+		if r != '\n' && unicode.IsControl(r) {
+			return fmt.Errorf("note text contains control character %U", r)
+		}
+	}
+	return nil
+}
+
+// A NotePolicy restricts sign requests to the text of signed notes,
+// see https://c2sp.org/signed-note, signed with the key name Name.
+// If State is non-nil, the note must be a checkpoint, see
+// https://c2sp.org/tlog-checkpoint, with Name as the origin, and
+// consistent with the checkpoints signed previously, as for
+// WitnessPolicy.
+type NotePolicy struct {
+	Name  string
+	State *TreeState
+}
+
+func (p *NotePolicy) check(data []byte, _ time.Time) error {
+	if err := checkNoteText(data); err != nil {
+		return err
+	}
+	if p.State == nil {
+		return nil
+	}
+	c, err := ParseCheckpoint(data)
+	if err != nil {
+		return err
+	}
+	if c.Origin != p.Name {
+		return fmt.Errorf("checkpoint origin %q doesn't match key name %q", c.Origin, p.Name)
+	}
+	return p.State.Update(c)
+}
@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Returns credentials of the process at the other end of a unix
+// socket connection, or nil if not available.
+func PeerCredentials(c net.Conn) *Peer {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return nil
+	}
+	peer := Peer{Pid: int(cred.Pid), Uid: int(cred.Uid), Gid: int(cred.Gid)}
+	if comm, err := os.ReadFile("/proc/" + strconv.Itoa(peer.Pid) + "/comm"); err == nil {
+		peer.Command = strings.TrimSpace(string(comm))
+	}
+	return &peer
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package agent
+
+import (
+	"net"
+)
+
+// Peer credentials are supported only on linux.
+func PeerCredentials(c net.Conn) *Peer {
+	return nil
+}
@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parameters for a token bucket: Rate is the number of tokens added
+// per second, and Burst is the maximum number of tokens.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// Parses a rate limit of the form "COUNT/UNIT[:BURST]", where UNIT is
+// one of "s", "m", "h" or "d". E.g., "10/m:20" means on average 10
+// requests per minute, with bursts up to 20 requests. The default
+// burst size is COUNT.
+func ParseRateLimit(s string) (RateLimit, error) {
+	spec, burstSpec, hasBurst := strings.Cut(s, ":")
+	countSpec, unit, ok := strings.Cut(spec, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, missing unit", s)
+	}
+	count, err := strconv.ParseUint(countSpec, 10, 32)
+	if err != nil || count == 0 {
+		return RateLimit{}, fmt.Errorf("invalid count in rate limit %q", s)
+	}
+	var period time.Duration
+	switch unit {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	case "d":
+		period = 24 * time.Hour
+	default:
+		return RateLimit{}, fmt.Errorf("invalid unit in rate limit %q", s)
+	}
+	burst := count
+	if hasBurst {
+		burst, err = strconv.ParseUint(burstSpec, 10, 32)
+		if err != nil || burst == 0 {
+			return RateLimit{}, fmt.Errorf("invalid burst size in rate limit %q", s)
+		}
+	}
+	return RateLimit{Rate: float64(count) / period.Seconds(), Burst: float64(burst)}, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// Number of requests allowed and refused.
+	allowed, refused uint64
+	// Number of requests refused since the last allowed one.
+	recentRefused uint64
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: limit.Burst, last: now}
+}
+
+func (b *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	b.tokens += limit.Rate * now.Sub(b.last).Seconds()
+	if b.tokens > limit.Burst {
+		b.tokens = limit.Burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Records the outcome for the bucket, and logs when the limit is
+// first hit, and when requests are allowed again.
+func (b *tokenBucket) record(allowed bool, what string) {
+	if allowed {
+		b.allowed++
+		if b.recentRefused > 0 {
+			log.Printf("rate limit for %s no longer exceeded, %d requests were refused", what, b.recentRefused)
+			b.recentRefused = 0
+		}
+		return
+	}
+	b.refused++
+	if b.recentRefused == 0 {
+		log.Printf("rate limit for %s exceeded, refusing requests", what)
+	}
+	b.recentRefused++
+}
+
+// A RateLimiter applies token bucket limits to sign requests, per
+// key and per peer uid. It is safe for concurrent use.
+type RateLimiter struct {
+	keyLimit *RateLimit
+	uidLimit *RateLimit
+
+	mu   sync.Mutex
+	keys map[string]*tokenBucket
+	uids map[int]*tokenBucket
+}
+
+// Either limit may be nil, meaning no limit.
+func NewRateLimiter(keyLimit, uidLimit *RateLimit) *RateLimiter {
+	return &RateLimiter{
+		keyLimit: keyLimit,
+		uidLimit: uidLimit,
+		keys:     make(map[string]*tokenBucket),
+		uids:     make(map[int]*tokenBucket),
+	}
+}
+
+// Checks whether or not a sign request is within limits. Tokens are
+// consumed only if the request is allowed by all applicable limits.
+func (l *RateLimiter) allow(pubKey string, peer *Peer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var keyBucket, uidBucket *tokenBucket
+	if l.keyLimit != nil {
+		keyBucket = l.keys[pubKey]
+		if keyBucket == nil {
+			keyBucket = newTokenBucket(*l.keyLimit, now)
+			l.keys[pubKey] = keyBucket
+		}
+	}
+	// Processes with unknown credentials share a single bucket.
+	uid := -1
+	if peer != nil {
+		uid = peer.Uid
+	}
+	if l.uidLimit != nil {
+		uidBucket = l.uids[uid]
+		if uidBucket == nil {
+			uidBucket = newTokenBucket(*l.uidLimit, now)
+			l.uids[uid] = uidBucket
+		}
+	}
+	// Check the uid limit first, to not consume key tokens for
+	// requests from a misbehaving peer.
+	if uidBucket != nil && !uidBucket.take(*l.uidLimit, now) {
+		uidBucket.record(false, fmt.Sprintf("uid %d", uid))
+		return fmt.Errorf("rate limit exceeded for uid %d", uid)
+	}
+	if keyBucket != nil {
+		ok := keyBucket.take(*l.keyLimit, now)
+		keyBucket.record(ok, "key "+Fingerprint(pubKey))
+		if !ok {
+			if uidBucket != nil {
+				// Give back the uid token.
+				uidBucket.tokens++
+			}
+			return fmt.Errorf("rate limit exceeded for key %s", Fingerprint(pubKey))
+		}
+	}
+	if uidBucket != nil {
+		uidBucket.record(true, fmt.Sprintf("uid %d", uid))
+	}
+	return nil
+}
+
+// Returns a human readable summary of the counters, one line per key
+// and uid.
+func (l *RateLimiter) Stats() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var lines []string
+	for k, b := range l.keys {
+		lines = append(lines, fmt.Sprintf("key %s: %d requests allowed, %d refused",
+			Fingerprint(k), b.allowed, b.refused))
+	}
+	for uid, b := range l.uids {
+		lines = append(lines, fmt.Sprintf("uid %d: %d requests allowed, %d refused",
+			uid, b.allowed, b.refused))
+	}
+	sort.Strings(lines)
+	return lines
+}
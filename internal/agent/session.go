@@ -0,0 +1,325 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Support for the session-bind@openssh.com extension and
+// restrict-destination-v00@openssh.com key constraints. See
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.agent
+// The rules for which keys are usable are intended to follow
+// OpenSSH's ssh-agent, except that host certificates are not
+// supported.
+
+const (
+	SSH_AGENTC_EXTENSION        = 27
+	SSH_AGENT_EXTENSION_FAILURE = 28
+
+	SSH_MSG_USERAUTH_REQUEST = 50
+
+	sessionBindExtension         = "session-bind@openssh.com"
+	restrictDestinationExtension = "restrict-destination-v00@openssh.com"
+
+	// Same limit as used by OpenSSH.
+	maxSessionBindings = 16
+)
+
+// A session binding, recorded per agent connection.
+type sessionBinding struct {
+	hostKey    []byte
+	sessionId  []byte
+	forwarding bool
+}
+
+type sessionBindRequest struct {
+	sessionBinding
+	signature []byte
+}
+
+func readBool(r io.Reader) (bool, error) {
+	b, err := readBytes(r, 1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] != 0, nil
+}
+
+func readSessionBindRequest(r io.Reader) (req sessionBindRequest, err error) {
+	req.hostKey, err = readString(r, maxSize)
+	if err != nil {
+		return
+	}
+	req.sessionId, err = readString(r, 128)
+	if err != nil {
+		return
+	}
+	req.signature, err = readString(r, maxSize)
+	if err != nil {
+		return
+	}
+	req.forwarding, err = readBool(r)
+	return
+}
+
+// Processes a session-bind request, and if it is valid, appends it to
+// the connection's list of bindings.
+func bindSession(bindings []sessionBinding, msg []byte) ([]sessionBinding, error) {
+	req, err := parseBytes(msg, nil, readSessionBindRequest)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySSHSignature(req.hostKey, req.signature, req.sessionId); err != nil {
+		return nil, fmt.Errorf("host key signature on session id failed: %v", err)
+	}
+	for _, b := range bindings {
+		if !b.forwarding {
+			return nil, fmt.Errorf("connection already bound for authentication")
+		}
+		if bytes.Equal(b.sessionId, req.sessionId) {
+			if bytes.Equal(b.hostKey, req.hostKey) {
+				// Already bound, nothing to do.
+				return bindings, nil
+			}
+			return nil, fmt.Errorf("session id already bound to a different host key")
+		}
+	}
+	if len(bindings) >= maxSessionBindings {
+		return nil, fmt.Errorf("too many session bindings")
+	}
+	log.Printf("session bound to host key %s, forwarding: %v", Fingerprint(req.hostKey), req.forwarding)
+	return append(bindings, req.sessionBinding), nil
+}
+
+// One hop in a destination constraint. An empty hostname and no keys
+// in the "from" hop means the local host.
+type destHop struct {
+	user     string
+	hostname string
+	// Public key blobs. CA keys are not included, since host
+	// certificates are not supported.
+	hostKeys [][]byte
+}
+
+type destConstraint struct {
+	from destHop
+	to   destHop
+}
+
+func readDestHop(r io.Reader) (hop destHop, err error) {
+	user, err := readString(r, maxSize)
+	if err != nil {
+		return
+	}
+	hostname, err := readString(r, maxSize)
+	if err != nil {
+		return
+	}
+	// Reserved.
+	if _, err = readString(r, maxSize); err != nil {
+		return
+	}
+	hop.user, hop.hostname = string(user), string(hostname)
+	for {
+		var key []byte
+		key, err = readString(r, maxSize)
+		if errors.Is(err, io.EOF) {
+			return hop, nil
+		}
+		if err != nil {
+			return
+		}
+		var isCA bool
+		isCA, err = readBool(r)
+		if err != nil {
+			return
+		}
+		if !isCA {
+			hop.hostKeys = append(hop.hostKeys, key)
+		}
+	}
+}
+
+func readDestConstraint(r io.Reader) (c destConstraint, err error) {
+	blob, err := readString(r, maxSize)
+	if err != nil {
+		return
+	}
+	return parseBytes(blob, nil, func(r io.Reader) (c destConstraint, err error) {
+		for _, hop := range []*destHop{&c.from, &c.to} {
+			var hopBlob []byte
+			hopBlob, err = readString(r, maxSize)
+			if err != nil {
+				return
+			}
+			*hop, err = parseBytes(hopBlob, nil, readDestHop)
+			if err != nil {
+				return
+			}
+		}
+		// Reserved.
+		_, err = readString(r, maxSize)
+		return
+	})
+}
+
+func readDestConstraints(r io.Reader) ([]destConstraint, error) {
+	blob, err := readString(r, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return parseBytes(blob, nil, func(r io.Reader) ([]destConstraint, error) {
+		var constraints []destConstraint
+		for {
+			c, err := readDestConstraint(r)
+			if errors.Is(err, io.EOF) {
+				if len(constraints) == 0 {
+					return nil, fmt.Errorf("empty destination constraint")
+				}
+				return constraints, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if c.from.user != "" {
+				return nil, fmt.Errorf("invalid destination constraint, from user is set")
+			}
+			if c.to.hostname == "" || len(c.to.hostKeys) == 0 {
+				return nil, fmt.Errorf("invalid destination constraint, missing to host")
+			}
+			constraints = append(constraints, c)
+		}
+	})
+}
+
+func (hop *destHop) matchKey(key []byte) bool {
+	for _, k := range hop.hostKeys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the constraints allow the hop from fromKey to toKey. A
+// nil fromKey means the local host, and a nil toKey matches any "to"
+// hop. If user is non-empty, it must match the constraint's user, if
+// any.
+func permittedHop(constraints []destConstraint, fromKey, toKey []byte, user string) bool {
+	for _, c := range constraints {
+		if fromKey == nil {
+			if c.from.hostname != "" || len(c.from.hostKeys) > 0 {
+				continue
+			}
+		} else if !c.from.matchKey(fromKey) {
+			continue
+		}
+		if toKey != nil && !c.to.matchKey(toKey) {
+			continue
+		}
+		if user != "" && c.to.user != "" && c.to.user != user {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Checks if a key is usable on a connection with the given session
+// bindings. The user is the remote user name, if known.
+func permittedKey(e *keyEntry, bindings []sessionBinding, user string) bool {
+	if len(e.destinations) == 0 {
+		return true
+	}
+	if len(bindings) == 0 {
+		// Local use.
+		return true
+	}
+	var fromKey []byte
+	for i, b := range bindings {
+		hopUser := ""
+		if i == len(bindings)-1 {
+			hopUser = user
+		}
+		if !permittedHop(e.destinations, fromKey, b.hostKey, hopUser) {
+			return false
+		}
+		fromKey = b.hostKey
+	}
+	// If the connection was forwarded to the last host, the key
+	// must be usable for some hop beyond it.
+	last := bindings[len(bindings)-1]
+	if last.forwarding && user == "" && !permittedHop(e.destinations, last.hostKey, nil, "") {
+		return false
+	}
+	return true
+}
+
+type userauthRequest struct {
+	sessionId []byte
+	user      string
+	hostKey   []byte
+}
+
+// Parses data to be signed as an ssh userauth request, using the
+// publickey-hostbound-v00@openssh.com method, which includes the
+// server's host key.
+func readUserauthRequest(r io.Reader, pubKey []byte) (req userauthRequest, err error) {
+	req.sessionId, err = readString(r, 128)
+	if err != nil {
+		return
+	}
+	if err = readSkip(r, []byte{SSH_MSG_USERAUTH_REQUEST}); err != nil {
+		return
+	}
+	user, err := readString(r, maxSize)
+	if err != nil {
+		return
+	}
+	req.user = string(user)
+	if err = readSkip(r, bytes.Join([][]byte{
+		serializeString("ssh-connection"),
+		serializeString("publickey-hostbound-v00@openssh.com"),
+		[]byte{1}}, nil)); err != nil {
+		return
+	}
+	// Signature algorithm.
+	if _, err = readString(r, 100); err != nil {
+		return
+	}
+	if err = readSkip(r, serializeString(pubKey)); err != nil {
+		err = fmt.Errorf("unexpected public key: %v", err)
+		return
+	}
+	req.hostKey, err = readString(r, maxSize)
+	return
+}
+
+// Checks if a sign request using a destination constrained key is
+// allowed on a connection with the given bindings.
+func checkConstrainedSign(e *keyEntry, pubKey, data []byte, bindings []sessionBinding) error {
+	if len(bindings) == 0 {
+		return fmt.Errorf("destination constrained key used on unbound connection")
+	}
+	req, err := parseBytes(data, nil, func(r io.Reader) (userauthRequest, error) {
+		return readUserauthRequest(r, pubKey)
+	})
+	if err != nil {
+		return fmt.Errorf("destination constrained key used to sign unidentified data: %v", err)
+	}
+	last := bindings[len(bindings)-1]
+	if !bytes.Equal(req.sessionId, last.sessionId) {
+		return fmt.Errorf("unexpected session id in userauth request")
+	}
+	if !bytes.Equal(req.hostKey, last.hostKey) {
+		return fmt.Errorf("unexpected host key in userauth request")
+	}
+	if !permittedKey(e, bindings, req.user) {
+		return fmt.Errorf("destination not permitted for user %q, host key %s",
+			req.user, Fingerprint(req.hostKey))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+)
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func publicBlob(priv ed25519.PrivateKey) []byte {
+	return serializeEd25519(priv.Public().(ed25519.PublicKey))
+}
+
+// Serializes a destination constraint permitting use from the local
+// host to the given host keys, as "ssh-add -h" does.
+func serializeDestConstraint(hostname string, hostKeys ...[]byte) []byte {
+	hop := func(hostname string, keys [][]byte) []byte {
+		b := bytes.Join([][]byte{
+			serializeString(""), // user
+			serializeString(hostname),
+			serializeString(""), // reserved
+		}, nil)
+		for _, key := range keys {
+			b = append(b, serializeString(key)...)
+			b = append(b, 0) // not a CA key
+		}
+		return serializeString(b)
+	}
+	constraint := bytes.Join([][]byte{
+		hop("", nil),
+		hop(hostname, hostKeys),
+		serializeString(""), // reserved
+	}, nil)
+	return serializeString(serializeString(constraint))
+}
+
+func addConstrainedRequest(priv ed25519.PrivateKey, constraint []byte) []byte {
+	return bytes.Join([][]byte{
+		[]byte{SSH_AGENTC_ADD_ID_CONSTRAINED},
+		serializeString("ssh-ed25519"),
+		serializeString([]byte(priv.Public().(ed25519.PublicKey))),
+		serializeString([]byte(priv)),
+		serializeString("constrained key"),
+		[]byte{SSH_AGENT_CONSTRAIN_EXTENSION},
+		serializeString(restrictDestinationExtension),
+		constraint,
+	}, nil)
+}
+
+// Serializes a session bind request, with the session id signed by
+// signer, but claiming the host key hostKey.
+func serializeSessionBind(hostKey []byte, signer ed25519.PrivateKey, sessionId []byte) []byte {
+	return bytes.Join([][]byte{
+		[]byte{SSH_AGENTC_EXTENSION},
+		serializeString(sessionBindExtension),
+		serializeString(hostKey),
+		serializeString(sessionId),
+		serializeString(serializeEd25519(ed25519.Sign(signer, sessionId))),
+		[]byte{0}, // not forwarding
+	}, nil)
+}
+
+// Sign request for an ssh userauth request, as made by an ssh client
+// using the publickey-hostbound-v00@openssh.com method.
+func userauthSignRequest(key []byte, sessionId []byte, user string, hostKey []byte) []byte {
+	data := bytes.Join([][]byte{
+		serializeString(sessionId),
+		[]byte{SSH_MSG_USERAUTH_REQUEST},
+		serializeString(user),
+		serializeString("ssh-connection"),
+		serializeString("publickey-hostbound-v00@openssh.com"),
+		[]byte{1},
+		serializeString("ssh-ed25519"),
+		serializeString(key),
+		serializeString(hostKey),
+	}, nil)
+	return bytes.Join([][]byte{
+		[]byte{SSH_AGENTC_SIGN_REQUEST},
+		serializeString(key),
+		serializeString(data),
+		serializeUint32(0),
+	}, nil)
+}
+
+// Starts serving a new connection to the agent, and returns a
+// function to make requests, returning the response message type.
+func connect(t *testing.T, a *Agent) func([]byte) byte {
+	client, server := net.Pipe()
+	go a.ServeAgent(server, server, nil)
+	t.Cleanup(func() { client.Close() })
+	return func(msg []byte) byte {
+		if err := writeString(client, msg); err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := readString(client, maxSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rsp) == 0 {
+			t.Fatal("empty response")
+		}
+		return rsp[0]
+	}
+}
+
+func TestDestinationConstraints(t *testing.T) {
+	key := newTestKey(t)
+	host := newTestKey(t)
+	otherHost := newTestKey(t)
+
+	a := Agent{Keys: NewKeyStore(true)}
+	request := connect(t, &a)
+	if rsp := request(addConstrainedRequest(key, serializeDestConstraint("example.org", publicBlob(host)))); rsp != SSH_AGENT_SUCCESS {
+		t.Fatalf("adding constrained key failed, response %d", rsp)
+	}
+	sessionId := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, table := range []struct {
+		desc       string
+		bindKey    []byte
+		bindSigner ed25519.PrivateKey
+		bindRsp    byte
+		signRsp    byte
+	}{
+		{"permitted host", publicBlob(host), host, SSH_AGENT_SUCCESS, SSH_AGENT_SIGN_RESPONSE},
+		{"forged binding", publicBlob(host), otherHost, SSH_AGENT_EXTENSION_FAILURE, SSH_AGENT_FAILURE},
+		{"host not permitted", publicBlob(otherHost), otherHost, SSH_AGENT_SUCCESS, SSH_AGENT_FAILURE},
+	} {
+		request := connect(t, &a)
+		if rsp := request(serializeSessionBind(table.bindKey, table.bindSigner, sessionId)); rsp != table.bindRsp {
+			t.Errorf("%s: unexpected session bind response %d, expected %d", table.desc, rsp, table.bindRsp)
+		}
+		if rsp := request(userauthSignRequest(publicBlob(key), sessionId, "user", table.bindKey)); rsp != table.signRsp {
+			t.Errorf("%s: unexpected sign response %d, expected %d", table.desc, rsp, table.signRsp)
+		}
+	}
+
+	// On a bound connection, the userauth request must match the
+	// bound session id and host key.
+	request = connect(t, &a)
+	if rsp := request(serializeSessionBind(publicBlob(host), host, sessionId)); rsp != SSH_AGENT_SUCCESS {
+		t.Fatalf("session bind failed, response %d", rsp)
+	}
+	otherSessionId := []byte("fedcba9876543210fedcba9876543210")
+	if rsp := request(userauthSignRequest(publicBlob(key), otherSessionId, "user", publicBlob(host))); rsp != SSH_AGENT_FAILURE {
+		t.Errorf("sign request with other session id accepted, response %d", rsp)
+	}
+	if rsp := request(userauthSignRequest(publicBlob(key), sessionId, "user", publicBlob(otherHost))); rsp != SSH_AGENT_FAILURE {
+		t.Errorf("sign request with mismatched host key accepted, response %d", rsp)
+	}
+	// Signing arbitrary data is refused.
+	if rsp := request(bytes.Join([][]byte{
+		[]byte{SSH_AGENTC_SIGN_REQUEST},
+		serializeString(publicBlob(key)),
+		serializeString("foo"),
+		serializeUint32(0),
+	}, nil)); rsp != SSH_AGENT_FAILURE {
+		t.Errorf("sign request for arbitrary data accepted, response %d", rsp)
+	}
+}
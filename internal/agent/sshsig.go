@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Creating and verifying detached SSHSIG signatures, compatible with
+// "ssh-keygen -Y sign" and "ssh-keygen -Y verify", see
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+// Only Ed25519 keys, and the sha512 hash, are supported.
+
+const (
+	pemSSHSIGTag   = "SSH SIGNATURE"
+	sshsigHashAlg  = "sha512"
+	sshsigVersion  = 1
+	sshsigMaxNames = 1000
+)
+
+// Formats a public key in OpenSSH format, "ssh-ed25519 <base64>".
+func FormatPublicKey(pub ed25519.PublicKey) string {
+	return "ssh-ed25519 " + base64.StdEncoding.EncodeToString(serializeEd25519(pub))
+}
+
+// Parses a public key in OpenSSH format. A trailing comment is
+// ignored.
+func ParsePublicKey(line string) (ed25519.PublicKey, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "ssh-ed25519" {
+		return nil, fmt.Errorf("not an ssh-ed25519 public key")
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key base64: %v", err)
+	}
+	return parseBytes(blob, nil, readPublicEd25519)
+}
+
+func sshsigSignedMessage(namespace string, msg []byte) []byte {
+	hash := sha512.Sum512(msg)
+	return bytes.Join([][]byte{
+		[]byte("SSHSIG"),
+		serializeString(namespace),
+		serializeString(""), // Reserved.
+		serializeString(sshsigHashAlg),
+		serializeString(hash[:]),
+	}, nil)
+}
+
+// Signs a message, and returns the signature in armored (PEM) form.
+func SignSSHSIG(signer crypto.Signer, namespace string, msg []byte) ([]byte, error) {
+	pub, ok := signer.Public().(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an Ed25519 key, type %T", signer.Public())
+	}
+	sig, err := ed25519Sign(signer, sshsigSignedMessage(namespace, msg))
+	if err != nil {
+		return nil, err
+	}
+	blob := bytes.Join([][]byte{
+		[]byte("SSHSIG"),
+		serializeUint32(sshsigVersion),
+		serializeString(serializeEd25519(pub)),
+		serializeString(namespace),
+		serializeString(""),
+		serializeString(sshsigHashAlg),
+		serializeString(sig),
+	}, nil)
+	return pem.EncodeToMemory(&pem.Block{Type: pemSSHSIGTag, Bytes: blob}), nil
+}
+
+type sshsig struct {
+	pub       ed25519.PublicKey
+	namespace string
+	hashAlg   string
+	signature []byte
+}
+
+func readSSHSIG(r io.Reader) (sig sshsig, err error) {
+	if err = readSkip(r, []byte("SSHSIG")); err != nil {
+		return
+	}
+	version, err := readUint32(r)
+	if err != nil {
+		return
+	}
+	if version != sshsigVersion {
+		err = fmt.Errorf("unsupported sshsig version %d", version)
+		return
+	}
+	keyBlob, err := readString(r, 1000)
+	if err != nil {
+		return
+	}
+	if sig.pub, err = parseBytes(keyBlob, nil, readPublicEd25519); err != nil {
+		return
+	}
+	namespace, err := readString(r, sshsigMaxNames)
+	if err != nil {
+		return
+	}
+	// Reserved.
+	if _, err = readString(r, sshsigMaxNames); err != nil {
+		return
+	}
+	hashAlg, err := readString(r, 100)
+	if err != nil {
+		return
+	}
+	sigBlob, err := readString(r, 1000)
+	if err != nil {
+		return
+	}
+	sigType, signature, err := readSignatureBlob(sigBlob)
+	if err != nil {
+		return
+	}
+	if sigType != "ssh-ed25519" || len(signature) != ed25519.SignatureSize {
+		err = fmt.Errorf("unsupported signature type %q", sigType)
+		return
+	}
+	sig.namespace, sig.hashAlg, sig.signature = string(namespace), string(hashAlg), signature
+	return
+}
+
+// Verifies an armored SSHSIG signature on a message, with the
+// expected namespace, and returns the public key of the signer. The
+// caller must check that the key is an allowed signer.
+func VerifySSHSIG(armored []byte, namespace string, msg []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != pemSSHSIGTag {
+		return nil, fmt.Errorf("not an armored ssh signature")
+	}
+	sig, err := parseBytes(block.Bytes, nil, readSSHSIG)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh signature: %v", err)
+	}
+	if sig.namespace != namespace {
+		return nil, fmt.Errorf("unexpected signature namespace %q, expected %q", sig.namespace, namespace)
+	}
+	if sig.hashAlg != sshsigHashAlg {
+		return nil, fmt.Errorf("unsupported signature hash algorithm %q", sig.hashAlg)
+	}
+	if !ed25519.Verify(sig.pub, sshsigSignedMessage(namespace, msg), sig.signature) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return sig.pub, nil
+}
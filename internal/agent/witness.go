@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header line of cosignature messages, see
+// https://c2sp.org/tlog-cosignature, as signed by sigsum witnesses.
+const CosignatureHeader = "cosignature/v1"
+
+// A request for a witness cosignature: the timestamp, in seconds
+// since the epoch, and the cosigned checkpoint.
+type Cosignature struct {
+	Timestamp  uint64
+	Checkpoint Checkpoint
+}
+
+// Parses a cosignature message: the header line, a "time" line with
+// the timestamp, and the checkpoint body. Checkpoints with extension
+// lines are refused, since they aren't covered by the cosignature.
+func ParseCosignature(data []byte) (*Cosignature, error) {
+	header, data, _ := bytes.Cut(data, []byte{'\n'})
+	if string(header) != CosignatureHeader {
+		return nil, fmt.Errorf("not a cosignature message, unexpected header %q", header)
+	}
+	timeLine, data, _ := bytes.Cut(data, []byte{'\n'})
+	timestamp, ok := strings.CutPrefix(string(timeLine), "time ")
+	if !ok {
+		return nil, fmt.Errorf("invalid cosignature time line %q", timeLine)
+	}
+	t, err := strconv.ParseUint(timestamp, 10, 64)
+	if err != nil || strconv.FormatUint(t, 10) != timestamp {
+		return nil, fmt.Errorf("invalid cosignature timestamp %q", timestamp)
+	}
+	c, err := ParseCheckpoint(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Extensions) > 0 {
+		return nil, fmt.Errorf("checkpoint has %d extension lines", len(c.Extensions))
+	}
+	return &Cosignature{Timestamp: t, Checkpoint: *c}, nil
+}
+
+// A WitnessPolicy restricts sign requests to cosignatures of
+// checkpoints of known logs, with a timestamp close to the local
+// clock, that are consistent with the checkpoints cosigned
+// previously: the tree size for a log never decreases, and the root
+// hash for a given size never changes.
+type WitnessPolicy struct {
+	// Origins of the logs to cosign.
+	Origins map[string]bool
+	// Max difference between the timestamp and the local clock.
+	MaxSkew time.Duration
+	State   *TreeState
+}
+
+// Reads the origins of the logs to cosign, one per line. Empty lines
+// and lines starting with "#" are ignored.
+func ReadOriginsFile(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	origins := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		origins[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(origins) == 0 {
+		return nil, fmt.Errorf("no origins listed in %q", file)
+	}
+	return origins, nil
+}
+
+// Checks a sign request, and, if allowed, records the checkpoint in
+// the state.
+func (p *WitnessPolicy) check(data []byte, now time.Time) error {
+	cs, err := ParseCosignature(data)
+	if err != nil {
+		return err
+	}
+	c := &cs.Checkpoint
+	if !p.Origins[c.Origin] {
+		return fmt.Errorf("unknown log origin %q", c.Origin)
+	}
+	if cs.Timestamp > math.MaxInt64 {
+		return fmt.Errorf("invalid cosignature timestamp %d", cs.Timestamp)
+	}
+	skew := int64(cs.Timestamp) - now.Unix()
+	if maxSkew := int64(p.MaxSkew / time.Second); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("cosignature timestamp %d too far from local time %d", cs.Timestamp, now.Unix())
+	}
+	return p.State.Update(c)
+}
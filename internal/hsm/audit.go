@@ -0,0 +1,180 @@
+package hsm
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/certusone/yubihsm-go/commands"
+)
+
+// Support for the device's audit log. Each log entry includes a
+// digest, computed over the entry and the digest of the previous
+// entry, so that the entries form a hash chain. See
+// https://developers.yubico.com/YubiHSM2/Concepts/Logs.html
+
+const (
+	logEntrySize  = 32
+	logDigestSize = 16
+)
+
+type LogEntry struct {
+	Number     uint16
+	Command    uint8
+	Length     uint16
+	SessionKey uint16
+	TargetKey  uint16
+	SecondKey  uint16
+	Result     uint8
+	Systick    uint32
+	Digest     [logDigestSize]byte
+}
+
+// Log entries returned by the device, and the number of events that
+// couldn't be logged since the log was full.
+type LogStatus struct {
+	UnloggedBoots uint16
+	UnloggedAuths uint16
+	Entries       []LogEntry
+}
+
+// Serializes the entry, excluding the digest.
+func (e *LogEntry) marshalFields() []byte {
+	b := binary.BigEndian.AppendUint16(nil, e.Number)
+	b = append(b, e.Command)
+	b = binary.BigEndian.AppendUint16(b, e.Length)
+	b = binary.BigEndian.AppendUint16(b, e.SessionKey)
+	b = binary.BigEndian.AppendUint16(b, e.TargetKey)
+	b = binary.BigEndian.AppendUint16(b, e.SecondKey)
+	b = append(b, e.Result)
+	return binary.BigEndian.AppendUint32(b, e.Systick)
+}
+
+// Serializes the entry, as returned by the device.
+func (e *LogEntry) Marshal() []byte {
+	return append(e.marshalFields(), e.Digest[:]...)
+}
+
+func parseLogEntry(b []byte) LogEntry {
+	e := LogEntry{
+		Number:     binary.BigEndian.Uint16(b[0:]),
+		Command:    b[2],
+		Length:     binary.BigEndian.Uint16(b[3:]),
+		SessionKey: binary.BigEndian.Uint16(b[5:]),
+		TargetKey:  binary.BigEndian.Uint16(b[7:]),
+		SecondKey:  binary.BigEndian.Uint16(b[9:]),
+		Result:     b[11],
+		Systick:    binary.BigEndian.Uint32(b[12:]),
+	}
+	copy(e.Digest[:], b[16:logEntrySize])
+	return e
+}
+
+// Computes the digest of the entry, given the previous entry.
+func (e *LogEntry) computeDigest(prev *LogEntry) (digest [logDigestSize]byte) {
+	h := sha256.New()
+	h.Write(e.marshalFields())
+	h.Write(prev.Digest[:])
+	copy(digest[:], h.Sum(nil))
+	return
+}
+
+// Checks that the entries are consecutive, and that the digests form
+// a valid chain. If prev is non-nil, the first entry must follow it,
+// otherwise, the digest of the first entry can't be checked.
+func VerifyLogChain(prev *LogEntry, entries []LogEntry) error {
+	for i := range entries {
+		e := &entries[i]
+		if prev != nil {
+			if e.Number != prev.Number+1 {
+				return fmt.Errorf("log entry %d doesn't follow entry %d", e.Number, prev.Number)
+			}
+			if e.computeDigest(prev) != e.Digest {
+				return fmt.Errorf("invalid digest for log entry %d", e.Number)
+			}
+		}
+		prev = e
+	}
+	return nil
+}
+
+func (d *Device) GetLogs() (*LogStatus, error) {
+	rsp, err := d.sendRaw(commands.CommandTypeGetLogs, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp) < 5 || len(rsp) != 5+logEntrySize*int(rsp[4]) {
+		return nil, fmt.Errorf("invalid get logs response")
+	}
+	status := LogStatus{
+		UnloggedBoots: binary.BigEndian.Uint16(rsp[0:]),
+		UnloggedAuths: binary.BigEndian.Uint16(rsp[2:]),
+	}
+	for b := rsp[5:]; len(b) > 0; b = b[logEntrySize:] {
+		status.Entries = append(status.Entries, parseLogEntry(b))
+	}
+	return &status, nil
+}
+
+// Tells the device that all entries up to and including the given
+// index have been read, and can be removed from the log.
+func (d *Device) SetLogIndex(index uint16) error {
+	_, err := d.sendRaw(commands.CommandTypeSetLogIndex, binary.BigEndian.AppendUint16(nil, index))
+	return err
+}
+
+// Formats an entry as a line of space separated key=value pairs, with
+// numbers in decimal and digest in hex.
+func (e *LogEntry) String() string {
+	return fmt.Sprintf("number=%d command=%d length=%d session-key=%d target-key=%d second-key=%d result=%d systick=%d digest=%x",
+		e.Number, e.Command, e.Length, e.SessionKey, e.TargetKey, e.SecondKey, e.Result, e.Systick, e.Digest)
+}
+
+// Parses an entry, in the format produced by the String method.
+func ParseLogEntry(line string) (LogEntry, error) {
+	values := make(map[string]string)
+	for _, field := range strings.Fields(line) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return LogEntry{}, fmt.Errorf("invalid log line, field %q missing '='", field)
+		}
+		values[key] = value
+	}
+	var err error
+	parse := func(key string, bitSize int) uint64 {
+		n, parseErr := strconv.ParseUint(values[key], 10, bitSize)
+		if parseErr != nil && err == nil {
+			err = fmt.Errorf("invalid log line, bad %s: %v", key, parseErr)
+		}
+		return n
+	}
+	e := LogEntry{
+		Number:     uint16(parse("number", 16)),
+		Command:    uint8(parse("command", 8)),
+		Length:     uint16(parse("length", 16)),
+		SessionKey: uint16(parse("session-key", 16)),
+		TargetKey:  uint16(parse("target-key", 16)),
+		SecondKey:  uint16(parse("second-key", 16)),
+		Result:     uint8(parse("result", 8)),
+		Systick:    uint32(parse("systick", 32)),
+	}
+	if err != nil {
+		return LogEntry{}, err
+	}
+	digest, err := hex.DecodeString(values["digest"])
+	if err != nil || len(digest) != logDigestSize {
+		return LogEntry{}, fmt.Errorf("invalid log line, bad digest")
+	}
+	copy(e.Digest[:], digest)
+	return e, nil
+}
+
+// Creates a new entry following prev, with digest.
+func NewLogEntry(prev *LogEntry, e LogEntry) LogEntry {
+	e.Number = prev.Number + 1
+	e.Digest = e.computeDigest(prev)
+	return e
+}
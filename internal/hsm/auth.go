@@ -0,0 +1,159 @@
+package hsm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/certusone/yubihsm-go/securechannel"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Credentials for authenticating a session with the device.
+type Credentials struct {
+	AuthKeyId uint16
+	Key       authkey.AuthKey
+}
+
+// Derives the authentication key from a passphrase, as
+// authkey.NewFromPassword does, but without copying the passphrase to
+// a string, so that the caller can clear it after use.
+func DeriveAuthKey(passphrase []byte) authkey.AuthKey {
+	return pbkdf2.Key(passphrase, []byte("Yubico"), 10000, 2*securechannel.KeyLength, sha256.New)
+}
+
+// Parses credentials, consisting of a single line with the
+// authorization id (decimal number), and the corresponding secret,
+// separated by a single ':' character. The secret is either a
+// passphrase, or, if derived is true, the 32-byte key derived from
+// the passphrase (encryption key followed by mac key), hex encoded.
+func ParseCredentials(data []byte, derived bool) (*Credentials, error) {
+	data = bytes.TrimSpace(data)
+	colon := bytes.Index(data, []byte{':'})
+	if colon < 0 {
+		return nil, fmt.Errorf("missing ':'")
+	}
+	authId, err := strconv.ParseUint(string(data[:colon]), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth id: %v", err)
+	}
+	secret := data[colon+1:]
+	if !derived {
+		return &Credentials{AuthKeyId: uint16(authId), Key: DeriveAuthKey(secret)}, nil
+	}
+	key := make([]byte, hex.DecodedLen(len(secret)))
+	if _, err := hex.Decode(key, secret); err != nil || len(key) != 2*securechannel.KeyLength {
+		return nil, fmt.Errorf("invalid derived key, expected %d hex digits", 4*securechannel.KeyLength)
+	}
+	return &Credentials{AuthKeyId: uint16(authId), Key: authkey.AuthKey(key)}, nil
+}
+
+// Where to read credentials from. Exactly one of the sources must be
+// specified.
+type CredentialSource struct {
+	// Name of a plain file.
+	File string
+	// Name of a systemd credential, read from the directory
+	// $CREDENTIALS_DIRECTORY. This works also with encrypted
+	// credentials (LoadCredentialEncrypted), which are decrypted
+	// by systemd.
+	SystemdCredential string
+	// Description of a key of type "user" in the kernel keyring.
+	Keyring string
+	// Name of a file encrypted with age, and the file with the
+	// identity (private key) needed to decrypt it.
+	AgeFile     string
+	AgeIdentity string
+	// Whether or not the secret is a derived key rather than a
+	// passphrase, see ParseCredentials.
+	Derived bool
+}
+
+func (s *CredentialSource) IsSet() bool {
+	return len(s.File) > 0 || len(s.SystemdCredential) > 0 || len(s.Keyring) > 0 || len(s.AgeFile) > 0
+}
+
+func (s *CredentialSource) Read() (*Credentials, error) {
+	var data []byte
+	var what string
+	var err error
+	n := 0
+	if len(s.File) > 0 {
+		n++
+		what = fmt.Sprintf("auth file %q", s.File)
+		data, err = os.ReadFile(s.File)
+	}
+	if len(s.SystemdCredential) > 0 {
+		n++
+		what = fmt.Sprintf("systemd credential %q", s.SystemdCredential)
+		data, err = readSystemdCredential(s.SystemdCredential)
+	}
+	if len(s.Keyring) > 0 {
+		n++
+		what = fmt.Sprintf("keyring key %q", s.Keyring)
+		data, err = readKeyring(s.Keyring)
+	}
+	if len(s.AgeFile) > 0 {
+		n++
+		what = fmt.Sprintf("age encrypted file %q", s.AgeFile)
+		data, err = readAgeFile(s.AgeFile, s.AgeIdentity)
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("exactly one credential source must be specified")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %v", what, err)
+	}
+	defer clear(data)
+	c, err := ParseCredentials(data, s.Derived)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", what, err)
+	}
+	return c, nil
+}
+
+func readSystemdCredential(name string) ([]byte, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("CREDENTIALS_DIRECTORY not set")
+	}
+	if strings.ContainsRune(name, '/') {
+		return nil, fmt.Errorf("invalid credential name")
+	}
+	return os.ReadFile(filepath.Join(dir, name))
+}
+
+func readAgeFile(name, identityFile string) ([]byte, error) {
+	if len(identityFile) == 0 {
+		return nil, fmt.Errorf("no age identity file specified")
+	}
+	f, err := os.Open(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity file %q: %v", identityFile, err)
+	}
+	encrypted, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer encrypted.Close()
+	r, err := age.Decrypt(encrypted, identities...)
+	if err != nil {
+		return nil, err
+	}
+	// A credentials line is short, limit the size in case the
+	// file is something else.
+	return io.ReadAll(io.LimitReader(r, 4096))
+}
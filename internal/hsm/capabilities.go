@@ -0,0 +1,164 @@
+package hsm
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/certusone/yubihsm-go/commands"
+)
+
+// Capability names, as used by yubihsm-shell.
+var capabilityNames = map[string]uint64{
+	"change-authentication-key":    commands.CapabilityChangeAuthenticationKey,
+	"create-otp-aead":              commands.CapabilityOtpAeadCreate,
+	"decrypt-oaep":                 commands.CapabilityAsymmetricDecryptOaep,
+	"decrypt-otp":                  commands.CapabilityOtpDecrypt,
+	"decrypt-pkcs":                 commands.CapabilityAsymmetricDecryptPkcs,
+	"delete-asymmetric-key":        commands.CapabilityDeleteAsymmetric,
+	"delete-authentication-key":    commands.CapabilityDeleteAuthKey,
+	"delete-hmac-key":              commands.CapabilityDeleteHmacKey,
+	"delete-opaque":                commands.CapabilityDeleteOpaque,
+	"delete-otp-aead-key":          commands.CapabilityDeleteOtpAeadKey,
+	"delete-template":              commands.CapabilityDeleteTemplate,
+	"delete-wrap-key":              commands.CapabilityDeleteWrapKey,
+	"derive-ecdh":                  commands.CapabilityAsymmetricDeriveEcdh,
+	"export-wrapped":               commands.CapabilityExportWrapped,
+	"exportable-under-wrap":        commands.CapabilityExportableUnderWrap,
+	"generate-asymmetric-key":      commands.CapabilityAsymmetricGen,
+	"generate-hmac-key":            commands.CapabilityHmacKeyGenerate,
+	"generate-otp-aead-key":        commands.CapabilityGenerateOtpAeadKey,
+	"generate-wrap-key":            commands.CapabilityGenerateWrapKey,
+	"get-log-entries":              commands.CapabilityAudit,
+	"get-opaque":                   commands.CapabilityGetOpaque,
+	"get-option":                   commands.CapabilityGetOption,
+	"get-pseudo-random":            commands.CapabilityGetRandomness,
+	"get-template":                 commands.CapabilityGetTemplate,
+	"import-wrapped":               commands.CapabilityImportWrapped,
+	"put-asymmetric-key":           commands.CapabilityPutAsymmetric,
+	"put-authentication-key":       commands.CapabilityPutAuthenticationKey,
+	"put-mac-key":                  commands.CapabilityPutHmacKey,
+	"put-opaque":                   commands.CapabilityPutOpaque,
+	"put-option":                   commands.CapabilityPutOption,
+	"put-otp-aead-key":             commands.CapabilityPutOtpAeadKey,
+	"put-template":                 commands.CapabilityPutTemplate,
+	"put-wrap-key":                 commands.CapabilityPutWrapKey,
+	"randomize-otp-aead":           commands.CapabilityOtpAeadRandom,
+	"reset-device":                 commands.CapabilityReset,
+	"rewrap-from-otp-aead-key":     commands.CapabilityOtpAeadRewrapFrom,
+	"rewrap-to-otp-aead-key":       commands.CapabilityOtpAeadRewrapTo,
+	"sign-attestation-certificate": commands.CapabilityAttest,
+	"sign-ecdsa":                   commands.CapabilityAsymmetricSignEcdsa,
+	"sign-eddsa":                   commands.CapabilityAsymmetricSignEddsa,
+	"sign-hmac":                    commands.CapabilityHmacData,
+	"sign-pkcs":                    commands.CapabilityAsymmetricSignPkcs,
+	"sign-pss":                     commands.CapabilityAsymmetricSignPss,
+	"sign-ssh-certificate":         commands.CapabilitySshCertify,
+	"unwrap-data":                  commands.CapabilityUnwrapData,
+	"verify-hmac":                  commands.CapabilityHmacVerify,
+	"wrap-data":                    commands.CapabilityWrapData,
+}
+
+// All capabilities defined by the device.
+const AllCapabilities = 0x00007fffffffffff
+
+// Parses a comma separated list of capability names, or the special
+// values "all" and "none".
+func ParseCapabilities(s string) (uint64, error) {
+	switch s {
+	case "all":
+		return AllCapabilities, nil
+	case "none":
+		return 0, nil
+	}
+	var capabilities uint64
+	for _, name := range strings.Split(s, ",") {
+		c, ok := capabilityNames[strings.TrimSpace(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown capability %q", name)
+		}
+		capabilities |= c
+	}
+	return capabilities, nil
+}
+
+// Formats capabilities as a sorted, comma separated, list of names.
+func FormatCapabilities(capabilities uint64) string {
+	if capabilities == 0 {
+		return "none"
+	}
+	var names []string
+	for name, c := range capabilityNames {
+		if capabilities&c != 0 {
+			names = append(names, name)
+			capabilities &^= c
+		}
+	}
+	for capabilities != 0 {
+		c := uint64(1) << bits.TrailingZeros64(capabilities)
+		names = append(names, fmt.Sprintf("0x%x", c))
+		capabilities &^= c
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Parses a comma separated list of domain numbers, 1-16, or the
+// special value "all".
+func ParseDomains(s string) (uint16, error) {
+	if s == "all" {
+		return 0xffff, nil
+	}
+	var domains uint16
+	for _, d := range strings.Split(s, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(d), 10, 8)
+		if err != nil || n < 1 || n > 16 {
+			return 0, fmt.Errorf("invalid domain %q, must be between 1 and 16", d)
+		}
+		domains |= 1 << (n - 1)
+	}
+	return domains, nil
+}
+
+// Formats domains as a comma separated list of domain numbers.
+func FormatDomains(domains uint16) string {
+	if domains == 0xffff {
+		return "all"
+	}
+	var list []string
+	for i := 0; i < 16; i++ {
+		if domains&(1<<i) != 0 {
+			list = append(list, strconv.Itoa(i+1))
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// Object type names, as used by yubihsm-shell.
+var objectTypeNames = map[uint8]string{
+	commands.ObjectTypeOpaque:            "opaque",
+	commands.ObjectTypeAuthenticationKey: "authentication-key",
+	commands.ObjectTypeAsymmetricKey:     "asymmetric-key",
+	commands.ObjectTypeWrapKey:           "wrap-key",
+	commands.ObjectTypeHmacKey:           "hmac-key",
+	commands.ObjectTypeTemplate:          "template",
+	commands.ObjectTypeOtpAeadKey:        "otp-aead-key",
+}
+
+func FormatObjectType(t uint8) string {
+	if name, ok := objectTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", t)
+}
+
+func ParseObjectType(s string) (uint8, error) {
+	for t, name := range objectTypeNames {
+		if name == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown object type %q", s)
+}
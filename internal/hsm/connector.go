@@ -0,0 +1,192 @@
+package hsm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/certusone/yubihsm-go/connector"
+)
+
+// Connectors for the different ways to reach the device. The plain
+// http connector is the one from the yubihsm-go library; the
+// variants here use a unix socket, where access is controlled by
+// filesystem permissions, or https with a pinned server certificate.
+
+const (
+	unixURLPrefix  = "unix:"
+	httpsURLPrefix = "https://"
+	httpURLPrefix  = "http://"
+)
+
+// Like the yubihsm-go HTTPConnector, but with a custom http client.
+type httpConnector struct {
+	client *http.Client
+	// Base url, without trailing slash.
+	url string
+}
+
+func (c *httpConnector) Request(command *commands.CommandMessage) ([]byte, error) {
+	msg, err := command.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := c.client.Post(c.url+"/connector/api", "application/octet-stream", bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned non OK status code %d", rsp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(rsp.Body, maxMessageSize))
+}
+
+func (c *httpConnector) GetStatus() (*connector.StatusResponse, error) {
+	rsp, err := c.client.Get(c.url + "/connector/status")
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned non OK status code %d", rsp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, 4096))
+	if err != nil {
+		return nil, err
+	}
+	var status connector.StatusResponse
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "status":
+			status.Status = connector.Status(value)
+		case "serial":
+			status.Serial = value
+		case "version":
+			status.Version = value
+		case "pid":
+			status.Pid = value
+		case "address":
+			status.Address = value
+		case "port":
+			status.Port = value
+		}
+	}
+	return &status, nil
+}
+
+func (c *httpConnector) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// Parses a certificate fingerprint, the SHA-256 hash of the DER
+// encoded certificate, in hex, optionally with ':' separators as
+// output by "openssl x509 -fingerprint -sha256".
+func parseCertificatePin(pin string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("invalid certificate fingerprint %q, expected %d hex digits", pin, 2*sha256.Size)
+	}
+	return fingerprint, nil
+}
+
+// Returns a tls configuration that accepts only the server
+// certificate with the given fingerprint. Since the certificate is
+// pinned, the usual validation of the certificate chain and name is
+// not used.
+func pinnedTLSConfig(fingerprint []byte) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no server certificate")
+			}
+			hash := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(hash[:], fingerprint) != 1 {
+				return fmt.Errorf("server certificate fingerprint %x doesn't match the pinned fingerprint", hash)
+			}
+			return nil
+		},
+	}
+}
+
+// Opens a connector, given a connector url, one of
+//
+//	yhusb:// or yhusb://serial=NUMBER, for direct usb access, see
+//	    OpenUSBConnector.
+//	unix:PATH, for a connector listening on a unix socket.
+//	https://HOST:PORT, for a connector using tls. The
+//	    certificatePin, the SHA-256 fingerprint of the connector's
+//	    certificate, is required.
+//	HOST:PORT (or http://HOST:PORT), for a connector using plain
+//	    http.
+//
+// The returned connector should be closed after use, with
+// CloseConnector.
+func OpenConnector(url, certificatePin string) (connector.Connector, error) {
+	isHTTPS := strings.HasPrefix(url, httpsURLPrefix)
+	if len(certificatePin) > 0 && !isHTTPS {
+		return nil, fmt.Errorf("a certificate fingerprint can be used only with an https connector url")
+	}
+	switch {
+	case strings.HasPrefix(url, usbURLPrefix):
+		serial, err := parseUSBURL(url)
+		if err != nil {
+			return nil, err
+		}
+		c, err := OpenUSBConnector(serial)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case strings.HasPrefix(url, unixURLPrefix):
+		path := strings.TrimPrefix(url, unixURLPrefix)
+		if len(path) == 0 {
+			return nil, fmt.Errorf("invalid connector url %q, missing socket name", url)
+		}
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		// The host name is ignored.
+		return &httpConnector{client: &http.Client{Transport: transport}, url: "http://localhost"}, nil
+	case isHTTPS:
+		if len(certificatePin) == 0 {
+			return nil, fmt.Errorf("an https connector url requires a certificate fingerprint")
+		}
+		fingerprint, err := parseCertificatePin(certificatePin)
+		if err != nil {
+			return nil, err
+		}
+		transport := &http.Transport{TLSClientConfig: pinnedTLSConfig(fingerprint)}
+		return &httpConnector{
+			client: &http.Client{Transport: transport},
+			url:    strings.TrimSuffix(url, "/"),
+		}, nil
+	}
+	return connector.NewHTTPConnector(strings.TrimPrefix(url, httpURLPrefix)), nil
+}
+
+// Releases any resources, e.g., the usb device, held by the
+// connector.
+func CloseConnector(conn connector.Connector) error {
+	if c, ok := conn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/certusone/yubihsm-go/connector"
+	"github.com/certusone/yubihsm-go/securechannel"
+)
+
+const (
+	// The device closes sessions after 30 seconds of
+	// inactivity. Don't reuse sessions idle for longer than this.
+	maxSessionIdle = 20 * time.Second
+	// Max number of sessions supported by the YubiHSM 2.
+	MaxSessions = 16
+)
+
+type pooledSession struct {
+	channel  *securechannel.SecureChannel
+	lastUsed time.Time
+}
+
+// A Device represents a connection to a YubiHSM, using a pool of
+// authenticated sessions, each a yubihsm-go SecureChannel. At most
+// the configured number of commands are processed concurrently,
+// other requests wait in line for a session to become available. It
+// is safe for concurrent use.
+type Device struct {
+	conn      connector.Connector
+	authKeyId uint16
+	// Max time to wait for a session, zero means no limit.
+	queueTimeout time.Duration
+
+	// Held for reading while authenticating new sessions, and for
+	// writing while the key is replaced, see ChangeAuthKey.
+	authMu  sync.RWMutex
+	authKey authkey.AuthKey
+
+	// Semaphore, with one element per allowed session.
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*pooledSession
+	closed bool
+}
+
+// Opens a device, and creates an initial session to check that
+// authentication works. The number of sessions must be between 1 and
+// MaxSessions. The device takes ownership of the connector, and
+// closes it, see CloseConnector, when the device is closed, or if
+// opening fails.
+func OpenDevice(conn connector.Connector, authKeyId uint16, authKey authkey.AuthKey, sessions int, queueTimeout time.Duration) (*Device, error) {
+	if sessions < 1 || sessions > MaxSessions {
+		CloseConnector(conn)
+		return nil, fmt.Errorf("invalid number of sessions %d, must be between 1 and %d", sessions, MaxSessions)
+	}
+	d := Device{
+		conn:         conn,
+		authKeyId:    authKeyId,
+		authKey:      authKey,
+		queueTimeout: queueTimeout,
+		slots:        make(chan struct{}, sessions),
+	}
+	s, err := d.openSession()
+	if err != nil {
+		CloseConnector(conn)
+		return nil, err
+	}
+	d.idle = append(d.idle, s)
+	return &d, nil
+}
+
+func (d *Device) openSession() (*pooledSession, error) {
+	d.authMu.RLock()
+	defer d.authMu.RUnlock()
+	return d.openSessionWithKey(d.authKey)
+}
+
+func (d *Device) openSessionWithKey(key authkey.AuthKey) (*pooledSession, error) {
+	// The password is unused, since the key is set explicitly.
+	channel, err := securechannel.NewSecureChannel(d.conn, d.authKeyId, "")
+	if err != nil {
+		return nil, err
+	}
+	channel.AuthKey = key
+	if err := channel.Authenticate(); err != nil {
+		return nil, fmt.Errorf("creating session failed: %w", deviceError(err))
+	}
+	return &pooledSession{channel: channel, lastUsed: time.Now()}, nil
+}
+
+func (d *Device) acquire() error {
+	if d.queueTimeout == 0 {
+		d.slots <- struct{}{}
+		return nil
+	}
+	timer := time.NewTimer(d.queueTimeout)
+	defer timer.Stop()
+	select {
+	case d.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("timeout waiting for an hsm session")
+	}
+}
+
+func (d *Device) release() {
+	<-d.slots
+}
+
+// Returns an idle session that is still usable, if any. Stale
+// sessions are discarded.
+func (d *Device) takeIdle() *pooledSession {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.idle) > 0 {
+		s := d.idle[len(d.idle)-1]
+		d.idle = d.idle[:len(d.idle)-1]
+		if time.Since(s.lastUsed) < maxSessionIdle && s.channel.Counter < securechannel.MaxMessagesPerSession-1 {
+			return s
+		}
+		// Don't wait for the device to respond.
+		go s.channel.Close()
+	}
+	return nil
+}
+
+func (d *Device) putIdle(s *pooledSession) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		s.channel.Close()
+		return
+	}
+	d.idle = append(d.idle, s)
+}
+
+// Converts errors from the yubihsm-go library: error responses from
+// the device are returned as *DeviceError, and a failed check of the
+// device's cryptogram as ErrAuthFailed.
+func deviceError(err error) error {
+	var cmdErr *commands.Error
+	if errors.As(err, &cmdErr) {
+		return &DeviceError{Code: cmdErr.Code}
+	}
+	if errors.Is(err, securechannel.ErrAuthCryptogram) {
+		return fmt.Errorf("%w, invalid card cryptogram", ErrAuthFailed)
+	}
+	return err
+}
+
+// Errors that indicate that the session is no longer usable.
+func isSessionError(err error) bool {
+	var hsmErr *DeviceError
+	if !errors.As(err, &hsmErr) {
+		// E.g., transport errors or invalid mac.
+		return true
+	}
+	return hsmErr.Code == commands.ErrorCodeInvalidSession ||
+		hsmErr.Code == commands.ErrorCodeSessionFailed
+}
+
+// Commands that don't modify the device, and that can be sent again
+// if it's unknown whether the device received them.
+var readOnlyCommands = map[commands.CommandType]bool{
+	commands.CommandTypeEcho:            true,
+	commands.CommandTypeDeviceInfo:      true,
+	commands.CommandTypeListObjects:     true,
+	commands.CommandTypeGetObjectInfo:   true,
+	commands.CommandTypeGetPubKey:       true,
+	commands.CommandTypeGetPseudoRandom: true,
+	commands.CommandTypeSignDataEddsa:   true,
+}
+
+// Sends a command, using an available session, and returns the
+// parsed response.
+func (d *Device) SendEncryptedCommand(c *commands.CommandMessage) (commands.Response, error) {
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	defer d.release()
+	return d.send(c, d.openSession)
+}
+
+// Like SendEncryptedCommand, but the caller must hold a session slot,
+// and new sessions are opened using openSession.
+func (d *Device) send(c *commands.CommandMessage, openSession func() (*pooledSession, error)) (commands.Response, error) {
+	s := d.takeIdle()
+	reused := s != nil
+	if !reused {
+		var err error
+		s, err = openSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+	rsp, err := s.channel.SendEncryptedCommand(c)
+	err = deviceError(err)
+	if err != nil && reused && isSessionError(err) && readOnlyCommands[c.CommandType] {
+		// The session may have been closed by the device,
+		// retry once with a new session. Other commands are
+		// not retried, since the device may have carried out
+		// the command before the failure.
+		log.Printf("hsm session failed: %v, retrying with new session", err)
+		s, err = openSession()
+		if err != nil {
+			return nil, err
+		}
+		rsp, err = s.channel.SendEncryptedCommand(c)
+		err = deviceError(err)
+	}
+	if err != nil {
+		if !isSessionError(err) {
+			s.lastUsed = time.Now()
+			d.putIdle(s)
+		}
+		return nil, err
+	}
+	s.lastUsed = time.Now()
+	d.putIdle(s)
+	return rsp, nil
+}
+
+// Close closes all idle sessions, and the connector. Commands in
+// progress may fail.
+func (d *Device) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	d.closed = true
+	for _, s := range d.idle {
+		s.channel.Close()
+	}
+	d.idle = nil
+	CloseConnector(d.conn)
+}
+
+// Sends a command whose response the yubihsm-go library can't parse,
+// and returns the response payload. The command is sent on a new
+// session, see secureChannel, which is closed afterwards, except
+// after a reset.
+func (d *Device) sendRaw(t commands.CommandType, data []byte) ([]byte, error) {
+	if err := d.acquire(); err != nil {
+		return nil, err
+	}
+	defer d.release()
+	d.authMu.RLock()
+	s, err := openSecureChannel(d.conn, d.authKeyId, d.authKey)
+	d.authMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := s.send(t, data)
+	if t != commands.CommandTypeReset {
+		s.close()
+	}
+	return rsp, err
+}
@@ -0,0 +1,214 @@
+package hsm_test
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/certusone/yubihsm-go/commands"
+
+	"sigsum.org/key-mgmt/internal/hsm"
+	"sigsum.org/key-mgmt/internal/hsmsim"
+)
+
+// Replaces the authentication key while other goroutines sign, and
+// need new sessions. Run with -race.
+func TestChangeAuthKeyWhileSigning(t *testing.T) {
+	const (
+		keyId    = 2
+		sessions = 4
+		signers  = 8
+		changes  = 10
+	)
+	sim := hsmsim.NewSimulator(1000000)
+	pub, err := sim.AddEd25519Key(keyId, "test", 1, commands.CapabilityAsymmetricSignEddsa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := hsm.OpenDevice(sim, hsm.DefaultAuthKeyId, authkey.NewFromPassword(hsm.DefaultAuthKeyPassword), sessions, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	signer, err := hsm.NewYubiHSMSigner(device, keyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, signers)
+	for i := 0; i < signers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := []byte(fmt.Sprintf("message %d", i))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				sig, err := signer.Sign(nil, msg, crypto.Hash(0))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !ed25519.Verify(pub, msg, sig) {
+					errs <- fmt.Errorf("invalid signature")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < changes; i++ {
+		if err := device.ChangeAuthKey(authkey.NewFromPassword(fmt.Sprintf("password %d", i))); err != nil {
+			t.Errorf("changing auth key failed: %v", err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("signing failed: %v", err)
+	}
+}
+
+// Simulator connector that loses the response to the next session
+// message, after the simulator has processed it.
+type lossyConnector struct {
+	*hsmsim.Simulator
+	mu   sync.Mutex
+	drop bool
+}
+
+func (c *lossyConnector) dropNext() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drop = true
+}
+
+func (c *lossyConnector) Request(m *commands.CommandMessage) ([]byte, error) {
+	rsp, err := c.Simulator.Request(m)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.drop && m.CommandType == commands.CommandTypeSessionMessage {
+		c.drop = false
+		return nil, errors.New("response lost")
+	}
+	return rsp, err
+}
+
+// Checks that only read-only commands are sent again when a reused
+// session fails.
+func TestRetryReadOnly(t *testing.T) {
+	const keyId = 2
+	sim := hsmsim.NewSimulator(1000000)
+	pub, err := sim.AddEd25519Key(keyId, "test", 1, commands.CapabilityAsymmetricSignEddsa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &lossyConnector{Simulator: sim}
+	device, err := hsm.OpenDevice(conn, hsm.DefaultAuthKeyId, authkey.NewFromPassword(hsm.DefaultAuthKeyPassword), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	// Leaves an idle session in the pool.
+	if _, err := device.DeviceInfo(); err != nil {
+		t.Fatal(err)
+	}
+	conn.dropNext()
+	got, err := device.GetPublicKey(keyId)
+	if err != nil {
+		t.Fatalf("get public key not retried: %v", err)
+	}
+	if !got.Equal(pub) {
+		t.Errorf("unexpected public key")
+	}
+
+	conn.dropNext()
+	err = device.DeleteObject(keyId, commands.ObjectTypeAsymmetricKey)
+	if err == nil {
+		t.Fatalf("delete object with lost response succeeded")
+	}
+	// The device carried out the command, so sending it again
+	// fails with object not found.
+	if errors.Is(err, hsm.ErrObjectNotFound) {
+		t.Errorf("delete object was sent again")
+	}
+	if _, err := device.ObjectInfo(keyId, commands.ObjectTypeAsymmetricKey); !errors.Is(err, hsm.ErrObjectNotFound) {
+		t.Errorf("unexpected object info error after delete: %v", err)
+	}
+}
+
+// Checks that a replaced wrap key keeps its id and attributes, that
+// the temporary key is deleted, and that objects wrapped under the
+// old key are rejected.
+func TestReplaceWrapKey(t *testing.T) {
+	const (
+		keyId     = 2
+		wrapKeyId = 400
+	)
+	sim := hsmsim.NewSimulator(1000000)
+	if _, err := sim.AddEd25519Key(keyId, "test", 1,
+		commands.CapabilityAsymmetricSignEddsa|commands.CapabilityExportableUnderWrap); err != nil {
+		t.Fatal(err)
+	}
+	device, err := hsm.OpenDevice(sim, hsm.DefaultAuthKeyId, authkey.NewFromPassword(hsm.DefaultAuthKeyPassword), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	attributes := &hsm.ObjectAttributes{
+		Id:           wrapKeyId,
+		Label:        "wrap key",
+		Domains:      1,
+		Capabilities: commands.CapabilityExportWrapped | commands.CapabilityImportWrapped,
+		Delegated:    commands.CapabilityAsymmetricSignEddsa | commands.CapabilityExportableUnderWrap,
+	}
+	if _, err := device.PutWrapKey(attributes, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	oldWrapped, err := device.ExportWrapped(wrapKeyId, commands.ObjectTypeAsymmetricKey, keyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := device.ReplaceWrapKey(wrapKeyId, make([]byte, 32)); err == nil {
+		t.Errorf("wrap key of a different size accepted")
+	}
+	if err := device.ReplaceWrapKey(wrapKeyId, []byte("0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := device.ListObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrapKeys []*hsm.ObjectInfo
+	for _, o := range objects {
+		if o.Type == commands.ObjectTypeWrapKey {
+			wrapKeys = append(wrapKeys, o)
+		}
+	}
+	if len(wrapKeys) != 1 {
+		t.Fatalf("got %d wrap keys, expected 1", len(wrapKeys))
+	}
+	if got := wrapKeys[0].Attributes(); *got != *attributes {
+		t.Errorf("unexpected attributes %+v, expected %+v", got, attributes)
+	}
+	// The key exists, so if the old wrap key were still valid, the
+	// import would fail with ErrObjectExists.
+	if _, _, err := device.ImportWrapped(wrapKeyId, oldWrapped); err == nil || errors.Is(err, hsm.ErrObjectExists) {
+		t.Errorf("object wrapped under the old key accepted: %v", err)
+	}
+	if _, err := device.ExportWrapped(wrapKeyId, commands.ObjectTypeAsymmetricKey, keyId); err != nil {
+		t.Errorf("export under the new key failed: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package hsm
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/certusone/yubihsm-go/commands"
+)
+
+// Errors for common failures reported by the device, to check for
+// with errors.Is.
+var (
+	ErrAuthFailed     = errors.New("authentication failed")
+	ErrPermission     = errors.New("insufficient permissions")
+	ErrObjectNotFound = errors.New("object not found")
+	ErrObjectExists   = errors.New("object already exists")
+)
+
+var deviceErrors = map[commands.ErrorCode]error{
+	commands.ErrorCodeAuthFail:          ErrAuthFailed,
+	commands.ErrorCodeInvalidPermission: ErrPermission,
+	commands.ErrorCodeObjectNotFound:    ErrObjectNotFound,
+	commands.ErrorCodeObjectExists:      ErrObjectExists,
+}
+
+// An error response from the device. Unwraps to the corresponding
+// *commands.Error, and matches the errors above.
+type DeviceError struct {
+	Code commands.ErrorCode
+}
+
+func (e *DeviceError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e *DeviceError) Unwrap() error {
+	return &commands.Error{Code: e.Code}
+}
+
+func (e *DeviceError) Is(target error) bool {
+	err, ok := deviceErrors[e.Code]
+	return ok && err == target
+}
+
+// Indicates that a key's public key isn't the expected one, e.g.,
+// after importing a wrapped key.
+type PublicKeyMismatchError struct {
+	KeyId    uint16
+	Expected ed25519.PublicKey
+	Got      ed25519.PublicKey
+}
+
+func (e *PublicKeyMismatchError) Error() string {
+	return fmt.Sprintf("public key of key %d is %x, expected %x", e.KeyId, e.Got, e.Expected)
+}
@@ -0,0 +1,69 @@
+package hsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/certusone/yubihsm-go/commands"
+)
+
+// Capabilities of signing keys, unless other capabilities are
+// explicitly expected: sign-eddsa only, in particular, the key must
+// not be exportable under wrap.
+const DefaultKeyCapabilities = commands.CapabilityAsymmetricSignEddsa
+
+// Expected properties of the device and the signing key. Zero values
+// mean that the property isn't checked, except for Capabilities,
+// where zero means DefaultKeyCapabilities.
+type Expected struct {
+	Serial       uint32
+	Label        string
+	Domains      uint16
+	Capabilities uint64
+}
+
+// Checks that the device and the signing key have the expected
+// properties, that the key is an Ed25519 key, and that the public key
+// is unchanged since the signer was created. If there are several
+// mismatches, all are reported.
+func (hsm *YubiHSMSigner) Check(expected *Expected) error {
+	var errs []error
+	info, err := hsm.device.DeviceInfo()
+	if err != nil {
+		return fmt.Errorf("device info failed: %v", err)
+	}
+	if expected.Serial != 0 && info.SerialNumber != expected.Serial {
+		errs = append(errs, fmt.Errorf("unexpected device serial %d, expected %d",
+			info.SerialNumber, expected.Serial))
+	}
+	key, err := hsm.device.ObjectInfo(hsm.keyId, commands.ObjectTypeAsymmetricKey)
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("object info for key %d failed: %v", hsm.keyId, err))...)
+	}
+	if key.Algorithm != commands.AlgorithmED25519 {
+		errs = append(errs, fmt.Errorf("unexpected key algorithm %d", key.Algorithm))
+	}
+	if len(expected.Label) > 0 && key.Label != expected.Label {
+		errs = append(errs, fmt.Errorf("unexpected key label %q, expected %q", key.Label, expected.Label))
+	}
+	if expected.Domains != 0 && key.Domains != expected.Domains {
+		errs = append(errs, fmt.Errorf("unexpected key domains %s, expected %s",
+			FormatDomains(key.Domains), FormatDomains(expected.Domains)))
+	}
+	capabilities := expected.Capabilities
+	if capabilities == 0 {
+		capabilities = DefaultKeyCapabilities
+	}
+	if key.Capabilities != capabilities {
+		errs = append(errs, fmt.Errorf("unexpected key capabilities %s, expected %s",
+			FormatCapabilities(key.Capabilities), FormatCapabilities(capabilities)))
+	}
+	pub, err := getEd25519PublicKey(hsm.device, hsm.keyId)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("getting public key failed: %v", err))
+	} else if !bytes.Equal(pub, hsm.publicKey) {
+		errs = append(errs, fmt.Errorf("public key of key %d has changed", hsm.keyId))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,111 @@
+package hsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/certusone/yubihsm-go/connector"
+)
+
+// Attributes of an object stored on the device.
+type ObjectInfo struct {
+	Id           uint16
+	Type         uint8
+	Algorithm    commands.Algorithm
+	Label        string
+	Domains      uint16
+	Capabilities uint64
+	Delegated    uint64
+	Sequence     uint8
+	Origin       uint8
+}
+
+func (d *Device) DeviceInfo() (*commands.DeviceInfoResponse, error) {
+	command, err := commands.CreateDeviceInfoCommand()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.SendEncryptedCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	info, matched := resp.(*commands.DeviceInfoResponse)
+	if !matched {
+		return nil, fmt.Errorf("unexpected response type %T", resp)
+	}
+	return info, nil
+}
+
+// Reads the serial number of the device, without a session, using
+// the device info command, which the device accepts unauthenticated.
+func ReadSerial(conn connector.Connector) (uint32, error) {
+	rsp, err := sendCommand(conn, commands.CommandTypeDeviceInfo)
+	if err != nil {
+		return 0, err
+	}
+	if len(rsp) < 7 {
+		return 0, fmt.Errorf("invalid device info response")
+	}
+	return binary.BigEndian.Uint32(rsp[3:7]), nil
+}
+
+func (d *Device) ObjectInfo(id uint16, objectType uint8) (*ObjectInfo, error) {
+	command, err := commands.CreateGetObjectInfoCommand(id, objectType)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.SendEncryptedCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	info, matched := resp.(*commands.ObjectInfoResponse)
+	if !matched {
+		return nil, fmt.Errorf("unexpected response type %T", resp)
+	}
+	return &ObjectInfo{
+		Id:           info.ObjectID,
+		Type:         info.Type,
+		Algorithm:    info.Algorithm,
+		Label:        string(bytes.TrimRight(info.Label[:], "\x00")),
+		Domains:      info.Domains,
+		Capabilities: info.Capabilities,
+		Delegated:    info.DelegatedCapabilites,
+		Sequence:     info.Sequence,
+		Origin:       info.Origin,
+	}, nil
+}
+
+// Lists all objects accessible in the session, sorted by type and
+// id.
+func (d *Device) ListObjects() ([]*ObjectInfo, error) {
+	command, err := commands.CreateListObjectsCommand()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.SendEncryptedCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	list, matched := resp.(*commands.ListObjectsResponse)
+	if !matched {
+		return nil, fmt.Errorf("unexpected response type %T", resp)
+	}
+	var objects []*ObjectInfo
+	for _, o := range list.Objects {
+		info, err := d.ObjectInfo(o.ObjectID, o.ObjectType)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, info)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Type != objects[j].Type {
+			return objects[i].Type < objects[j].Type
+		}
+		return objects[i].Id < objects[j].Id
+	})
+	return objects, nil
+}
@@ -0,0 +1,32 @@
+package hsm
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reads the payload of a key of type "user" in the kernel keyring.
+// The key is looked up in the keyrings of the process (thread,
+// process and session keyrings), and then in the user keyring.
+func readKeyring(description string) ([]byte, error) {
+	id, err := unix.RequestKey("user", description, "", 0)
+	if errors.Is(err, unix.ENOKEY) {
+		id, err = unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", description, 0)
+	}
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.ENOENT) {
+		return nil, errors.New("key not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n > len(buf) {
+		return nil, errors.New("key payload too large")
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package hsm
+
+import (
+	"errors"
+)
+
+func readKeyring(description string) ([]byte, error) {
+	return nil, errors.New("kernel keyring is supported only on linux")
+}
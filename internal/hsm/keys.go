@@ -0,0 +1,193 @@
+package hsm
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/certusone/yubihsm-go/commands"
+)
+
+// Creating keys, and moving keys between devices under wrap.
+
+const (
+	// Size of the nonce at the start of a wrapped object, as
+	// returned by the device's export command.
+	wrapNonceSize = 13
+	wrapTagSize   = 16
+)
+
+// Attributes of an object to be created. An id of zero means that
+// the device selects a free id.
+type ObjectAttributes struct {
+	Id           uint16
+	Label        string
+	Domains      uint16
+	Capabilities uint64
+	// Delegated capabilities, applicable to authentication and
+	// wrap keys only.
+	Delegated uint64
+}
+
+func (a *ObjectAttributes) marshalLabel() ([]byte, error) {
+	if len(a.Label) > commands.LabelLength {
+		return nil, fmt.Errorf("label %q too long, max %d bytes", a.Label, commands.LabelLength)
+	}
+	label := make([]byte, commands.LabelLength)
+	copy(label, a.Label)
+	return label, nil
+}
+
+// Generates an Ed25519 key on the device, and returns its id.
+func (d *Device) GenerateEd25519Key(a *ObjectAttributes) (uint16, error) {
+	label, err := a.marshalLabel()
+	if err != nil {
+		return 0, err
+	}
+	data := binary.BigEndian.AppendUint16(nil, a.Id)
+	data = append(data, label...)
+	data = binary.BigEndian.AppendUint16(data, a.Domains)
+	data = binary.BigEndian.AppendUint64(data, a.Capabilities)
+	data = append(data, byte(commands.AlgorithmED25519))
+	// Parse the response here, since the yubihsm-go parser
+	// extracts the wrong bytes.
+	rsp, err := d.sendRaw(commands.CommandTypeGenerateAsymmetricKey, data)
+	if err != nil {
+		return 0, err
+	}
+	if len(rsp) != 2 {
+		return 0, fmt.Errorf("invalid generate key response")
+	}
+	return binary.BigEndian.Uint16(rsp), nil
+}
+
+var wrapKeyAlgorithms = map[int]commands.Algorithm{
+	16: commands.AlgorithmAES128CCMWrap,
+	24: commands.AlgorithmAES192CCMWrap,
+	32: commands.AlgorithmAES256CCMWrap,
+}
+
+// Returns the key size of a wrap key algorithm, or zero if not
+// supported.
+func WrapKeySize(algorithm commands.Algorithm) int {
+	for size, a := range wrapKeyAlgorithms {
+		if a == algorithm {
+			return size
+		}
+	}
+	return 0
+}
+
+// Imports an AES-CCM wrap key, of 16, 24 or 32 bytes, and returns its
+// id.
+func (d *Device) PutWrapKey(a *ObjectAttributes, key []byte) (uint16, error) {
+	algorithm, ok := wrapKeyAlgorithms[len(key)]
+	if !ok {
+		return 0, fmt.Errorf("invalid wrap key size %d", len(key))
+	}
+	label, err := a.marshalLabel()
+	if err != nil {
+		return 0, err
+	}
+	command, err := commands.CreatePutWrapkeyCommand(a.Id, label, a.Domains, a.Capabilities, algorithm, a.Delegated, key)
+	if err != nil {
+		return 0, err
+	}
+	rsp, err := d.SendEncryptedCommand(command)
+	if err != nil {
+		return 0, err
+	}
+	wrapKey, matched := rsp.(*commands.PutWrapkeyResponse)
+	if !matched {
+		return 0, fmt.Errorf("unexpected response type %T", rsp)
+	}
+	return wrapKey.ObjectID, nil
+}
+
+func (d *Device) DeleteObject(id uint16, objectType uint8) error {
+	command, err := commands.CreateDeleteObjectCommand(id, objectType)
+	if err != nil {
+		return err
+	}
+	_, err = d.SendEncryptedCommand(command)
+	return err
+}
+
+// Returns the public key of an Ed25519 key.
+func (d *Device) GetPublicKey(id uint16) (ed25519.PublicKey, error) {
+	return getEd25519PublicKey(d, id)
+}
+
+// Signs a message with an Ed25519 key.
+func (d *Device) SignEd25519(id uint16, msg []byte) ([]byte, error) {
+	return sign(d, id, msg)
+}
+
+// Exports an object encrypted under a wrap key. The returned wrapped
+// object is the nonce followed by the encrypted object, the same
+// format as used by yubihsm-shell (before base64 encoding).
+func (d *Device) ExportWrapped(wrapKeyId uint16, objectType uint8, id uint16) ([]byte, error) {
+	command, err := commands.CreateExportWrappedCommand(wrapKeyId, objectType, id)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := d.SendEncryptedCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	export, matched := rsp.(*commands.ExportWrappedResponse)
+	if !matched {
+		return nil, fmt.Errorf("unexpected response type %T", rsp)
+	}
+	if len(export.Data) <= wrapTagSize {
+		return nil, fmt.Errorf("invalid export wrapped response")
+	}
+	return append(export.Nonce, export.Data...), nil
+}
+
+// Imports a wrapped object, as returned by ExportWrapped. Returns the
+// type and id of the object.
+func (d *Device) ImportWrapped(wrapKeyId uint16, wrapped []byte) (uint8, uint16, error) {
+	if len(wrapped) <= wrapNonceSize+wrapTagSize {
+		return 0, 0, fmt.Errorf("invalid wrapped object, too short")
+	}
+	command, err := commands.CreateImportWrappedCommand(wrapKeyId, wrapped[:wrapNonceSize], wrapped[wrapNonceSize:])
+	if err != nil {
+		return 0, 0, err
+	}
+	rsp, err := d.SendEncryptedCommand(command)
+	if err != nil {
+		return 0, 0, err
+	}
+	imported, matched := rsp.(*commands.ImportWrappedResponse)
+	if !matched {
+		return 0, 0, fmt.Errorf("unexpected response type %T", rsp)
+	}
+	return imported.ObjectType, imported.ObjectID, nil
+}
+
+// Imports a wrapped Ed25519 key, and checks that the imported key
+// has the expected public key. If not, the imported key is deleted,
+// and a *PublicKeyMismatchError is returned. Returns the id of the
+// key.
+func (d *Device) ImportWrappedEd25519(wrapKeyId uint16, wrapped []byte, expected ed25519.PublicKey) (uint16, error) {
+	objectType, id, err := d.ImportWrapped(wrapKeyId, wrapped)
+	if err != nil {
+		return 0, err
+	}
+	if objectType != commands.ObjectTypeAsymmetricKey {
+		return 0, fmt.Errorf("imported object %d is of type %d, not an asymmetric key", id, objectType)
+	}
+	pub, err := d.GetPublicKey(id)
+	if err != nil {
+		return 0, err
+	}
+	if !pub.Equal(expected) {
+		err := &PublicKeyMismatchError{KeyId: id, Expected: expected, Got: pub}
+		if deleteErr := d.DeleteObject(id, objectType); deleteErr != nil {
+			return 0, fmt.Errorf("%v, and deleting the imported key failed: %v", err, deleteErr)
+		}
+		return 0, err
+	}
+	return id, nil
+}
@@ -0,0 +1,88 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/certusone/yubihsm-go/commands"
+)
+
+// Factory reset, and checking that a device is in factory state.
+
+const (
+	// The only object on a device in factory state.
+	DefaultAuthKeyId       = 1
+	DefaultAuthKeyPassword = "password"
+	DefaultAuthKeyLabel    = "DEFAULT AUTHKEY CHANGE THIS ASAP"
+
+	// Device options, see GetOption.
+	OptionForceAudit      = 0x01
+	OptionCommandAudit    = 0x03
+	OptionAlgorithmToggle = 0x04
+)
+
+// Returns the value of a device option.
+func (d *Device) GetOption(option uint8) ([]byte, error) {
+	return d.sendRaw(commands.CommandTypeGetOption, []byte{option})
+}
+
+// Resets the device to factory state, deleting all objects. The
+// device then restarts, so the Device can't be used for anything
+// but Close; a new one must be opened, using the default
+// authentication key.
+func (d *Device) Reset() error {
+	_, err := d.sendRaw(commands.CommandTypeReset, nil)
+	return err
+}
+
+// Checks that the device, opened with the default authentication
+// key, is in factory state: the default authentication key is the
+// only object, audit logging isn't forced, and the firmware supports
+// Ed25519. If there are several deviations, all are reported.
+func (d *Device) CheckFactoryState() error {
+	var errs []error
+	info, err := d.DeviceInfo()
+	if err != nil {
+		return fmt.Errorf("device info failed: %v", err)
+	}
+	if info.MajorVersion < 2 {
+		errs = append(errs, fmt.Errorf("unsupported firmware version %d.%d.%d",
+			info.MajorVersion, info.MinorVersion, info.BuildVersion))
+	}
+	if !slices.Contains(info.SupportedAlgorithms, commands.AlgorithmED25519) {
+		errs = append(errs, errors.New("the device doesn't support Ed25519"))
+	}
+	objects, err := d.ListObjects()
+	if err != nil {
+		return fmt.Errorf("listing objects failed: %v", err)
+	}
+	found := false
+	for _, o := range objects {
+		if o.Type == commands.ObjectTypeAuthenticationKey && o.Id == DefaultAuthKeyId {
+			found = true
+			if o.Label != DefaultAuthKeyLabel {
+				errs = append(errs, fmt.Errorf("the default authentication key has label %q", o.Label))
+			}
+			if o.Domains != 0xffff {
+				errs = append(errs, fmt.Errorf("the default authentication key has domains %s",
+					FormatDomains(o.Domains)))
+			}
+			continue
+		}
+		errs = append(errs, fmt.Errorf("unexpected object: %s %d %q", FormatObjectType(o.Type), o.Id, o.Label))
+	}
+	if !found {
+		errs = append(errs, errors.New("the default authentication key is missing"))
+	}
+	forceAudit, err := d.GetOption(OptionForceAudit)
+	switch {
+	case err != nil:
+		errs = append(errs, fmt.Errorf("getting the force-audit option failed: %v", err))
+	case len(forceAudit) != 1:
+		errs = append(errs, fmt.Errorf("invalid force-audit option %x", forceAudit))
+	case forceAudit[0] != 0:
+		errs = append(errs, fmt.Errorf("the force-audit option is set, value %d", forceAudit[0]))
+	}
+	return errors.Join(errs...)
+}
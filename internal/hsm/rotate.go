@@ -0,0 +1,141 @@
+package hsm
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/certusone/yubihsm-go/commands"
+)
+
+// Replacing authentication and wrap keys.
+
+// Returns the id of the authentication key used for the device's
+// sessions.
+func (d *Device) AuthKeyId() uint16 {
+	return d.authKeyId
+}
+
+// Returns random bytes generated by the device.
+func (d *Device) GetPseudoRandom(n int) ([]byte, error) {
+	if n < 1 || n > maxMessageSize {
+		return nil, fmt.Errorf("invalid number of random bytes %d", n)
+	}
+	rsp, err := d.SendEncryptedCommand(commands.CreateGetPseudoRandomCommand(uint16(n)))
+	if err != nil {
+		return nil, err
+	}
+	random, matched := rsp.([]byte)
+	if !matched {
+		return nil, fmt.Errorf("unexpected response type %T", rsp)
+	}
+	if len(random) != n {
+		return nil, fmt.Errorf("invalid get pseudo random response")
+	}
+	return random, nil
+}
+
+// Imports an authentication key, and returns its id.
+func (d *Device) PutAuthKey(a *ObjectAttributes, key authkey.AuthKey) (uint16, error) {
+	label, err := a.marshalLabel()
+	if err != nil {
+		return 0, err
+	}
+	command, err := commands.CreatePutAuthkeyCommand(a.Id, label, a.Domains, a.Capabilities, a.Delegated, key.GetEncKey(), key.GetMacKey())
+	if err != nil {
+		return 0, err
+	}
+	rsp, err := d.SendEncryptedCommand(command)
+	if err != nil {
+		return 0, err
+	}
+	put, matched := rsp.(*commands.PutAuthkeyResponse)
+	if !matched {
+		return 0, fmt.Errorf("unexpected response type %T", rsp)
+	}
+	return put.ObjectID, nil
+}
+
+// Replaces the secret of the authentication key used for the
+// device's sessions, which requires the change-authentication-key
+// capability. Sessions created later use the new key; existing
+// sessions are not affected. No new sessions are authenticated while
+// the key is being replaced.
+func (d *Device) ChangeAuthKey(key authkey.AuthKey) error {
+	// The yubihsm-go library has no constructor for this command.
+	data := binary.BigEndian.AppendUint16(nil, d.authKeyId)
+	data = append(data, byte(commands.AlgorithmYubicoAESAuthentication))
+	data = append(data, key.GetEncKey()...)
+	data = append(data, key.GetMacKey()...)
+	command := &commands.CommandMessage{
+		CommandType: commands.CommandTypeChangeAuthenticationKey,
+		Data:        data,
+	}
+
+	// Take the session slot first, since other requests may hold
+	// slots while waiting for authMu.
+	if err := d.acquire(); err != nil {
+		return err
+	}
+	defer d.release()
+	d.authMu.Lock()
+	defer d.authMu.Unlock()
+	rsp, err := d.send(command, func() (*pooledSession, error) {
+		return d.openSessionWithKey(d.authKey)
+	})
+	if err != nil {
+		return err
+	}
+	changed, matched := rsp.(*commands.ChangeAuthenticationKeyResponse)
+	if !matched {
+		return fmt.Errorf("unexpected response type %T", rsp)
+	}
+	if changed.ObjectID != d.authKeyId {
+		return fmt.Errorf("invalid change authentication key response")
+	}
+	d.authKey = key
+	return nil
+}
+
+// Returns the attributes needed to create an object like this one.
+func (info *ObjectInfo) Attributes() *ObjectAttributes {
+	return &ObjectAttributes{
+		Id:           info.Id,
+		Label:        info.Label,
+		Domains:      info.Domains,
+		Capabilities: info.Capabilities,
+		Delegated:    info.Delegated,
+	}
+}
+
+// Replaces a wrap key with a new key of the same size, keeping its
+// id and attributes. The new key is first stored under a temporary
+// id, so that it is on the device before the old key is deleted.
+// Objects wrapped under the old key can no longer be imported.
+func (d *Device) ReplaceWrapKey(id uint16, key []byte) error {
+	info, err := d.ObjectInfo(id, commands.ObjectTypeWrapKey)
+	if err != nil {
+		return err
+	}
+	if size := WrapKeySize(info.Algorithm); size != len(key) {
+		return fmt.Errorf("invalid size of new wrap key, got %d bytes, expected %d", len(key), size)
+	}
+	temporary := info.Attributes()
+	temporary.Id = 0
+	temporaryId, err := d.PutWrapKey(temporary, key)
+	if err != nil {
+		return fmt.Errorf("storing the new wrap key failed: %v", err)
+	}
+	if err := d.DeleteObject(id, commands.ObjectTypeWrapKey); err != nil {
+		d.DeleteObject(temporaryId, commands.ObjectTypeWrapKey)
+		return err
+	}
+	if _, err := d.PutWrapKey(info.Attributes(), key); err != nil {
+		return fmt.Errorf("wrap key %d was deleted, and storing the new key in its place failed, "+
+			"the new key is stored as wrap key %d: %v", id, temporaryId, err)
+	}
+	if err := d.DeleteObject(temporaryId, commands.ObjectTypeWrapKey); err != nil {
+		return fmt.Errorf("deleting temporary wrap key %d failed: %v", temporaryId, err)
+	}
+	return nil
+}
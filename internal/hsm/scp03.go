@@ -0,0 +1,150 @@
+package hsm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/certusone/yubihsm-go/connector"
+
+	"sigsum.org/key-mgmt/internal/scp03"
+)
+
+// Implementation of the YubiHSM secure channel, based on SCP03, see
+// https://developers.yubico.com/YubiHSM2/Concepts/Session.html and
+// package scp03. Sessions in the Device pool use the yubihsm-go
+// library's SecureChannel; this implementation is used only for the
+// few commands that the library can't send or parse (see
+// Device.sendRaw), since it gives access to the raw response data.
+
+// Message type of error responses (before adding the response
+// offset).
+const errorResponse = commands.ErrorResponseCode - commands.ResponseCommandOffset
+
+// Serializes a message, consisting of type, length, and payload.
+func serializeMessage(t commands.CommandType, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	msg := make([]byte, 3, 3+len(data))
+	msg[0] = byte(t)
+	binary.BigEndian.PutUint16(msg[1:], uint16(len(data)))
+	return append(msg, data...)
+}
+
+// Parses a response message, returning the payload. Error
+// responses are returned as *DeviceError.
+func parseResponse(t commands.CommandType, msg []byte) ([]byte, error) {
+	if len(msg) < 3 || int(binary.BigEndian.Uint16(msg[1:3])) != len(msg)-3 {
+		return nil, fmt.Errorf("invalid response message")
+	}
+	payload := msg[3:]
+	if msg[0] == byte(errorResponse) && len(payload) == 1 {
+		return nil, &DeviceError{Code: commands.ErrorCode(payload[0])}
+	}
+	if msg[0] != byte(t+commands.ResponseCommandOffset) {
+		return nil, fmt.Errorf("unexpected response type 0x%02x to command 0x%02x", msg[0], byte(t))
+	}
+	return payload, nil
+}
+
+// Sends an unauthenticated command, returning the response payload.
+func sendCommand(conn connector.Connector, t commands.CommandType, data ...[]byte) ([]byte, error) {
+	rsp, err := conn.Request(&commands.CommandMessage{CommandType: t, Data: bytes.Join(data, nil)})
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(t, rsp)
+}
+
+// An authenticated session with the device. Not safe for concurrent
+// use.
+type secureChannel struct {
+	conn      connector.Connector
+	id        uint8
+	keys      scp03.SessionKeys
+	chain     []byte
+	counter   uint32
+	authKeyId uint16
+}
+
+func openSecureChannel(conn connector.Connector, authKeyId uint16, key authkey.AuthKey) (*secureChannel, error) {
+	hostChallenge := make([]byte, scp03.ChallengeLength)
+	if _, err := rand.Read(hostChallenge); err != nil {
+		return nil, err
+	}
+	return openSecureChannelWithChallenge(conn, authKeyId, key, hostChallenge)
+}
+
+func openSecureChannelWithChallenge(conn connector.Connector, authKeyId uint16, key authkey.AuthKey, hostChallenge []byte) (*secureChannel, error) {
+	rsp, err := sendCommand(conn, commands.CommandTypeCreateSession,
+		binary.BigEndian.AppendUint16(nil, authKeyId), hostChallenge)
+	if err != nil {
+		return nil, fmt.Errorf("creating session failed: %w", err)
+	}
+	if len(rsp) != 1+2*scp03.ChallengeLength {
+		return nil, fmt.Errorf("invalid create session response")
+	}
+	s := secureChannel{conn: conn, id: rsp[0], chain: make([]byte, 16), authKeyId: authKeyId}
+	cardChallenge, cardCryptogram := rsp[1:1+scp03.ChallengeLength], rsp[1+scp03.ChallengeLength:]
+
+	s.keys = scp03.DeriveSessionKeys(key, hostChallenge, cardChallenge)
+	if subtle.ConstantTimeCompare(cardCryptogram,
+		scp03.Derive(s.keys.MAC, scp03.DeriveCardCryptogram, scp03.ChallengeLength, hostChallenge, cardChallenge)) != 1 {
+		return nil, fmt.Errorf("%w, invalid card cryptogram", ErrAuthFailed)
+	}
+	hostCryptogram := scp03.Derive(s.keys.MAC, scp03.DeriveHostCryptogram, scp03.ChallengeLength, hostChallenge, cardChallenge)
+	mac := scp03.MessageMAC(s.keys.MAC, s.chain, commands.CommandTypeAuthenticateSession, s.id, hostCryptogram)
+	if _, err := sendCommand(conn, commands.CommandTypeAuthenticateSession,
+		[]byte{s.id}, hostCryptogram, mac[:scp03.MACLength]); err != nil {
+		return nil, fmt.Errorf("authenticating session failed: %w", err)
+	}
+	s.chain = mac
+	s.counter = 1
+	return &s, nil
+}
+
+// Sends a command over the secure channel, and returns the response
+// payload.
+func (s *secureChannel) send(t commands.CommandType, data []byte) ([]byte, error) {
+	if s.counter >= scp03.MaxMessages {
+		return nil, fmt.Errorf("session message limit reached")
+	}
+	encrypted, err := scp03.Crypt(s.keys.Enc, s.counter, scp03.Pad(serializeMessage(t, data)), true)
+	if err != nil {
+		return nil, err
+	}
+	mac := scp03.MessageMAC(s.keys.MAC, s.chain, commands.CommandTypeSessionMessage, s.id, encrypted)
+	s.chain = mac
+	rsp, err := sendCommand(s.conn, commands.CommandTypeSessionMessage,
+		[]byte{s.id}, encrypted, mac[:scp03.MACLength])
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp) < 1+scp03.MACLength || rsp[0] != s.id {
+		return nil, fmt.Errorf("invalid session message response")
+	}
+	rspData, rspMAC := rsp[1:len(rsp)-scp03.MACLength], rsp[len(rsp)-scp03.MACLength:]
+	expectedMAC := scp03.MessageMAC(s.keys.RMAC, s.chain,
+		commands.CommandTypeSessionMessage+commands.ResponseCommandOffset, s.id, rspData)
+	if subtle.ConstantTimeCompare(rspMAC, expectedMAC[:scp03.MACLength]) != 1 {
+		return nil, fmt.Errorf("invalid response mac")
+	}
+	decrypted, err := scp03.Crypt(s.keys.Enc, s.counter, rspData, false)
+	if err != nil {
+		return nil, err
+	}
+	s.counter++
+	msg, err := scp03.Unpad(decrypted)
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(t, msg)
+}
+
+func (s *secureChannel) close() error {
+	_, err := s.send(commands.CommandTypeCloseSession, nil)
+	return err
+}
@@ -0,0 +1,138 @@
+package hsm
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/certusone/yubihsm-go/connector"
+	"github.com/certusone/yubihsm-go/securechannel"
+
+	"sigsum.org/key-mgmt/internal/scp03"
+)
+
+// A device with fixed session id and card challenge, supporting only
+// the echo command, which records all requests.
+type scriptedDevice struct {
+	key           authkey.AuthKey
+	sessionId     uint8
+	cardChallenge []byte
+
+	keys     scp03.SessionKeys
+	chain    []byte
+	counter  uint32
+	requests [][]byte
+}
+
+func (d *scriptedDevice) GetStatus() (*connector.StatusResponse, error) {
+	return &connector.StatusResponse{Status: "OK"}, nil
+}
+
+func (d *scriptedDevice) Request(c *commands.CommandMessage) ([]byte, error) {
+	msg, err := c.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	d.requests = append(d.requests, msg)
+	data := msg[3:]
+	switch c.CommandType {
+	case commands.CommandTypeCreateSession:
+		hostChallenge := data[2:]
+		d.keys = scp03.DeriveSessionKeys(d.key, hostChallenge, d.cardChallenge)
+		d.chain = make([]byte, 16)
+		d.counter = 1
+		return serializeMessage(c.CommandType+commands.ResponseCommandOffset, []byte{d.sessionId}, d.cardChallenge,
+			scp03.Derive(d.keys.MAC, scp03.DeriveCardCryptogram, scp03.ChallengeLength, hostChallenge, d.cardChallenge)), nil
+	case commands.CommandTypeAuthenticateSession:
+		d.chain = scp03.MessageMAC(d.keys.MAC, d.chain, c.CommandType, d.sessionId, data[1:1+scp03.ChallengeLength])
+		return serializeMessage(c.CommandType + commands.ResponseCommandOffset), nil
+	case commands.CommandTypeSessionMessage:
+		encrypted := data[1 : len(data)-scp03.MACLength]
+		d.chain = scp03.MessageMAC(d.keys.MAC, d.chain, c.CommandType, d.sessionId, encrypted)
+		decrypted, err := scp03.Crypt(d.keys.Enc, d.counter, encrypted, false)
+		if err != nil {
+			return nil, err
+		}
+		inner, err := scp03.Unpad(decrypted)
+		if err != nil {
+			return nil, err
+		}
+		if inner[0] != byte(commands.CommandTypeEcho) {
+			return nil, fmt.Errorf("unexpected command 0x%02x", inner[0])
+		}
+		rsp, err := scp03.Crypt(d.keys.Enc, d.counter,
+			scp03.Pad(serializeMessage(commands.CommandTypeEcho+commands.ResponseCommandOffset, inner[3:])), true)
+		if err != nil {
+			return nil, err
+		}
+		d.counter++
+		mac := scp03.MessageMAC(d.keys.RMAC, d.chain, c.CommandType+commands.ResponseCommandOffset, d.sessionId, rsp)
+		return serializeMessage(c.CommandType+commands.ResponseCommandOffset, []byte{d.sessionId}, rsp, mac[:scp03.MACLength]), nil
+	}
+	return nil, fmt.Errorf("unexpected command 0x%02x", byte(c.CommandType))
+}
+
+// Checks that the secure channel sends the same messages as the
+// yubihsm-go library, given the same host challenge, and that both
+// accept the same responses.
+func TestSecureChannelCompatibility(t *testing.T) {
+	const password = "password"
+	hostChallenge := []byte{0xa0, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7}
+	newDevice := func() *scriptedDevice {
+		return &scriptedDevice{
+			key:           authkey.NewFromPassword(password),
+			sessionId:     3,
+			cardChallenge: []byte{0xb0, 0xb1, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7},
+		}
+	}
+	messages := [][]byte{[]byte("ping"), []byte{}, bytes.Repeat([]byte{0x80}, 47)}
+
+	reference := newDevice()
+	lib, err := securechannel.NewSecureChannel(reference, 1, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib.HostChallenge = hostChallenge
+	if err := lib.Authenticate(); err != nil {
+		t.Fatalf("yubihsm-go authentication failed: %v", err)
+	}
+	for _, msg := range messages {
+		command, err := commands.CreateEchoCommand(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := lib.SendEncryptedCommand(command)
+		if err != nil {
+			t.Fatalf("yubihsm-go echo failed: %v", err)
+		}
+		if echo, ok := rsp.(*commands.EchoResponse); !ok || !bytes.Equal(echo.Data, msg) {
+			t.Fatalf("unexpected yubihsm-go echo response %#v", rsp)
+		}
+	}
+
+	device := newDevice()
+	s, err := openSecureChannelWithChallenge(device, 1, authkey.NewFromPassword(password), hostChallenge)
+	if err != nil {
+		t.Fatalf("authentication failed: %v", err)
+	}
+	for _, msg := range messages {
+		rsp, err := s.send(commands.CommandTypeEcho, msg)
+		if err != nil {
+			t.Fatalf("echo failed: %v", err)
+		}
+		if !bytes.Equal(rsp, msg) {
+			t.Fatalf("unexpected echo response %x", rsp)
+		}
+	}
+
+	if got, want := len(device.requests), len(reference.requests); got != want {
+		t.Fatalf("unexpected number of requests %d, expected %d", got, want)
+	}
+	for i, req := range device.requests {
+		if !bytes.Equal(req, reference.requests[i]) {
+			t.Errorf("request %d differs from yubihsm-go:\n got: %x\nwant: %x", i, req, reference.requests[i])
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package hsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/certusone/yubihsm-go/connector"
+)
+
+// Direct access to the device, without a yubihsm-connector process.
+// Over USB, each command message is sent as a single bulk transfer,
+// and the response message is read back as a single bulk transfer,
+// with the same message framing as in the connector's http api
+// (type, 16-bit length, payload).
+
+const (
+	usbVendorId  = 0x1050
+	usbProductId = 0x0030
+	// Max size of a message, including the 3 byte header.
+	maxMessageSize = 3136
+
+	// Prefix of connector urls for direct usb access, same as
+	// used by yubihsm-shell.
+	usbURLPrefix = "yhusb://"
+)
+
+// Reads a complete message, using the length in the header.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	msg := make([]byte, 3, maxMessageSize)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(msg[1:3]))
+	if 3+length > maxMessageSize {
+		return nil, fmt.Errorf("message too large, %d bytes", length)
+	}
+	msg = msg[:3+length]
+	if _, err := io.ReadFull(r, msg[3:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// A StreamConnector talks to a device, or a stand-in, using the usb
+// message framing over a byte stream, e.g., a pipe. Commands are
+// processed one at a time. It is safe for concurrent use.
+type StreamConnector struct {
+	mu sync.Mutex
+	r  io.Reader
+	w  io.Writer
+}
+
+func NewStreamConnector(r io.Reader, w io.Writer) *StreamConnector {
+	return &StreamConnector{r: r, w: w}
+}
+
+func (c *StreamConnector) Request(command *commands.CommandMessage) ([]byte, error) {
+	msg, err := command.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.w.Write(msg); err != nil {
+		return nil, err
+	}
+	return ReadMessage(c.r)
+}
+
+func (c *StreamConnector) GetStatus() (*connector.StatusResponse, error) {
+	return &connector.StatusResponse{Status: "OK", Version: "stream"}, nil
+}
+
+// Parses a usb connector url, "yhusb://" or "yhusb://serial=NUMBER".
+// Returns the serial number, zero if not specified.
+func parseUSBURL(url string) (uint32, error) {
+	params, ok := strings.CutPrefix(url, usbURLPrefix)
+	if !ok {
+		return 0, fmt.Errorf("invalid usb url %q", url)
+	}
+	if len(params) == 0 {
+		return 0, nil
+	}
+	value, ok := strings.CutPrefix(params, "serial=")
+	if !ok {
+		return 0, fmt.Errorf("invalid usb url %q, only the serial parameter is supported", url)
+	}
+	serial, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || serial == 0 {
+		return 0, fmt.Errorf("invalid serial number in usb url %q", url)
+	}
+	return uint32(serial), nil
+}
@@ -0,0 +1,233 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/certusone/yubihsm-go/connector"
+	"golang.org/x/sys/unix"
+)
+
+// Usb access using the kernel's usbfs interface, see
+// linux/usbdevice_fs.h. The process needs read and write access to
+// the device node under /dev/bus/usb, typically granted by a udev
+// rule.
+
+const (
+	usbEndpointOut = 0x01
+	usbEndpointIn  = 0x81
+	usbInterface   = 0
+	// Bulk packet size; a transfer that is a multiple of the
+	// packet size must be terminated by a zero-length packet.
+	usbPacketSize = 64
+	// Timeout for a single transfer, in milliseconds.
+	usbTimeout = 30000
+
+	usbSysfsDir = "/sys/bus/usb/devices"
+)
+
+// Corresponds to struct usbdevfs_bulktransfer.
+type usbBulkTransfer struct {
+	endpoint uint32
+	length   uint32
+	timeout  uint32
+	data     unsafe.Pointer
+}
+
+// Ioctl request numbers, using the _IOR/_IOWR encoding of the
+// common architectures.
+func usbIoctl(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | 'U'<<8 | nr
+}
+
+var (
+	usbdevfsBulk             = usbIoctl(3, 2, unsafe.Sizeof(usbBulkTransfer{}))
+	usbdevfsClaimInterface   = usbIoctl(2, 15, 4)
+	usbdevfsReleaseInterface = usbIoctl(2, 16, 4)
+)
+
+// A USBConnector talks directly to a YubiHSM attached via usb.
+// Commands are processed one at a time. It is safe for concurrent
+// use.
+type USBConnector struct {
+	mu     sync.Mutex
+	file   *os.File
+	serial uint32
+}
+
+type usbDeviceInfo struct {
+	path   string
+	serial uint32
+}
+
+func readSysfsAttribute(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Lists attached YubiHSM devices.
+func listUSBDevices() ([]usbDeviceInfo, error) {
+	entries, err := os.ReadDir(usbSysfsDir)
+	if err != nil {
+		return nil, err
+	}
+	var devices []usbDeviceInfo
+	for _, entry := range entries {
+		dir := filepath.Join(usbSysfsDir, entry.Name())
+		if readSysfsAttribute(dir, "idVendor") != fmt.Sprintf("%04x", usbVendorId) ||
+			readSysfsAttribute(dir, "idProduct") != fmt.Sprintf("%04x", usbProductId) {
+			continue
+		}
+		bus, err := strconv.Atoi(readSysfsAttribute(dir, "busnum"))
+		if err != nil {
+			continue
+		}
+		dev, err := strconv.Atoi(readSysfsAttribute(dir, "devnum"))
+		if err != nil {
+			continue
+		}
+		serial, err := strconv.ParseUint(readSysfsAttribute(dir, "serial"), 10, 32)
+		if err != nil {
+			continue
+		}
+		devices = append(devices, usbDeviceInfo{
+			path:   fmt.Sprintf("/dev/bus/usb/%03d/%03d", bus, dev),
+			serial: uint32(serial),
+		})
+	}
+	return devices, nil
+}
+
+// Returns the serial numbers of attached YubiHSM devices.
+func ListUSBDevices() ([]uint32, error) {
+	devices, err := listUSBDevices()
+	if err != nil {
+		return nil, err
+	}
+	var serials []uint32
+	for _, d := range devices {
+		serials = append(serials, d.serial)
+	}
+	return serials, nil
+}
+
+// Opens an attached YubiHSM. If serial is zero, there must be
+// exactly one device attached.
+func OpenUSBConnector(serial uint32) (*USBConnector, error) {
+	devices, err := listUSBDevices()
+	if err != nil {
+		return nil, err
+	}
+	var found *usbDeviceInfo
+	for i := range devices {
+		if serial != 0 && devices[i].serial != serial {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("multiple YubiHSM devices found, serial numbers %d and %d, specify which to use",
+				found.serial, devices[i].serial)
+		}
+		found = &devices[i]
+	}
+	if found == nil {
+		if serial != 0 {
+			return nil, fmt.Errorf("no YubiHSM device with serial number %d found", serial)
+		}
+		return nil, errors.New("no YubiHSM device found")
+	}
+	f, err := os.OpenFile(found.path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	c := USBConnector{file: f, serial: found.serial}
+	iface := uint32(usbInterface)
+	if err := c.ioctl(usbdevfsClaimInterface, unsafe.Pointer(&iface)); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("claiming usb interface of %s failed: %v", found.path, err)
+	}
+	return &c, nil
+}
+
+func (c *USBConnector) ioctl(req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, c.file.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (c *USBConnector) bulk(endpoint uint32, data []byte) (int, error) {
+	t := usbBulkTransfer{
+		endpoint: endpoint,
+		length:   uint32(len(data)),
+		timeout:  usbTimeout,
+	}
+	if len(data) > 0 {
+		t.data = unsafe.Pointer(&data[0])
+	}
+	n, _, errno := unix.Syscall(unix.SYS_IOCTL, c.file.Fd(), usbdevfsBulk, uintptr(unsafe.Pointer(&t)))
+	runtime.KeepAlive(data)
+	if errno != 0 {
+		return 0, fmt.Errorf("usb transfer failed: %v", errno)
+	}
+	return int(n), nil
+}
+
+func (c *USBConnector) Request(command *commands.CommandMessage) ([]byte, error) {
+	msg, err := command.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil, errors.New("usb connector is closed")
+	}
+	if _, err := c.bulk(usbEndpointOut, msg); err != nil {
+		return nil, err
+	}
+	if len(msg)%usbPacketSize == 0 {
+		if _, err := c.bulk(usbEndpointOut, nil); err != nil {
+			return nil, err
+		}
+	}
+	rsp := make([]byte, maxMessageSize)
+	n, err := c.bulk(usbEndpointIn, rsp)
+	if err != nil {
+		return nil, err
+	}
+	return rsp[:n], nil
+}
+
+func (c *USBConnector) GetStatus() (*connector.StatusResponse, error) {
+	return &connector.StatusResponse{
+		Status:  "OK",
+		Serial:  fmt.Sprintf("%010d", c.serial),
+		Version: "usb",
+		Pid:     fmt.Sprintf("%d", os.Getpid()),
+	}, nil
+}
+
+func (c *USBConnector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	iface := uint32(usbInterface)
+	c.ioctl(usbdevfsReleaseInterface, unsafe.Pointer(&iface))
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package hsm
+
+import (
+	"errors"
+
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/certusone/yubihsm-go/connector"
+)
+
+// Direct usb access is implemented only for linux.
+type USBConnector struct{}
+
+func ListUSBDevices() ([]uint32, error) {
+	return nil, errors.New("direct usb access not supported on this platform")
+}
+
+func OpenUSBConnector(serial uint32) (*USBConnector, error) {
+	return nil, errors.New("direct usb access not supported on this platform")
+}
+
+func (c *USBConnector) Request(command *commands.CommandMessage) ([]byte, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *USBConnector) GetStatus() (*connector.StatusResponse, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *USBConnector) Close() error {
+	return nil
+}
@@ -6,32 +6,26 @@ import (
 	"fmt"
 	"io"
 
-	"github.com/certusone/yubihsm-go"
 	"github.com/certusone/yubihsm-go/commands"
-	"github.com/certusone/yubihsm-go/connector"
 )
 
 type YubiHSMSigner struct {
-	session   *yubihsm.SessionManager
+	device    *Device
 	keyId     uint16
 	publicKey ed25519.PublicKey
 }
 
-func NewYubiHSMSigner(conn string /* host:port */, authId uint16, authPassword string, keyId uint16) (*YubiHSMSigner, error) {
-	sess, err := yubihsm.NewSessionManager(connector.NewHTTPConnector(conn), authId, authPassword)
-	if err != nil {
-		return nil, err
-	}
-	pub, err := getEd25519PublicKey(sess, keyId)
+func NewYubiHSMSigner(device *Device, keyId uint16) (*YubiHSMSigner, error) {
+	pub, err := getEd25519PublicKey(device, keyId)
 	if err != nil {
 		return nil, err
 	}
 
-	return &YubiHSMSigner{session: sess, keyId: keyId, publicKey: pub}, nil
+	return &YubiHSMSigner{device: device, keyId: keyId, publicKey: pub}, nil
 }
 
 func (hsm *YubiHSMSigner) Sign(_ io.Reader, msg []byte, _ crypto.SignerOpts) ([]byte, error) {
-	signature, err := sign(hsm.session, hsm.keyId, msg)
+	signature, err := sign(hsm.device, hsm.keyId, msg)
 	if err != nil {
 		return nil, err
 	}
@@ -50,10 +44,10 @@ func (hsm *YubiHSMSigner) Public() crypto.PublicKey {
 
 // Close closes the connection to the HSM
 func (hsm *YubiHSMSigner) Close() {
-	hsm.session.Destroy()
+	hsm.device.Close()
 }
 
-func getEd25519PublicKey(session *yubihsm.SessionManager, keyID uint16) (ed25519.PublicKey, error) {
+func getEd25519PublicKey(session *Device, keyID uint16) (ed25519.PublicKey, error) {
 	command, err := commands.CreateGetPubKeyCommand(keyID)
 	if err != nil {
 		return nil, err
@@ -72,7 +66,7 @@ func getEd25519PublicKey(session *yubihsm.SessionManager, keyID uint16) (ed25519
 	return ed25519.PublicKey(respCmd.KeyData), nil
 }
 
-func sign(session *yubihsm.SessionManager, keyID uint16, data []byte) ([]byte, error) {
+func sign(session *Device, keyID uint16, data []byte) ([]byte, error) {
 	command, err := commands.CreateSignDataEddsaCommand(keyID, data)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,84 @@
+package hsmsim
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// AES-CCM (RFC 3610), as used by the device for wrapped objects,
+// with a 13 byte nonce, a 16 byte tag, and no associated data. Only
+// used by the simulator.
+
+const ccmLengthSize = 15 - wrapNonceSize
+
+func ccmBlocks(key, nonce []byte) (cipher.Block, error) {
+	if len(nonce) != wrapNonceSize {
+		return nil, errors.New("invalid ccm nonce size")
+	}
+	return aes.NewCipher(key)
+}
+
+// Computes the CBC-MAC over the formatted input.
+func ccmMAC(block cipher.Block, nonce, plaintext []byte) []byte {
+	var b [aes.BlockSize]byte
+	b[0] = 8*((wrapTagSize-2)/2) + (ccmLengthSize - 1)
+	copy(b[1:], nonce)
+	binary.BigEndian.PutUint16(b[1+wrapNonceSize:], uint16(len(plaintext)))
+	mac := make([]byte, aes.BlockSize)
+	block.Encrypt(mac, b[:])
+	for data := plaintext; len(data) > 0; {
+		n := copy(b[:], data)
+		clear(b[n:])
+		data = data[n:]
+		subtle.XORBytes(mac, mac, b[:])
+		block.Encrypt(mac, mac)
+	}
+	return mac[:wrapTagSize]
+}
+
+// Applies the ctr keystream, starting with counter i, to data.
+func ccmCTR(block cipher.Block, nonce []byte, i uint16, dst, data []byte) {
+	var a [aes.BlockSize]byte
+	a[0] = ccmLengthSize - 1
+	copy(a[1:], nonce)
+	binary.BigEndian.PutUint16(a[1+wrapNonceSize:], i)
+	cipher.NewCTR(block, a[:]).XORKeyStream(dst, data)
+}
+
+// Returns the ciphertext followed by the tag.
+func ccmSeal(key, nonce, plaintext []byte) ([]byte, error) {
+	block, err := ccmBlocks(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) > 0xffff {
+		return nil, errors.New("ccm plaintext too large")
+	}
+	tag := ccmMAC(block, nonce, plaintext)
+	out := make([]byte, len(plaintext)+wrapTagSize)
+	ccmCTR(block, nonce, 1, out, plaintext)
+	ccmCTR(block, nonce, 0, out[len(plaintext):], tag)
+	return out, nil
+}
+
+func ccmOpen(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, err := ccmBlocks(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < wrapTagSize {
+		return nil, errors.New("ccm ciphertext too short")
+	}
+	n := len(ciphertext) - wrapTagSize
+	plaintext := make([]byte, n)
+	ccmCTR(block, nonce, 1, plaintext, ciphertext[:n])
+	tag := make([]byte, wrapTagSize)
+	ccmCTR(block, nonce, 0, tag, ciphertext[n:])
+	if subtle.ConstantTimeCompare(tag, ccmMAC(block, nonce, plaintext)) != 1 {
+		return nil, errors.New("ccm authentication failed")
+	}
+	return plaintext, nil
+}
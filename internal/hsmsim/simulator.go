@@ -0,0 +1,1061 @@
+package hsmsim
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/certusone/yubihsm-go/connector"
+
+	"sigsum.org/key-mgmt/internal/hsm"
+	"sigsum.org/key-mgmt/internal/scp03"
+)
+
+// A software simulation of a YubiHSM 2, implementing the
+// connector.Connector interface, for use in tests and dry runs. Only
+// the subset of commands used by package hsm and the provisioning
+// scripts is implemented, with Ed25519 as the only asymmetric
+// algorithm. Secret key material is stored in the clear, so the
+// simulator must never be used with real keys.
+
+const (
+	// The device closes sessions after 30 seconds of inactivity.
+	simSessionTimeout = 30 * time.Second
+
+	// Object origin flags.
+	simOriginGenerated = 0x01
+	simOriginImported  = 0x02
+	// Flag for objects imported under wrap.
+	simOriginImportedWrapped = 0x10
+
+	simAllDomains = 0xffff
+
+	simLogSize = 62
+	// Used in log entries when there's no applicable key.
+	simNoKey = 0xffff
+
+	// Sizes of the CCM nonce and tag of wrapped objects.
+	wrapNonceSize = 13
+	wrapTagSize   = 16
+)
+
+// Response type of error responses, with the response offset
+// removed.
+const errorResponse = commands.ErrorResponseCode - commands.ResponseCommandOffset
+
+// Serializes a message: the type, a 16-bit length, and the payload.
+func serializeMessage(t commands.CommandType, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	msg := make([]byte, 3, 3+len(data))
+	msg[0] = byte(t)
+	binary.BigEndian.PutUint16(msg[1:], uint16(len(data)))
+	return append(msg, data...)
+}
+
+type simObject struct {
+	Id           uint16
+	Type         uint8
+	Algorithm    commands.Algorithm
+	Label        string
+	Domains      uint16
+	Capabilities uint64
+	Delegated    uint64
+	Sequence     uint8
+	Origin       uint8
+	// Secret key material: For authentication keys, the
+	// encryption key followed by the mac key, and for Ed25519
+	// keys, the private key seed.
+	Secret []byte
+}
+
+// Persistent state of the simulated device.
+type simState struct {
+	Serial  uint32
+	Objects []*simObject
+	// Audit log entries not yet acknowledged, and the last entry
+	// added, which the next entry is chained to.
+	Log     []hsm.LogEntry
+	LastLog hsm.LogEntry
+}
+
+type simSession struct {
+	authKeyId                    uint16
+	hostChallenge, cardChallenge []byte
+	keys                         scp03.SessionKeys
+	chain                        []byte
+	counter                      uint32
+	authenticated                bool
+	lastUsed                     time.Time
+}
+
+type Simulator struct {
+	// If non-empty, the state is saved to this file after each
+	// modification.
+	file string
+
+	mu       sync.Mutex
+	state    simState
+	sessions [hsm.MaxSessions]*simSession
+}
+
+func factoryState(serial uint32) simState {
+	// The log starts with an initial entry, with all fields set
+	// to 0xff.
+	initial := hsm.NewLogEntry(&hsm.LogEntry{}, hsm.LogEntry{
+		Command: 0xff, Length: 0xffff, SessionKey: 0xffff,
+		TargetKey: 0xffff, SecondKey: 0xffff, Result: 0xff, Systick: 0xffffffff,
+	})
+	return simState{
+		Log:     []hsm.LogEntry{initial},
+		LastLog: initial,
+		Serial:  serial,
+		Objects: []*simObject{&simObject{
+			Id:           hsm.DefaultAuthKeyId,
+			Type:         commands.ObjectTypeAuthenticationKey,
+			Algorithm:    commands.AlgorithmYubicoAESAuthentication,
+			Label:        hsm.DefaultAuthKeyLabel,
+			Domains:      simAllDomains,
+			Capabilities: hsm.AllCapabilities,
+			Delegated:    hsm.AllCapabilities,
+			Origin:       simOriginImported,
+			Secret:       authkey.NewFromPassword(hsm.DefaultAuthKeyPassword),
+		}},
+	}
+}
+
+// Creates a simulator in factory reset state, with the given serial
+// number, and no persistent storage.
+func NewSimulator(serial uint32) *Simulator {
+	return &Simulator{state: factoryState(serial)}
+}
+
+// Creates a simulator with state stored in the given file. If the
+// file doesn't exist, it is created with factory reset state.
+func OpenSimulator(file string, serial uint32) (*Simulator, error) {
+	s := Simulator{file: file}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		s.state = factoryState(serial)
+		return &s, s.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, fmt.Errorf("invalid simulator state file %q: %v", file, err)
+	}
+	return &s, nil
+}
+
+func (s *Simulator) save() error {
+	if len(s.file) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(&s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".new"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+func (s *Simulator) Serial() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Serial
+}
+
+// Adds an Ed25519 key directly to the device state, bypassing
+// authentication, unless a key with that id already exists. Returns
+// the public key.
+func (s *Simulator) AddEd25519Key(id uint16, label string, domains uint16, capabilities uint64) (ed25519.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, o := s.findObject(id, commands.ObjectTypeAsymmetricKey)
+	if o == nil {
+		o = &simObject{
+			Id:           id,
+			Type:         commands.ObjectTypeAsymmetricKey,
+			Algorithm:    commands.AlgorithmED25519,
+			Label:        label,
+			Domains:      domains,
+			Capabilities: capabilities,
+			Origin:       simOriginGenerated,
+			Secret:       make([]byte, ed25519.SeedSize),
+		}
+		if _, err := rand.Read(o.Secret); err != nil {
+			return nil, err
+		}
+		s.state.Objects = append(s.state.Objects, o)
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+	return ed25519.NewKeyFromSeed(o.Secret).Public().(ed25519.PublicKey), nil
+}
+
+func (s *Simulator) GetStatus() (*connector.StatusResponse, error) {
+	return &connector.StatusResponse{
+		Status:  "OK",
+		Serial:  fmt.Sprintf("%010d", s.Serial()),
+		Version: "simulator",
+		Pid:     fmt.Sprintf("%d", os.Getpid()),
+		Address: "localhost",
+		Port:    "0",
+	}, nil
+}
+
+// Processes a command message, and returns the response message.
+// Errors are reported to the client as error responses, like the
+// real device does.
+func (s *Simulator) Request(c *commands.CommandMessage) ([]byte, error) {
+	msg, err := c.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return s.Process(msg), nil
+}
+
+// Processes a serialized command message.
+func (s *Simulator) Process(msg []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, data, err := parseMessage(msg)
+	if err != nil {
+		return simErrorResponse(err)
+	}
+	var rsp []byte
+	switch t {
+	case commands.CommandTypeEcho:
+		rsp = data
+	case commands.CommandTypeDeviceInfo:
+		rsp = s.deviceInfo()
+	case commands.CommandTypeCreateSession:
+		authKeyId := uint16(simNoKey)
+		if len(data) >= 2 {
+			authKeyId = binary.BigEndian.Uint16(data)
+		}
+		rsp, err = s.createSession(data)
+		s.logCommand(t, len(data), authKeyId, simNoKey, err)
+	case commands.CommandTypeAuthenticateSession:
+		authKeyId := uint16(simNoKey)
+		if len(data) > 0 && int(data[0]) < len(s.sessions) && s.sessions[data[0]] != nil {
+			authKeyId = s.sessions[data[0]].authKeyId
+		}
+		rsp, err = s.authenticateSession(data)
+		s.logCommand(t, len(data), authKeyId, simNoKey, err)
+	case commands.CommandTypeSessionMessage:
+		// Errors in the session layer are not encrypted.
+		rsp, err = s.sessionMessage(data)
+	default:
+		err = simError(commands.ErrorCodeInvalidCommand)
+	}
+	if err == nil && t != commands.CommandTypeEcho && t != commands.CommandTypeDeviceInfo {
+		if saveErr := s.save(); saveErr != nil {
+			err = simError(commands.ErrorCodeStorageFailed)
+		}
+	}
+	if err != nil {
+		return simErrorResponse(err)
+	}
+	return serializeMessage(t+commands.ResponseCommandOffset, rsp)
+}
+
+// Serves commands using the usb message framing, see
+// StreamConnector, until the client closes the stream.
+func (s *Simulator) ServeStream(r io.Reader, w io.Writer) error {
+	for {
+		msg, err := hsm.ReadMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(s.Process(msg)); err != nil {
+			return err
+		}
+	}
+}
+
+// Adds an entry to the audit log. If the log is full, the oldest
+// entry is dropped.
+func (s *Simulator) logCommand(t commands.CommandType, length int, sessionKey, targetKey uint16, err error) {
+	result := byte(t + commands.ResponseCommandOffset)
+	if err != nil {
+		result = byte(errorResponse)
+	}
+	e := hsm.NewLogEntry(&s.state.LastLog, hsm.LogEntry{
+		Command:    uint8(t),
+		Length:     uint16(length),
+		SessionKey: sessionKey,
+		TargetKey:  targetKey,
+		SecondKey:  simNoKey,
+		Result:     result,
+		Systick:    s.state.LastLog.Systick + 1,
+	})
+	if len(s.state.Log) >= simLogSize {
+		s.state.Log = s.state.Log[1:]
+	}
+	s.state.Log = append(s.state.Log, e)
+	s.state.LastLog = e
+}
+
+func parseMessage(msg []byte) (commands.CommandType, []byte, error) {
+	if len(msg) < 3 {
+		return 0, nil, simError(commands.ErrorCodeInvalidData)
+	}
+	if int(binary.BigEndian.Uint16(msg[1:3])) != len(msg)-3 {
+		return 0, nil, simError(commands.ErrorCodeWrongLength)
+	}
+	return commands.CommandType(msg[0]), msg[3:], nil
+}
+
+func simError(code commands.ErrorCode) error {
+	return &commands.Error{Code: code}
+}
+
+func simErrorResponse(err error) []byte {
+	code := commands.ErrorCodeInvalidData
+	var hsmErr *commands.Error
+	if errors.As(err, &hsmErr) {
+		code = hsmErr.Code
+	}
+	return serializeMessage(errorResponse, []byte{byte(code)})
+}
+
+func (s *Simulator) deviceInfo() []byte {
+	info := []byte{2, 4, 0}
+	info = binary.BigEndian.AppendUint32(info, s.state.Serial)
+	// Log size and entries used.
+	info = append(info, simLogSize, byte(len(s.state.Log)))
+	return append(info, byte(commands.AlgorithmED25519),
+		byte(commands.AlgorithmYubicoAESAuthentication))
+}
+
+func (s *Simulator) findObject(id uint16, t uint8) (int, *simObject) {
+	for i, o := range s.state.Objects {
+		if o.Id == id && o.Type == t {
+			return i, o
+		}
+	}
+	return -1, nil
+}
+
+func (s *Simulator) createSession(data []byte) ([]byte, error) {
+	if len(data) != 2+scp03.ChallengeLength {
+		return nil, simError(commands.ErrorCodeWrongLength)
+	}
+	authKeyId := binary.BigEndian.Uint16(data)
+	_, key := s.findObject(authKeyId, commands.ObjectTypeAuthenticationKey)
+	if key == nil {
+		return nil, simError(commands.ErrorCodeObjectNotFound)
+	}
+	s.expireSessions()
+	id := -1
+	for i, session := range s.sessions {
+		if session == nil {
+			id = i
+			break
+		}
+	}
+	if id < 0 {
+		return nil, simError(commands.ErrorCodeSessionFull)
+	}
+	cardChallenge := make([]byte, scp03.ChallengeLength)
+	if _, err := rand.Read(cardChallenge); err != nil {
+		return nil, err
+	}
+	hostChallenge := bytes.Clone(data[2:])
+	session := simSession{
+		authKeyId:     authKeyId,
+		hostChallenge: hostChallenge,
+		cardChallenge: cardChallenge,
+		keys:          scp03.DeriveSessionKeys(authkey.AuthKey(key.Secret), hostChallenge, cardChallenge),
+		chain:         make([]byte, 16),
+		lastUsed:      time.Now(),
+	}
+	s.sessions[id] = &session
+	return bytes.Join([][]byte{
+		[]byte{byte(id)}, cardChallenge,
+		scp03.Derive(session.keys.MAC, scp03.DeriveCardCryptogram, scp03.ChallengeLength, hostChallenge, cardChallenge),
+	}, nil), nil
+}
+
+func (s *Simulator) expireSessions() {
+	for i, session := range s.sessions {
+		if session != nil && time.Since(session.lastUsed) > simSessionTimeout {
+			s.sessions[i] = nil
+		}
+	}
+}
+
+// Looks up a session, given the message data starting with the
+// session id.
+func (s *Simulator) lookupSession(data []byte, authenticated bool) (uint8, *simSession, error) {
+	if len(data) < 1+scp03.MACLength {
+		return 0, nil, simError(commands.ErrorCodeWrongLength)
+	}
+	id := data[0]
+	if int(id) >= len(s.sessions) || s.sessions[id] == nil {
+		return 0, nil, simError(commands.ErrorCodeInvalidSession)
+	}
+	session := s.sessions[id]
+	if time.Since(session.lastUsed) > simSessionTimeout || session.authenticated != authenticated {
+		s.sessions[id] = nil
+		return 0, nil, simError(commands.ErrorCodeInvalidSession)
+	}
+	return id, session, nil
+}
+
+// Checks the mac of a message, data is the message data starting
+// with the session id.
+func (session *simSession) checkMAC(t commands.CommandType, data []byte) bool {
+	mac := scp03.MessageMAC(session.keys.MAC, session.chain, t, data[0], data[1:len(data)-scp03.MACLength])
+	if subtle.ConstantTimeCompare(mac[:scp03.MACLength], data[len(data)-scp03.MACLength:]) != 1 {
+		return false
+	}
+	session.chain = mac
+	return true
+}
+
+func (s *Simulator) authenticateSession(data []byte) ([]byte, error) {
+	id, session, err := s.lookupSession(data, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1+scp03.ChallengeLength+scp03.MACLength {
+		return nil, simError(commands.ErrorCodeWrongLength)
+	}
+	hostCryptogram := scp03.Derive(session.keys.MAC, scp03.DeriveHostCryptogram, scp03.ChallengeLength,
+		session.hostChallenge, session.cardChallenge)
+	if subtle.ConstantTimeCompare(hostCryptogram, data[1:1+scp03.ChallengeLength]) != 1 ||
+		!session.checkMAC(commands.CommandTypeAuthenticateSession, data) {
+		s.sessions[id] = nil
+		return nil, simError(commands.ErrorCodeAuthFail)
+	}
+	session.authenticated = true
+	session.counter = 1
+	session.lastUsed = time.Now()
+	return nil, nil
+}
+
+func (s *Simulator) sessionMessage(data []byte) ([]byte, error) {
+	id, session, err := s.lookupSession(data, true)
+	if err != nil {
+		return nil, err
+	}
+	if !session.checkMAC(commands.CommandTypeSessionMessage, data) {
+		s.sessions[id] = nil
+		return nil, simError(commands.ErrorCodeSessionFailed)
+	}
+	session.lastUsed = time.Now()
+	decrypted, err := scp03.Crypt(session.keys.Enc, session.counter, data[1:len(data)-scp03.MACLength], false)
+	if err != nil {
+		s.sessions[id] = nil
+		return nil, simError(commands.ErrorCodeSessionFailed)
+	}
+	msg, err := scp03.Unpad(decrypted)
+	if err != nil {
+		s.sessions[id] = nil
+		return nil, simError(commands.ErrorCodeSessionFailed)
+	}
+
+	var rsp []byte
+	t, cmdData, cmdErr := parseMessage(msg)
+	if cmdErr == nil {
+		rsp, cmdErr = s.sessionCommand(session, t, cmdData)
+	}
+	if cmdErr != nil {
+		rsp = simErrorResponse(cmdErr)
+	} else {
+		rsp = serializeMessage(t+commands.ResponseCommandOffset, rsp)
+	}
+	if t != commands.CommandTypeReset || cmdErr != nil {
+		s.logCommand(t, len(cmdData), session.authKeyId, simTargetKey(t, cmdData, rsp), cmdErr)
+	}
+	encrypted, err := scp03.Crypt(session.keys.Enc, session.counter, scp03.Pad(rsp), true)
+	if err != nil {
+		return nil, err
+	}
+	session.counter++
+	mac := scp03.MessageMAC(session.keys.RMAC, session.chain,
+		commands.CommandTypeSessionMessage+commands.ResponseCommandOffset, id, encrypted)
+	if t == commands.CommandTypeCloseSession {
+		s.sessions[id] = nil
+	}
+	if t == commands.CommandTypeReset && cmdErr == nil {
+		s.sessions = [hsm.MaxSessions]*simSession{}
+	}
+	return bytes.Join([][]byte{[]byte{id}, encrypted, mac[:scp03.MACLength]}, nil), nil
+}
+
+// Returns the id of the object a command operates on, for the audit
+// log. For commands creating objects, the id is taken from the
+// response message.
+func simTargetKey(t commands.CommandType, data, rsp []byte) uint16 {
+	switch t {
+	case commands.CommandTypeGetPubKey,
+		commands.CommandTypeSignDataEddsa,
+		commands.CommandTypeGetObjectInfo,
+		commands.CommandTypeDeleteObject,
+		commands.CommandTypeExportWrapped,
+		commands.CommandTypeImportWrapped,
+		commands.CommandTypeChangeAuthenticationKey:
+		if len(data) >= 2 {
+			return binary.BigEndian.Uint16(data)
+		}
+	case commands.CommandTypeGenerateAsymmetricKey,
+		commands.CommandTypePutAuthKey,
+		commands.CommandTypePutWrapKey:
+		if len(rsp) == 5 && rsp[0] == byte(t+commands.ResponseCommandOffset) {
+			return binary.BigEndian.Uint16(rsp[3:])
+		}
+	}
+	return simNoKey
+}
+
+// A parser for fixed size command arguments.
+type simArgs struct {
+	data []byte
+	err  error
+}
+
+func (a *simArgs) next(n int) []byte {
+	if a.err != nil {
+		return make([]byte, n)
+	}
+	if len(a.data) < n {
+		a.err = simError(commands.ErrorCodeWrongLength)
+		return make([]byte, n)
+	}
+	b := a.data[:n]
+	a.data = a.data[n:]
+	return b
+}
+
+func (a *simArgs) uint8() uint8   { return a.next(1)[0] }
+func (a *simArgs) uint16() uint16 { return binary.BigEndian.Uint16(a.next(2)) }
+func (a *simArgs) uint64() uint64 { return binary.BigEndian.Uint64(a.next(8)) }
+func (a *simArgs) label() string {
+	return string(bytes.TrimRight(a.next(commands.LabelLength), "\x00"))
+}
+
+// Returns the error, if any, and checks that all data was consumed.
+func (a *simArgs) done() error {
+	if a.err == nil && len(a.data) > 0 {
+		return simError(commands.ErrorCodeWrongLength)
+	}
+	return a.err
+}
+
+type simContext struct {
+	*Simulator
+	authKey *simObject
+}
+
+// Checks that the session's authentication key has all the given
+// capabilities.
+func (c *simContext) require(capabilities uint64) error {
+	if c.authKey.Capabilities&capabilities != capabilities {
+		return simError(commands.ErrorCodeInvalidPermission)
+	}
+	return nil
+}
+
+// Looks up an object accessible in the session.
+func (c *simContext) object(id uint16, t uint8) (*simObject, error) {
+	_, o := c.findObject(id, t)
+	if o == nil || o.Domains&c.authKey.Domains == 0 {
+		return nil, simError(commands.ErrorCodeObjectNotFound)
+	}
+	return o, nil
+}
+
+// Checks the attributes of an object to be created in the session,
+// and adds it. An id of zero means that the device selects a free
+// id.
+func (c *simContext) create(o *simObject) error {
+	if o.Domains == 0 || o.Domains&^c.authKey.Domains != 0 ||
+		o.Capabilities&^c.authKey.Delegated != 0 || o.Delegated&^c.authKey.Delegated != 0 {
+		return simError(commands.ErrorCodeInvalidPermission)
+	}
+	if o.Id == 0 {
+		for id := uint16(1); id != 0; id++ {
+			if _, other := c.findObject(id, o.Type); other == nil {
+				o.Id = id
+				break
+			}
+		}
+	} else if _, other := c.findObject(o.Id, o.Type); other != nil {
+		return simError(commands.ErrorCodeObjectExists)
+	}
+	c.state.Objects = append(c.state.Objects, o)
+	return nil
+}
+
+func (s *Simulator) sessionCommand(session *simSession, t commands.CommandType, data []byte) ([]byte, error) {
+	_, authKey := s.findObject(session.authKeyId, commands.ObjectTypeAuthenticationKey)
+	if authKey == nil {
+		return nil, simError(commands.ErrorCodeInvalidSession)
+	}
+	c := simContext{Simulator: s, authKey: authKey}
+	args := simArgs{data: data}
+
+	switch t {
+	case commands.CommandTypeEcho:
+		return data, nil
+	case commands.CommandTypeDeviceInfo:
+		return s.deviceInfo(), args.done()
+	case commands.CommandTypeCloseSession:
+		return nil, args.done()
+	case commands.CommandTypeGetPseudoRandom:
+		n := args.uint16()
+		if err := args.done(); err != nil {
+			return nil, err
+		}
+		if err := c.require(commands.CapabilityGetRandomness); err != nil {
+			return nil, err
+		}
+		rsp := make([]byte, n)
+		_, err := rand.Read(rsp)
+		return rsp, err
+	case commands.CommandTypeListObjects:
+		return c.listObjects(&args)
+	case commands.CommandTypeGetObjectInfo:
+		return c.objectInfo(&args)
+	case commands.CommandTypeGetPubKey:
+		return c.getPubKey(&args)
+	case commands.CommandTypeSignDataEddsa:
+		return c.signEddsa(&args)
+	case commands.CommandTypeGenerateAsymmetricKey:
+		return c.generateAsymmetric(&args)
+	case commands.CommandTypePutAuthKey:
+		return c.putAuthKey(&args)
+	case commands.CommandTypePutWrapKey:
+		return c.putWrapKey(&args)
+	case commands.CommandTypeChangeAuthenticationKey:
+		return c.changeAuthKey(&args)
+	case commands.CommandTypeExportWrapped:
+		return c.exportWrapped(&args)
+	case commands.CommandTypeImportWrapped:
+		return c.importWrapped(&args)
+	case commands.CommandTypeDeleteObject:
+		return c.deleteObject(&args)
+	case commands.CommandTypeGetLogs:
+		if err := args.done(); err != nil {
+			return nil, err
+		}
+		if err := c.require(commands.CapabilityAudit); err != nil {
+			return nil, err
+		}
+		// No unlogged boot or authentication events.
+		rsp := []byte{0, 0, 0, 0, byte(len(s.state.Log))}
+		for _, e := range s.state.Log {
+			rsp = append(rsp, e.Marshal()...)
+		}
+		return rsp, nil
+	case commands.CommandTypeSetLogIndex:
+		index := args.uint16()
+		if err := args.done(); err != nil {
+			return nil, err
+		}
+		if err := c.require(commands.CapabilityAudit); err != nil {
+			return nil, err
+		}
+		for i, e := range s.state.Log {
+			if e.Number == index {
+				s.state.Log = s.state.Log[i+1:]
+				return nil, nil
+			}
+		}
+		return nil, simError(commands.ErrorCodeInvalidData)
+	case commands.CommandTypeGetOption:
+		option := args.uint8()
+		if err := args.done(); err != nil {
+			return nil, err
+		}
+		if err := c.require(commands.CapabilityGetOption); err != nil {
+			return nil, err
+		}
+		// Only the force-audit option, which is always off, is
+		// simulated.
+		if option != hsm.OptionForceAudit {
+			return nil, simError(commands.ErrorCodeInvalidData)
+		}
+		return []byte{0}, nil
+	case commands.CommandTypeReset:
+		if err := args.done(); err != nil {
+			return nil, err
+		}
+		if err := c.require(commands.CapabilityReset); err != nil {
+			return nil, err
+		}
+		s.state = factoryState(s.state.Serial)
+		return nil, nil
+	}
+	return nil, simError(commands.ErrorCodeInvalidCommand)
+}
+
+func (c *simContext) listObjects(args *simArgs) ([]byte, error) {
+	var id, domains uint16
+	var hasId, hasType, hasAlgorithm bool
+	var t uint8
+	var capabilities uint64
+	var algorithm commands.Algorithm
+	var label *string
+	for args.err == nil && len(args.data) > 0 {
+		switch args.uint8() {
+		case commands.ListObjectParamID:
+			id, hasId = args.uint16(), true
+		case commands.ListObjectParamType:
+			t, hasType = args.uint8(), true
+		case commands.ListObjectParamDomains:
+			domains = args.uint16()
+		case commands.ListObjectParamCapabilities:
+			capabilities = args.uint64()
+		case commands.ListObjectParamAlgorithm:
+			algorithm, hasAlgorithm = commands.Algorithm(args.uint8()), true
+		case commands.ListObjectParamLabel:
+			l := args.label()
+			label = &l
+		default:
+			return nil, simError(commands.ErrorCodeInvalidData)
+		}
+	}
+	if err := args.done(); err != nil {
+		return nil, err
+	}
+	var rsp []byte
+	for _, o := range c.state.Objects {
+		if o.Domains&c.authKey.Domains == 0 ||
+			(hasId && o.Id != id) || (hasType && o.Type != t) ||
+			(domains != 0 && o.Domains&domains == 0) ||
+			o.Capabilities&capabilities != capabilities ||
+			(hasAlgorithm && o.Algorithm != algorithm) ||
+			(label != nil && o.Label != *label) {
+			continue
+		}
+		rsp = binary.BigEndian.AppendUint16(rsp, o.Id)
+		rsp = append(rsp, o.Type, o.Sequence)
+	}
+	return rsp, nil
+}
+
+func (o *simObject) length() int {
+	switch o.Type {
+	case commands.ObjectTypeAuthenticationKey:
+		return 2 * scp03.KeyLength
+	case commands.ObjectTypeAsymmetricKey:
+		return ed25519.SeedSize
+	}
+	return len(o.Secret)
+}
+
+func (c *simContext) objectInfo(args *simArgs) ([]byte, error) {
+	id, t := args.uint16(), args.uint8()
+	if err := args.done(); err != nil {
+		return nil, err
+	}
+	o, err := c.object(id, t)
+	if err != nil {
+		return nil, err
+	}
+	return o.info(), nil
+}
+
+// Serializes the object's attributes, in the format of the get object
+// info response.
+func (o *simObject) info() []byte {
+	var label [commands.LabelLength]byte
+	copy(label[:], o.Label)
+	b := binary.BigEndian.AppendUint64(nil, o.Capabilities)
+	b = binary.BigEndian.AppendUint16(b, o.Id)
+	b = binary.BigEndian.AppendUint16(b, uint16(o.length()))
+	b = binary.BigEndian.AppendUint16(b, o.Domains)
+	b = append(b, o.Type, byte(o.Algorithm), o.Sequence, o.Origin)
+	b = append(b, label[:]...)
+	return binary.BigEndian.AppendUint64(b, o.Delegated)
+}
+
+// Parses attributes serialized by the info method.
+func parseSimObjectInfo(args *simArgs) *simObject {
+	o := simObject{Capabilities: args.uint64(), Id: args.uint16()}
+	args.uint16() // Length
+	o.Domains = args.uint16()
+	o.Type = args.uint8()
+	o.Algorithm = commands.Algorithm(args.uint8())
+	o.Sequence = args.uint8()
+	o.Origin = args.uint8()
+	o.Label = args.label()
+	o.Delegated = args.uint64()
+	return &o
+}
+
+func (c *simContext) getPubKey(args *simArgs) ([]byte, error) {
+	id := args.uint16()
+	if err := args.done(); err != nil {
+		return nil, err
+	}
+	o, err := c.object(id, commands.ObjectTypeAsymmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	pub := ed25519.NewKeyFromSeed(o.Secret).Public().(ed25519.PublicKey)
+	return append([]byte{byte(o.Algorithm)}, pub...), nil
+}
+
+func (c *simContext) signEddsa(args *simArgs) ([]byte, error) {
+	id := args.uint16()
+	if args.err != nil {
+		return nil, args.err
+	}
+	o, err := c.object(id, commands.ObjectTypeAsymmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.require(commands.CapabilityAsymmetricSignEddsa); err != nil {
+		return nil, err
+	}
+	if o.Capabilities&commands.CapabilityAsymmetricSignEddsa == 0 {
+		return nil, simError(commands.ErrorCodeInvalidPermission)
+	}
+	return ed25519.Sign(ed25519.NewKeyFromSeed(o.Secret), args.data), nil
+}
+
+func (c *simContext) generateAsymmetric(args *simArgs) ([]byte, error) {
+	o := simObject{
+		Id:           args.uint16(),
+		Type:         commands.ObjectTypeAsymmetricKey,
+		Label:        args.label(),
+		Domains:      args.uint16(),
+		Capabilities: args.uint64(),
+		Algorithm:    commands.Algorithm(args.uint8()),
+		Origin:       simOriginGenerated,
+	}
+	if err := args.done(); err != nil {
+		return nil, err
+	}
+	if err := c.require(commands.CapabilityAsymmetricGen); err != nil {
+		return nil, err
+	}
+	if o.Algorithm != commands.AlgorithmED25519 {
+		return nil, simError(commands.ErrorCodeInvalidData)
+	}
+	o.Secret = make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(o.Secret); err != nil {
+		return nil, err
+	}
+	if err := c.create(&o); err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint16(nil, o.Id), nil
+}
+
+func (c *simContext) putAuthKey(args *simArgs) ([]byte, error) {
+	o := simObject{
+		Id:           args.uint16(),
+		Type:         commands.ObjectTypeAuthenticationKey,
+		Label:        args.label(),
+		Domains:      args.uint16(),
+		Capabilities: args.uint64(),
+		Algorithm:    commands.Algorithm(args.uint8()),
+		Delegated:    args.uint64(),
+		Origin:       simOriginImported,
+		Secret:       bytes.Clone(args.next(2 * scp03.KeyLength)),
+	}
+	if err := args.done(); err != nil {
+		return nil, err
+	}
+	if err := c.require(commands.CapabilityPutAuthenticationKey); err != nil {
+		return nil, err
+	}
+	if o.Algorithm != commands.AlgorithmYubicoAESAuthentication {
+		return nil, simError(commands.ErrorCodeInvalidData)
+	}
+	if err := c.create(&o); err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint16(nil, o.Id), nil
+}
+
+// Replaces the secret of the session's own authentication key.
+func (c *simContext) changeAuthKey(args *simArgs) ([]byte, error) {
+	id := args.uint16()
+	algorithm := commands.Algorithm(args.uint8())
+	secret := bytes.Clone(args.next(2 * scp03.KeyLength))
+	if err := args.done(); err != nil {
+		return nil, err
+	}
+	if err := c.require(commands.CapabilityChangeAuthenticationKey); err != nil {
+		return nil, err
+	}
+	if id != c.authKey.Id {
+		return nil, simError(commands.ErrorCodeInvalidPermission)
+	}
+	if algorithm != commands.AlgorithmYubicoAESAuthentication {
+		return nil, simError(commands.ErrorCodeInvalidData)
+	}
+	c.authKey.Secret = secret
+	c.authKey.Origin = simOriginImported
+	return binary.BigEndian.AppendUint16(nil, id), nil
+}
+
+// Size of the wrap key for each supported algorithm.
+var simWrapKeySizes = map[commands.Algorithm]int{
+	commands.AlgorithmAES128CCMWrap: 16,
+	commands.AlgorithmAES192CCMWrap: 24,
+	commands.AlgorithmAES256CCMWrap: 32,
+}
+
+func (c *simContext) putWrapKey(args *simArgs) ([]byte, error) {
+	o := simObject{
+		Id:           args.uint16(),
+		Type:         commands.ObjectTypeWrapKey,
+		Label:        args.label(),
+		Domains:      args.uint16(),
+		Capabilities: args.uint64(),
+		Algorithm:    commands.Algorithm(args.uint8()),
+		Delegated:    args.uint64(),
+		Origin:       simOriginImported,
+	}
+	if args.err == nil && simWrapKeySizes[o.Algorithm] != len(args.data) {
+		return nil, simError(commands.ErrorCodeInvalidData)
+	}
+	o.Secret = bytes.Clone(args.data)
+	if err := c.require(commands.CapabilityPutWrapKey); err != nil {
+		return nil, err
+	}
+	if args.err != nil {
+		return nil, args.err
+	}
+	if err := c.create(&o); err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint16(nil, o.Id), nil
+}
+
+// Looks up a wrap key, and checks that it has the given capability.
+func (c *simContext) wrapKey(id uint16, capability uint64) (*simObject, error) {
+	if err := c.require(capability); err != nil {
+		return nil, err
+	}
+	wrapKey, err := c.object(id, commands.ObjectTypeWrapKey)
+	if err != nil {
+		return nil, err
+	}
+	if wrapKey.Capabilities&capability == 0 {
+		return nil, simError(commands.ErrorCodeInvalidPermission)
+	}
+	return wrapKey, nil
+}
+
+// The wrapped object is a random nonce, followed by the object's
+// attributes and key material, encrypted and authenticated with
+// AES-CCM.
+func (c *simContext) exportWrapped(args *simArgs) ([]byte, error) {
+	wrapKeyId, t, id := args.uint16(), args.uint8(), args.uint16()
+	// Optional format byte, ignored.
+	if len(args.data) == 1 {
+		args.uint8()
+	}
+	if err := args.done(); err != nil {
+		return nil, err
+	}
+	wrapKey, err := c.wrapKey(wrapKeyId, commands.CapabilityExportWrapped)
+	if err != nil {
+		return nil, err
+	}
+	o, err := c.object(id, t)
+	if err != nil {
+		return nil, err
+	}
+	if o.Capabilities&commands.CapabilityExportableUnderWrap == 0 ||
+		o.Capabilities&^wrapKey.Delegated != 0 {
+		return nil, simError(commands.ErrorCodeInvalidPermission)
+	}
+	nonce := make([]byte, wrapNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ciphertext, err := ccmSeal(wrapKey.Secret, nonce, append(o.info(), o.Secret...))
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ciphertext...), nil
+}
+
+func (c *simContext) importWrapped(args *simArgs) ([]byte, error) {
+	wrapKeyId, nonce := args.uint16(), args.next(wrapNonceSize)
+	if args.err != nil {
+		return nil, args.err
+	}
+	wrapKey, err := c.wrapKey(wrapKeyId, commands.CapabilityImportWrapped)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := ccmOpen(wrapKey.Secret, nonce, args.data)
+	if err != nil {
+		return nil, simError(commands.ErrorCodeInvalidData)
+	}
+	objectArgs := simArgs{data: plaintext}
+	o := parseSimObjectInfo(&objectArgs)
+	o.Secret = bytes.Clone(objectArgs.data)
+	if objectArgs.err != nil || len(o.Secret) != o.length() {
+		return nil, simError(commands.ErrorCodeInvalidData)
+	}
+	if o.Capabilities&^wrapKey.Delegated != 0 {
+		return nil, simError(commands.ErrorCodeInvalidPermission)
+	}
+	o.Origin |= simOriginImportedWrapped
+	if err := c.create(o); err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint16([]byte{o.Type}, o.Id), nil
+}
+
+// Capability needed to delete objects of each type.
+var simDeleteCapabilities = map[uint8]uint64{
+	commands.ObjectTypeOpaque:            commands.CapabilityDeleteOpaque,
+	commands.ObjectTypeAuthenticationKey: commands.CapabilityDeleteAuthKey,
+	commands.ObjectTypeAsymmetricKey:     commands.CapabilityDeleteAsymmetric,
+	commands.ObjectTypeWrapKey:           commands.CapabilityDeleteWrapKey,
+	commands.ObjectTypeHmacKey:           commands.CapabilityDeleteHmacKey,
+	commands.ObjectTypeTemplate:          commands.CapabilityDeleteTemplate,
+	commands.ObjectTypeOtpAeadKey:        commands.CapabilityDeleteOtpAeadKey,
+}
+
+func (c *simContext) deleteObject(args *simArgs) ([]byte, error) {
+	id, t := args.uint16(), args.uint8()
+	if err := args.done(); err != nil {
+		return nil, err
+	}
+	capability, ok := simDeleteCapabilities[t]
+	if !ok {
+		return nil, simError(commands.ErrorCodeInvalidData)
+	}
+	if err := c.require(capability); err != nil {
+		return nil, err
+	}
+	if _, err := c.object(id, t); err != nil {
+		return nil, err
+	}
+	i, _ := c.findObject(id, t)
+	c.state.Objects = append(c.state.Objects[:i], c.state.Objects[i+1:]...)
+	return nil, nil
+}
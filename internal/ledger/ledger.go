@@ -0,0 +1,306 @@
+// Package ledger maintains a record of where backup devices are
+// stored: YubiHSMs, and USB thumb drives or paper printouts holding
+// passphrases, sealed in tamper-evident bags at separate locations.
+// The ledger is a list of events, each signed by the operator who
+// recorded it, and linked to the previous event by its hash, so that
+// the ledger can be tracked in a git repository and checked by all
+// operators. Replaying the events detects inconsistencies, e.g., a
+// device in two places, or passphrases stored together with a
+// YubiHSM they are valid for.
+package ledger
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"sigsum.org/key-mgmt/internal/agent"
+)
+
+const (
+	// Namespace of SSHSIG signatures on events.
+	SignatureNamespace = "ledger@key-mgmt.sigsum.org"
+
+	// A bag is sealed at a location, with some devices inside.
+	EventSeal = "seal"
+	// A sealed bag is opened, and its devices taken out.
+	EventOpen = "open"
+	// A sealed bag is moved to another location.
+	EventMove = "move"
+	// Devices, not in any sealed bag, are taken out of use.
+	EventRetire = "retire"
+
+	// Device kinds.
+	KindYubiHSM = "yubihsm"
+	// A USB thumb drive or a printout holding passphrases.
+	KindSecrets = "secrets"
+)
+
+// A device involved in an event. For devices holding secrets,
+// Unlocks lists the names of the YubiHSMs the passphrases are valid
+// for; once recorded, it need not be repeated in later events.
+type Device struct {
+	Name    string   `json:"name"`
+	Kind    string   `json:"kind"`
+	Unlocks []string `json:"unlocks,omitempty"`
+}
+
+// A ledger event, stored as a single line of JSON. Previous is the
+// hex encoded SHA256 hash of the previous event, empty for the
+// first one. Operator is the OpenSSH public key of the operator who
+// recorded the event, and Signature is an armored SSHSIG signature,
+// by that key, of the event with an empty Signature field.
+type Event struct {
+	Seq       int       `json:"seq"`
+	Previous  string    `json:"previous,omitempty"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"event"`
+	Bag       string    `json:"bag,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	Devices   []Device  `json:"devices,omitempty"`
+	Notes     string    `json:"notes,omitempty"`
+	Operator  string    `json:"operator"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+func (e *Event) signedData() ([]byte, error) {
+	unsigned := *e
+	unsigned.Signature = ""
+	return json.Marshal(&unsigned)
+}
+
+func (e *Event) hash() (string, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// Returns the names of the event's devices.
+func (e *Event) DeviceNames() []string {
+	var names []string
+	for _, d := range e.Devices {
+		names = append(names, d.Name)
+	}
+	return names
+}
+
+// Returns the operator's public key, after checking the event's
+// signature.
+func (e *Event) verify() (ed25519.PublicKey, error) {
+	operator, err := agent.ParsePublicKey(e.Operator)
+	if err != nil {
+		return nil, fmt.Errorf("invalid operator key: %v", err)
+	}
+	data, err := e.signedData()
+	if err != nil {
+		return nil, err
+	}
+	pub, err := agent.VerifySSHSIG([]byte(e.Signature), SignatureNamespace, data)
+	if err != nil {
+		return nil, err
+	}
+	if !pub.Equal(operator) {
+		return nil, fmt.Errorf("signed by %s, not by the operator", agent.FormatPublicKey(pub))
+	}
+	return pub, nil
+}
+
+type Ledger struct {
+	Events []Event
+	state  *state
+}
+
+// Reads a ledger, and checks that the events are linked by their
+// hashes, and signed by their operators. If signers is non-nil, the
+// operators must also be listed there. If the file doesn't exist, an
+// empty ledger is returned. Inconsistencies are not errors, they are
+// reported by Check.
+func ReadFile(file string, signers []ed25519.PublicKey) (*Ledger, error) {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Ledger{state: newState()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l, err := Read(f, signers)
+	if err != nil {
+		return nil, fmt.Errorf("ledger %q: %v", file, err)
+	}
+	return l, nil
+}
+
+func Read(r io.Reader, signers []ed25519.PublicKey) (*Ledger, error) {
+	l := Ledger{state: newState()}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		var e Event
+		if err := decoder.Decode(&e); err != nil {
+			return nil, fmt.Errorf("line %d: invalid event: %v", n, err)
+		}
+		if err := l.link(&e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		pub, err := e.verify()
+		if err != nil {
+			return nil, fmt.Errorf("event %d: invalid signature: %v", e.Seq, err)
+		}
+		if signers != nil && !knownSigner(pub, signers) {
+			return nil, fmt.Errorf("event %d: recorded by unknown operator %s", e.Seq, e.Operator)
+		}
+		l.Events = append(l.Events, e)
+		l.state.apply(&e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func knownSigner(pub ed25519.PublicKey, signers []ed25519.PublicKey) bool {
+	for _, signer := range signers {
+		if pub.Equal(signer) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the event follows the last event of the ledger.
+func (l *Ledger) link(e *Event) error {
+	seq, previous := 1, ""
+	if n := len(l.Events); n > 0 {
+		last := &l.Events[n-1]
+		h, err := last.hash()
+		if err != nil {
+			return err
+		}
+		seq, previous = last.Seq+1, h
+		if e.Time.Before(last.Time) {
+			return fmt.Errorf("event %d: time %s is before the previous event", e.Seq, e.Time.Format(time.RFC3339))
+		}
+	}
+	if e.Seq != seq {
+		return fmt.Errorf("unexpected sequence number %d, expected %d", e.Seq, seq)
+	}
+	if e.Previous != previous {
+		return fmt.Errorf("event %d: hash of previous event doesn't match", e.Seq)
+	}
+	return nil
+}
+
+// Fills in the event's sequence number and hash of the previous
+// event.
+func (l *Ledger) prepare(e *Event) error {
+	e.Seq, e.Previous = 1, ""
+	if n := len(l.Events); n > 0 {
+		h, err := l.Events[n-1].hash()
+		if err != nil {
+			return err
+		}
+		e.Seq, e.Previous = l.Events[n-1].Seq+1, h
+	}
+	return l.link(e)
+}
+
+// Returns the inconsistencies that the event, if added, would
+// introduce.
+func (l *Ledger) CheckEvent(e *Event) error {
+	if err := l.prepare(e); err != nil {
+		return err
+	}
+	return l.state.clone().apply(e)
+}
+
+// Signs the event, as the next event of the ledger, and returns it
+// serialized, to be appended to the ledger file. The event is not
+// added to the ledger, and it is not checked for consistency.
+func (l *Ledger) Sign(e *Event, signer crypto.Signer) ([]byte, error) {
+	pub, ok := signer.Public().(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an Ed25519 key, type %T", signer.Public())
+	}
+	if err := l.prepare(e); err != nil {
+		return nil, err
+	}
+	e.Operator = agent.FormatPublicKey(pub)
+	e.Signature = ""
+	data, err := e.signedData()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := agent.SignSSHSIG(signer, SignatureNamespace, data)
+	if err != nil {
+		return nil, err
+	}
+	e.Signature = string(signature)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// Appends a signed event to the ledger file, creating the file if
+// needed.
+func AppendFile(file string, line []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Returns all inconsistencies, found when replaying the events, and
+// in the final state: devices taken out of an opened bag that have
+// been neither resealed nor retired.
+func (l *Ledger) Check() error {
+	return errors.Join(append(l.state.errs, l.state.unsealed()...)...)
+}
+
+// A device's current place: the sealed bag it is in, or else the
+// event where it was taken out of a bag, or retired.
+type Place struct {
+	Device   Device
+	Bag      string
+	Location string
+	Event    *Event
+	Retired  bool
+}
+
+// Returns the current place of each device, in order of first
+// appearance.
+func (l *Ledger) Places() []Place {
+	var places []Place
+	for _, name := range l.state.order {
+		d := l.state.devices[name]
+		p := Place{Device: d.Device, Bag: d.bag, Event: d.event, Retired: d.retired}
+		if b := l.state.bags[d.bag]; b != nil && len(d.bag) > 0 {
+			p.Location = b.location
+		}
+		places = append(places, p)
+	}
+	return places
+}
@@ -0,0 +1,222 @@
+package ledger
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"sigsum.org/key-mgmt/internal/agent"
+)
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+var testTime = time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+
+func testEvents() []Event {
+	return []Event{
+		{Time: testTime, Type: EventSeal, Bag: "A1", Location: "office",
+			Devices: []Device{{Name: "hsm-1", Kind: KindYubiHSM}}},
+		{Time: testTime.Add(time.Hour), Type: EventSeal, Bag: "B1", Location: "bank",
+			Devices: []Device{{Name: "usb-1", Kind: KindSecrets, Unlocks: []string{"hsm-1"}}}},
+		{Time: testTime.Add(2 * time.Hour), Type: EventMove, Bag: "A1", Location: "home"},
+	}
+}
+
+// Signs the events in order, and returns the lines of the ledger.
+func signEvents(t *testing.T, signer ed25519.PrivateKey, events []Event) []string {
+	t.Helper()
+	l := &Ledger{state: newState()}
+	var lines []string
+	for i := range events {
+		e := events[i]
+		line, err := l.Sign(&e, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+		l.Events = append(l.Events, e)
+	}
+	return lines
+}
+
+func readLines(lines []string, signers []ed25519.PublicKey) (*Ledger, error) {
+	return Read(strings.NewReader(strings.Join(lines, "")), signers)
+}
+
+// Modifies an event, keeping its Seq and Previous unless modified,
+// and signs it again.
+func resign(t *testing.T, signer ed25519.PrivateKey, line string, modify func(e *Event)) string {
+	t.Helper()
+	var e Event
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		t.Fatal(err)
+	}
+	modify(&e)
+	e.Signature = ""
+	data, err := e.signedData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := agent.SignSSHSIG(signer, SignatureNamespace, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Signature = string(signature)
+	out, err := json.Marshal(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out) + "\n"
+}
+
+func TestReadValid(t *testing.T) {
+	signer := newTestKey(t)
+	lines := signEvents(t, signer, testEvents())
+	l, err := readLines(lines, []ed25519.PublicKey{signer.Public().(ed25519.PublicKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Events) != 3 {
+		t.Fatalf("got %d events, expected 3", len(l.Events))
+	}
+	if err := l.Check(); err != nil {
+		t.Errorf("unexpected inconsistencies: %v", err)
+	}
+	places := l.Places()
+	if len(places) != 2 || places[0].Bag != "A1" || places[0].Location != "home" {
+		t.Errorf("unexpected places %+v", places)
+	}
+}
+
+// Checks that reordered, missing or modified events break the chain
+// of sequence numbers and hashes.
+func TestChainBreaks(t *testing.T) {
+	signer := newTestKey(t)
+	lines := signEvents(t, signer, testEvents())
+	for _, c := range []struct {
+		desc  string
+		lines []string
+		err   string
+	}{
+		{"missing first event", lines[1:], "unexpected sequence number 2, expected 1"},
+		{"missing event", []string{lines[0], lines[2]}, "unexpected sequence number 3, expected 2"},
+		{"reordered events", []string{lines[0], lines[2], lines[1]}, "unexpected sequence number 3, expected 2"},
+		{"duplicated event", []string{lines[0], lines[1], lines[1]}, "unexpected sequence number 2, expected 3"},
+		{"modified previous event", []string{
+			resign(t, signer, lines[0], func(e *Event) { e.Location = "elsewhere" }),
+			lines[1], lines[2]},
+			"event 2: hash of previous event doesn't match"},
+		{"modified sequence number", []string{
+			lines[0],
+			resign(t, signer, lines[1], func(e *Event) { e.Seq = 3 }),
+			lines[2]},
+			"unexpected sequence number 3, expected 2"},
+		{"time before previous event", []string{
+			lines[0],
+			resign(t, signer, lines[1], func(e *Event) { e.Time = testTime.Add(-time.Hour) }),
+			lines[2]},
+			"is before the previous event"},
+		{"unsigned modification", []string{
+			lines[0],
+			strings.Replace(lines[1], `"bank"`, `"office"`, 1),
+			lines[2]},
+			"event 2: invalid signature"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			_, err := readLines(c.lines, nil)
+			if err == nil {
+				t.Fatalf("ledger accepted")
+			}
+			if !strings.Contains(err.Error(), c.err) {
+				t.Errorf("unexpected error %q, expected %q", err, c.err)
+			}
+		})
+	}
+}
+
+func TestUnknownSigner(t *testing.T) {
+	lines := signEvents(t, newTestKey(t), testEvents())
+	other := newTestKey(t).Public().(ed25519.PublicKey)
+	if _, err := readLines(lines, []ed25519.PublicKey{other}); err == nil ||
+		!strings.Contains(err.Error(), "unknown operator") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestInconsistencies(t *testing.T) {
+	signer := newTestKey(t)
+	for _, c := range []struct {
+		desc   string
+		events []Event
+		err    string
+	}{
+		{"passphrases with device", []Event{
+			{Time: testTime, Type: EventSeal, Bag: "A1", Location: "office",
+				Devices: []Device{{Name: "hsm-1", Kind: KindYubiHSM}}},
+			{Time: testTime, Type: EventSeal, Bag: "B1", Location: "office",
+				Devices: []Device{{Name: "usb-1", Kind: KindSecrets, Unlocks: []string{"hsm-1"}}}},
+		}, "passphrases on usb-1, in bag B1, are stored together with YubiHSM hsm-1"},
+		{"device in two bags", []Event{
+			{Time: testTime, Type: EventSeal, Bag: "A1", Location: "office",
+				Devices: []Device{{Name: "hsm-1", Kind: KindYubiHSM}}},
+			{Time: testTime, Type: EventSeal, Bag: "A2", Location: "bank",
+				Devices: []Device{{Name: "hsm-1", Kind: KindYubiHSM}}},
+		}, "device hsm-1 is already in bag A1"},
+		{"not resealed", []Event{
+			{Time: testTime, Type: EventSeal, Bag: "A1", Location: "office",
+				Devices: []Device{{Name: "hsm-1", Kind: KindYubiHSM}}},
+			{Time: testTime, Type: EventOpen, Bag: "A1"},
+		}, "device hsm-1 was taken out of bag A1, in event 2, and not resealed"},
+		{"reused bag", []Event{
+			{Time: testTime, Type: EventSeal, Bag: "A1", Location: "office",
+				Devices: []Device{{Name: "hsm-1", Kind: KindYubiHSM}}},
+			{Time: testTime, Type: EventOpen, Bag: "A1"},
+			{Time: testTime, Type: EventSeal, Bag: "A1", Location: "office",
+				Devices: []Device{{Name: "hsm-1", Kind: KindYubiHSM}}},
+		}, "bag A1 was already used, in event 1"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			l, err := readLines(signEvents(t, signer, c.events), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = l.Check()
+			if err == nil {
+				t.Fatalf("inconsistency not detected")
+			}
+			if !strings.Contains(err.Error(), c.err) {
+				t.Errorf("unexpected error %q, expected %q", err, c.err)
+			}
+		})
+	}
+}
+
+// Checks that CheckEvent reports the inconsistencies of a new event,
+// without modifying the ledger.
+func TestCheckEvent(t *testing.T) {
+	signer := newTestKey(t)
+	l, err := readLines(signEvents(t, signer, testEvents()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Event{Time: testTime.Add(3 * time.Hour), Type: EventRetire,
+		Devices: []Device{{Name: "hsm-1", Kind: KindYubiHSM}}}
+	if err := l.CheckEvent(&e); err == nil || !strings.Contains(err.Error(), "still in sealed bag A1") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if e.Seq != 4 {
+		t.Errorf("unexpected sequence number %d", e.Seq)
+	}
+	if err := l.Check(); err != nil {
+		t.Errorf("ledger modified by CheckEvent: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+type bag struct {
+	location string
+	devices  []string
+	// False once the bag is opened.
+	sealed bool
+	// Sequence number of the seal event.
+	seq int
+}
+
+type device struct {
+	Device
+	// The sealed bag the device is in, or empty.
+	bag string
+	// The last event involving the device.
+	event   *Event
+	retired bool
+}
+
+// State of the ledger, after replaying events.
+type state struct {
+	bags    map[string]*bag
+	devices map[string]*device
+	// Device names, in order of first appearance.
+	order []string
+	// Inconsistencies found so far.
+	errs []error
+}
+
+func newState() *state {
+	return &state{bags: make(map[string]*bag), devices: make(map[string]*device)}
+}
+
+func (s *state) clone() *state {
+	c := newState()
+	for serial, b := range s.bags {
+		b := *b
+		c.bags[serial] = &b
+	}
+	for name, d := range s.devices {
+		d := *d
+		c.devices[name] = &d
+	}
+	c.order = slices.Clone(s.order)
+	c.errs = slices.Clone(s.errs)
+	return c
+}
+
+// Applies an event, and returns the inconsistencies it introduces.
+// The state is updated also if there are inconsistencies, so that
+// replay can continue.
+func (s *state) apply(e *Event) error {
+	var errs []error
+	report := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("event %d: %s", e.Seq, fmt.Sprintf(format, args...)))
+	}
+	switch e.Type {
+	case EventSeal:
+		if len(e.Bag) == 0 || len(e.Location) == 0 || len(e.Devices) == 0 {
+			report("seal requires a bag, a location and at least one device")
+			break
+		}
+		if b := s.bags[e.Bag]; b != nil {
+			report("bag %s was already used, in event %d", e.Bag, b.seq)
+		}
+		b := bag{location: e.Location, sealed: true, seq: e.Seq}
+		for _, ed := range e.Devices {
+			if slices.Contains(b.devices, ed.Name) {
+				report("device %s is listed more than once", ed.Name)
+				continue
+			}
+			d := s.register(ed, report)
+			if d.retired {
+				report("device %s was retired, in event %d", d.Name, d.event.Seq)
+			}
+			if len(d.bag) > 0 {
+				report("device %s is already in bag %s, at %s", d.Name, d.bag, s.bags[d.bag].location)
+			}
+			d.bag, d.event = e.Bag, e
+			b.devices = append(b.devices, d.Name)
+		}
+		s.bags[e.Bag] = &b
+		s.checkLocation(e.Bag, report)
+	case EventOpen:
+		b := s.sealedBag(e.Bag, report)
+		if b == nil {
+			break
+		}
+		b.sealed = false
+		for _, name := range b.devices {
+			if d := s.devices[name]; d.bag == e.Bag {
+				d.bag, d.event = "", e
+			}
+		}
+	case EventMove:
+		b := s.sealedBag(e.Bag, report)
+		if b == nil {
+			break
+		}
+		if len(e.Location) == 0 {
+			report("move requires a location")
+			break
+		}
+		b.location = e.Location
+		s.checkLocation(e.Bag, report)
+	case EventRetire:
+		if len(e.Devices) == 0 {
+			report("retire requires at least one device")
+		}
+		for _, ed := range e.Devices {
+			d := s.devices[ed.Name]
+			switch {
+			case d == nil:
+				report("unknown device %s", ed.Name)
+				continue
+			case d.retired:
+				report("device %s was already retired, in event %d", d.Name, d.event.Seq)
+			case len(d.bag) > 0:
+				report("device %s is still in sealed bag %s", d.Name, d.bag)
+			}
+			d.bag, d.event, d.retired = "", e, true
+		}
+	default:
+		report("unknown event type %q", e.Type)
+	}
+	s.errs = append(s.errs, errs...)
+	return errors.Join(errs...)
+}
+
+// Looks up a device, adding it if it is new, and merges the kind and
+// unlocked YubiHSMs recorded in the event.
+func (s *state) register(ed Device, report func(string, ...any)) *device {
+	switch {
+	case len(ed.Name) == 0:
+		report("device without a name")
+	case ed.Kind != KindYubiHSM && ed.Kind != KindSecrets:
+		report("device %s has invalid kind %q", ed.Name, ed.Kind)
+	case ed.Kind != KindSecrets && len(ed.Unlocks) > 0:
+		report("device %s is a %s, it can't hold passphrases", ed.Name, ed.Kind)
+	}
+	d := s.devices[ed.Name]
+	if d == nil {
+		d = &device{Device: Device{Name: ed.Name, Kind: ed.Kind}}
+		s.devices[ed.Name] = d
+		s.order = append(s.order, ed.Name)
+	} else if d.Kind != ed.Kind {
+		report("device %s is a %s, not a %s", ed.Name, d.Kind, ed.Kind)
+	}
+	for _, hsm := range ed.Unlocks {
+		if !slices.Contains(d.Unlocks, hsm) {
+			// Don't modify the slice in place, it may be shared with
+			// a cloned state.
+			d.Unlocks = append(slices.Clone(d.Unlocks), hsm)
+		}
+	}
+	return d
+}
+
+func (s *state) sealedBag(serial string, report func(string, ...any)) *bag {
+	b := s.bags[serial]
+	switch {
+	case len(serial) == 0:
+		report("no bag given")
+	case b == nil:
+		report("unknown bag %s", serial)
+	case !b.sealed:
+		report("bag %s is not sealed", serial)
+	default:
+		return b
+	}
+	return nil
+}
+
+// Reports passphrases stored at the same location as a YubiHSM they
+// are valid for, where at least one of them is in the given bag.
+func (s *state) checkLocation(serial string, report func(string, ...any)) {
+	location := s.bags[serial].location
+	for _, name := range s.order {
+		d := s.devices[name]
+		if len(d.bag) == 0 || s.bags[d.bag].location != location {
+			continue
+		}
+		for _, hsm := range d.Unlocks {
+			h := s.devices[hsm]
+			if h == nil || len(h.bag) == 0 || s.bags[h.bag].location != location {
+				continue
+			}
+			if d.bag != serial && h.bag != serial {
+				continue
+			}
+			report("passphrases on %s, in bag %s, are stored together with YubiHSM %s, in bag %s, at %s",
+				d.Name, d.bag, h.Name, h.bag, location)
+		}
+	}
+}
+
+// Returns an error for each device that was taken out of an opened
+// bag, and neither resealed nor retired.
+func (s *state) unsealed() []error {
+	var errs []error
+	for _, name := range s.order {
+		d := s.devices[name]
+		if len(d.bag) == 0 && !d.retired {
+			errs = append(errs, fmt.Errorf("device %s was taken out of bag %s, in event %d, and not resealed",
+				d.Name, d.event.Bag, d.event.Seq))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,163 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Lifecycle of signing keys, to support rotation: a successor key is
+// generated while the old key is still in use, both keys are valid
+// during an overlap period, and finally the old key is retired. The
+// lifecycle is kept in a separate JSON file, updated by the
+// generate-successor and retire-key commands, and a copy is included
+// in manifests.
+
+// Lifecycle of a single signing key. Times are nil when unknown or
+// not applicable. NotAfter is exclusive. Predecessor and Successor
+// are key ids, zero if there are none.
+type KeyLifecycle struct {
+	KeyId       uint16     `json:"key-id"`
+	PublicKey   string     `json:"public-key"`
+	Created     *time.Time `json:"created,omitempty"`
+	NotBefore   *time.Time `json:"not-before,omitempty"`
+	NotAfter    *time.Time `json:"not-after,omitempty"`
+	Retired     *time.Time `json:"retired,omitempty"`
+	Predecessor uint16     `json:"predecessor,omitempty"`
+	Successor   uint16     `json:"successor,omitempty"`
+}
+
+type Lifecycle struct {
+	Version int            `json:"version"`
+	Keys    []KeyLifecycle `json:"keys"`
+}
+
+// Parses a time, either as a date, YYYY-MM-DD, meaning midnight UTC,
+// or in RFC 3339 format.
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected YYYY-MM-DD or RFC 3339 format", s)
+	}
+	return t, nil
+}
+
+// Returns the entry for the given key id, or nil if there is none.
+func (l *Lifecycle) Key(id uint16) *KeyLifecycle {
+	for i := range l.Keys {
+		if l.Keys[i].KeyId == id {
+			return &l.Keys[i]
+		}
+	}
+	return nil
+}
+
+// Checks that ids are unique, that predecessor and successor
+// references are consistent, and that validity periods are not
+// empty.
+func (l *Lifecycle) Check() error {
+	return checkKeyLifecycle(l.Keys)
+}
+
+func checkKeyLifecycle(keys []KeyLifecycle) error {
+	var errs []error
+	ids := make(map[uint16]*KeyLifecycle)
+	for i := range keys {
+		k := &keys[i]
+		if ids[k.KeyId] != nil {
+			errs = append(errs, fmt.Errorf("key %d is listed more than once", k.KeyId))
+		}
+		ids[k.KeyId] = k
+		if k.NotBefore != nil && k.NotAfter != nil && !k.NotBefore.Before(*k.NotAfter) {
+			errs = append(errs, fmt.Errorf("key %d has an empty validity period", k.KeyId))
+		}
+	}
+	for _, k := range keys {
+		if k.Successor != 0 {
+			if s := ids[k.Successor]; s == nil || s.Predecessor != k.KeyId {
+				errs = append(errs, fmt.Errorf("key %d: successor %d doesn't list it as predecessor", k.KeyId, k.Successor))
+			}
+		}
+		if k.Predecessor != 0 {
+			if p := ids[k.Predecessor]; p == nil || p.Successor != k.KeyId {
+				errs = append(errs, fmt.Errorf("key %d: predecessor %d doesn't list it as successor", k.KeyId, k.Predecessor))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reads a lifecycle file. If the file doesn't exist, an empty
+// lifecycle is returned.
+func ReadLifecycleFile(file string) (*Lifecycle, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Lifecycle{Version: FormatVersion}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var l Lifecycle
+	if err := decoder.Decode(&l); err != nil {
+		return nil, fmt.Errorf("invalid lifecycle file %q: %v", file, err)
+	}
+	if l.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported lifecycle version %d", l.Version)
+	}
+	if err := l.Check(); err != nil {
+		return nil, fmt.Errorf("inconsistent lifecycle file %q: %v", file, err)
+	}
+	return &l, nil
+}
+
+// Writes a lifecycle file, replacing any existing file.
+func WriteLifecycleFile(file string, l *Lifecycle) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".new"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Checks the key lifecycle recorded in the manifest against the
+// manifest's objects: retired keys must be absent, and keys that are
+// present must have the recorded public key.
+func (m *Manifest) checkLifecycle() error {
+	errs := []error{checkKeyLifecycle(m.KeyLifecycle)}
+	for _, k := range m.KeyLifecycle {
+		o := m.Object("asymmetric-key", k.KeyId)
+		if k.Retired != nil {
+			if o != nil {
+				errs = append(errs, fmt.Errorf("retired key %d is present", k.KeyId))
+			}
+			continue
+		}
+		if o != nil && o.PublicKey != k.PublicKey {
+			errs = append(errs, fmt.Errorf("key %d has public key %s, lifecycle says %s", k.KeyId, o.PublicKey, k.PublicKey))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Records the lifecycle in the manifest, after checking it against
+// the manifest's objects.
+func (m *Manifest) SetLifecycle(l *Lifecycle) error {
+	m.KeyLifecycle = l.Keys
+	if err := m.checkLifecycle(); err != nil {
+		m.KeyLifecycle = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+// Package manifest implements a machine readable record of the
+// state of a YubiHSM after a provisioning step: the device serial
+// number, the objects on the device, and a transcript of test
+// signatures. Manifests are signed by the operator, using SSHSIG
+// signatures, and can be verified against a device later.
+package manifest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/certusone/yubihsm-go/commands"
+
+	"sigsum.org/key-mgmt/internal/agent"
+	"sigsum.org/key-mgmt/internal/hsm"
+	"sigsum.org/key-mgmt/internal/pubkey"
+)
+
+const (
+	FormatVersion = 1
+	// Namespace of SSHSIG signatures on manifests.
+	SignatureNamespace = "manifest@key-mgmt.sigsum.org"
+	// Message signed with each signing key, the same as used by
+	// the provisioning scripts.
+	TestMessage = "git.glasklar.is/sigsum/core/key-mgmt testonly"
+)
+
+type Manifest struct {
+	Version int `json:"version"`
+	// Name of the provisioning step, e.g., "keygen" or "backup".
+	Step           string          `json:"step"`
+	ToolVersion    string          `json:"tool-version"`
+	Date           time.Time       `json:"date"`
+	Device         Device          `json:"device"`
+	Objects        []Object        `json:"objects"`
+	TestSignatures []TestSignature `json:"test-signatures"`
+	// Lifecycle of signing keys, if recorded, see lifecycle.go.
+	KeyLifecycle []KeyLifecycle `json:"key-lifecycle,omitempty"`
+}
+
+type Device struct {
+	Serial   uint32 `json:"serial"`
+	Firmware string `json:"firmware"`
+}
+
+// An object on the device. Domains and capabilities are formatted as
+// by yubihsm-shell. Public keys are included for Ed25519 keys, both
+// in PEM format and hex encoded, as used by sigsum.
+type Object struct {
+	Id           uint16 `json:"id"`
+	Type         string `json:"type"`
+	Algorithm    uint8  `json:"algorithm"`
+	Label        string `json:"label"`
+	Domains      string `json:"domains"`
+	Capabilities string `json:"capabilities"`
+	Delegated    string `json:"delegated-capabilities,omitempty"`
+	PublicKeyPEM string `json:"public-key-pem,omitempty"`
+	PublicKey    string `json:"public-key,omitempty"`
+}
+
+// A signature on TestMessage by a signing key, hex encoded.
+type TestSignature struct {
+	KeyId     uint16 `json:"key-id"`
+	Message   string `json:"message"`
+	Signature string `json:"signature"`
+}
+
+// Returns the version of the running program, as recorded by the go
+// toolchain.
+func ToolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Path + " " + info.Main.Version
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			version += " " + s.Value
+		}
+	}
+	return version
+}
+
+func formatPublicKeyPEM(pub ed25519.PublicKey) (string, error) {
+	s, err := pubkey.Format(pub, pubkey.FormatPEM)
+	if err != nil {
+		return "", err
+	}
+	return s + "\n", nil
+}
+
+// Returns the public key of an object, if any.
+func (o *Object) Ed25519PublicKey() (ed25519.PublicKey, error) {
+	pub, err := hex.DecodeString(o.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("object %d has no valid Ed25519 public key", o.Id)
+	}
+	return pub, nil
+}
+
+func (o *Object) isSigningKey() bool {
+	return o.Type == hsm.FormatObjectType(commands.ObjectTypeAsymmetricKey) &&
+		o.Algorithm == uint8(commands.AlgorithmED25519)
+}
+
+// Looks up an object by type and id.
+func (m *Manifest) Object(objectType string, id uint16) *Object {
+	for i := range m.Objects {
+		if m.Objects[i].Type == objectType && m.Objects[i].Id == id {
+			return &m.Objects[i]
+		}
+	}
+	return nil
+}
+
+// Records the current state of the device. Each Ed25519 key with the
+// sign-eddsa capability is used to sign TestMessage.
+func Collect(device *hsm.Device, step string) (*Manifest, error) {
+	info, err := device.DeviceInfo()
+	if err != nil {
+		return nil, err
+	}
+	m := Manifest{
+		Version:     FormatVersion,
+		Step:        step,
+		ToolVersion: ToolVersion(),
+		Date:        time.Now().UTC().Truncate(time.Second),
+		Device: Device{
+			Serial:   info.SerialNumber,
+			Firmware: fmt.Sprintf("%d.%d.%d", info.MajorVersion, info.MinorVersion, info.BuildVersion),
+		},
+		Objects:        []Object{},
+		TestSignatures: []TestSignature{},
+	}
+	objects, err := device.ListObjects()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range objects {
+		o := Object{
+			Id:           info.Id,
+			Type:         hsm.FormatObjectType(info.Type),
+			Algorithm:    uint8(info.Algorithm),
+			Label:        info.Label,
+			Domains:      hsm.FormatDomains(info.Domains),
+			Capabilities: hsm.FormatCapabilities(info.Capabilities),
+		}
+		if info.Type == commands.ObjectTypeAuthenticationKey || info.Type == commands.ObjectTypeWrapKey {
+			o.Delegated = hsm.FormatCapabilities(info.Delegated)
+		}
+		if o.isSigningKey() {
+			pub, err := device.GetPublicKey(info.Id)
+			if err != nil {
+				return nil, err
+			}
+			o.PublicKey = hex.EncodeToString(pub)
+			if o.PublicKeyPEM, err = formatPublicKeyPEM(pub); err != nil {
+				return nil, err
+			}
+			if info.Capabilities&commands.CapabilityAsymmetricSignEddsa != 0 {
+				signature, err := device.SignEd25519(info.Id, []byte(TestMessage))
+				if err != nil {
+					return nil, fmt.Errorf("test signature with key %d failed: %v", info.Id, err)
+				}
+				if !ed25519.Verify(pub, []byte(TestMessage), signature) {
+					return nil, fmt.Errorf("invalid test signature from key %d", info.Id)
+				}
+				m.TestSignatures = append(m.TestSignatures, TestSignature{
+					KeyId:     info.Id,
+					Message:   TestMessage,
+					Signature: hex.EncodeToString(signature),
+				})
+			}
+		}
+		m.Objects = append(m.Objects, o)
+	}
+	return &m, nil
+}
+
+// Serializes the manifest as indented JSON.
+func (m *Manifest) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func Parse(data []byte) (*Manifest, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var m Manifest
+	if err := decoder.Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if m.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// Signs the serialized manifest, returning an armored SSHSIG
+// signature.
+func Sign(data []byte, signer crypto.Signer) ([]byte, error) {
+	return agent.SignSSHSIG(signer, SignatureNamespace, data)
+}
+
+// Checks that the serialized manifest is signed by one of the
+// given keys, and returns the signer's key.
+func VerifySignature(data, signature []byte, signers []ed25519.PublicKey) (ed25519.PublicKey, error) {
+	pub, err := agent.VerifySSHSIG(signature, SignatureNamespace, data)
+	if err != nil {
+		return nil, err
+	}
+	for _, signer := range signers {
+		if pub.Equal(signer) {
+			return pub, nil
+		}
+	}
+	return nil, fmt.Errorf("manifest signed by unknown key %s", agent.FormatPublicKey(pub))
+}
+
+// Compares two lists of objects, and returns a description of each
+// difference.
+func DiffObjects(expected, got []Object) []string {
+	var diffs []string
+	find := func(objects []Object, o *Object) *Object {
+		for i := range objects {
+			if objects[i].Type == o.Type && objects[i].Id == o.Id {
+				return &objects[i]
+			}
+		}
+		return nil
+	}
+	for i := range expected {
+		e := &expected[i]
+		g := find(got, e)
+		if g == nil {
+			diffs = append(diffs, fmt.Sprintf("missing %s %d (%q)", e.Type, e.Id, e.Label))
+			continue
+		}
+		field := func(name, expected, got string) {
+			if expected != got {
+				diffs = append(diffs, fmt.Sprintf("%s %d: %s is %q, expected %q", e.Type, e.Id, name, got, expected))
+			}
+		}
+		field("algorithm", fmt.Sprint(e.Algorithm), fmt.Sprint(g.Algorithm))
+		field("label", e.Label, g.Label)
+		field("domains", e.Domains, g.Domains)
+		field("capabilities", e.Capabilities, g.Capabilities)
+		field("delegated capabilities", e.Delegated, g.Delegated)
+		field("public key", e.PublicKey, g.PublicKey)
+	}
+	for i := range got {
+		if g := &got[i]; find(expected, g) == nil {
+			diffs = append(diffs, fmt.Sprintf("unexpected %s %d (%q)", g.Type, g.Id, g.Label))
+		}
+	}
+	return diffs
+}
+
+// Checks that the test signatures are valid, and made by signing keys
+// listed in the manifest.
+func (m *Manifest) checkTestSignatures() error {
+	var errs []error
+	for _, t := range m.TestSignatures {
+		o := m.Object(hsm.FormatObjectType(commands.ObjectTypeAsymmetricKey), t.KeyId)
+		if o == nil {
+			errs = append(errs, fmt.Errorf("test signature by unknown key %d", t.KeyId))
+			continue
+		}
+		pub, err := o.Ed25519PublicKey()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		signature, err := hex.DecodeString(t.Signature)
+		if err != nil || !ed25519.Verify(pub, []byte(t.Message), signature) {
+			errs = append(errs, fmt.Errorf("invalid test signature by key %d", t.KeyId))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Checks that the device matches the manifest: Same serial number,
+// and the same objects, with the same attributes and public keys.
+// The test signatures in the manifest must be valid, and signing
+// TestMessage again must give the same signatures.
+func (m *Manifest) Verify(device *hsm.Device) error {
+	if err := m.checkTestSignatures(); err != nil {
+		return err
+	}
+	if err := m.checkLifecycle(); err != nil {
+		return err
+	}
+	current, err := Collect(device, m.Step)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if current.Device.Serial != m.Device.Serial {
+		errs = append(errs, fmt.Errorf("device serial is %d, expected %d", current.Device.Serial, m.Device.Serial))
+	}
+	for _, diff := range DiffObjects(m.Objects, current.Objects) {
+		errs = append(errs, errors.New(diff))
+	}
+	for _, t := range m.TestSignatures {
+		found := false
+		for _, c := range current.TestSignatures {
+			if c.KeyId == t.KeyId && c.Message == t.Message {
+				found = true
+				if c.Signature != t.Signature {
+					errs = append(errs, fmt.Errorf("test signature by key %d differs", t.KeyId))
+				}
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("no test signature by key %d", t.KeyId))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reports if the factory default authentication key, which should be
+// deleted during provisioning, is still present.
+func (m *Manifest) HasDefaultAuthKey() bool {
+	return m.Object(hsm.FormatObjectType(commands.ObjectTypeAuthenticationKey), 1) != nil
+}
+
+// Compares devices that should be replicas of each other, e.g., the
+// backup devices, and returns a description of each difference. If
+// a reference manifest is provided, each device is compared to it,
+// otherwise, devices are compared to the first one.
+func CompareReplicas(replicas []*Manifest, reference *Manifest) []string {
+	var diffs []string
+	for i, r := range replicas {
+		report := func(msg string) {
+			diffs = append(diffs, fmt.Sprintf("serial %d: %s", r.Device.Serial, msg))
+		}
+		for _, other := range replicas[:i] {
+			if other.Device.Serial == r.Device.Serial {
+				report("the same device is listed more than once")
+			}
+		}
+		if r.HasDefaultAuthKey() {
+			report("the default authentication key 1 is present")
+		}
+		if reference != nil {
+			for _, diff := range DiffObjects(reference.Objects, r.Objects) {
+				report(diff)
+			}
+		} else if i > 0 {
+			for _, diff := range DiffObjects(replicas[0].Objects, r.Objects) {
+				report(fmt.Sprintf("compared to serial %d: %s", replicas[0].Device.Serial, diff))
+			}
+		}
+	}
+	return diffs
+}
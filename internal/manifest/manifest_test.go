@@ -0,0 +1,225 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sigsum.org/key-mgmt/internal/agent"
+)
+
+// Test vectors, signed with "ssh-keygen -Y sign", and checked with
+// "ssh-keygen -Y verify".
+const (
+	vectorSigner = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOqPQIJB/jxynAr6Exh5I7ZR2AmVefnPB14x+BlwLadB operator"
+
+	vectorManifest = `{
+  "version": 1,
+  "step": "keygen",
+  "tool-version": "v0.2.0",
+  "date": "2026-01-02T10:00:00Z",
+  "device": {
+    "serial": 1000000,
+    "firmware": "2.4.0"
+  },
+  "objects": [
+    {
+      "id": 100,
+      "type": "authentication-key",
+      "algorithm": 38,
+      "label": "Backup authentication",
+      "domains": "all",
+      "capabilities": "all"
+    }
+  ],
+  "test-signatures": []
+}
+`
+	// ssh-keygen -Y sign -n manifest@key-mgmt.sigsum.org
+	vectorSignature = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAg6o9AgkH+PHKcCvoTGHkjtlHYCZ
+V5+c8HXjH4GXAtp0EAAAAcbWFuaWZlc3RAa2V5LW1nbXQuc2lnc3VtLm9yZwAAAAAAAAAG
+c2hhNTEyAAAAUwAAAAtzc2gtZWQyNTUxOQAAAEBtVYcdoOgWbPSH9Ct+VG4FHH2DKduz46
+SYjSPY+M5V3rzT0r/KIFddTo83R7trcozHHruXZq+30dk9gaoMwhwN
+-----END SSH SIGNATURE-----
+`
+	// ssh-keygen -Y sign -n transcript@key-mgmt.sigsum.org
+	vectorTranscriptSignature = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAg6o9AgkH+PHKcCvoTGHkjtlHYCZ
+V5+c8HXjH4GXAtp0EAAAAedHJhbnNjcmlwdEBrZXktbWdtdC5zaWdzdW0ub3JnAAAAAAAA
+AAZzaGE1MTIAAABTAAAAC3NzaC1lZDI1NTE5AAAAQDQiIr6iigkaFyO9sFC7wnKfr2/qzM
+nFKgEYQlcf/GCXGie/f9jFbGAaTEnuptTmKceBpJxXNcmCFlQUb1qYVQ4=
+-----END SSH SIGNATURE-----
+`
+	// ssh-keygen -Y sign -n manifest@key-mgmt.sigsum.org -O hashalg=sha256
+	vectorSHA256Signature = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAg6o9AgkH+PHKcCvoTGHkjtlHYCZ
+V5+c8HXjH4GXAtp0EAAAAcbWFuaWZlc3RAa2V5LW1nbXQuc2lnc3VtLm9yZwAAAAAAAAAG
+c2hhMjU2AAAAUwAAAAtzc2gtZWQyNTUxOQAAAEBQGQ4J0PkI5cJjcKTvJVRJ5J2FMesMnD
+FyKAvJo5f5p+z0slBMgZggKYGvIea2WHORAt3dGS8MApeeknvVZJYN
+-----END SSH SIGNATURE-----
+`
+)
+
+func vectorKey(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+	pub, err := agent.ParsePublicKey(vectorSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func TestVerifySignatureVectors(t *testing.T) {
+	signer := vectorKey(t)
+	other := newTestKey(t).Public().(ed25519.PublicKey)
+
+	pub, err := VerifySignature([]byte(vectorManifest), []byte(vectorSignature), []ed25519.PublicKey{other, signer})
+	if err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if !pub.Equal(signer) {
+		t.Errorf("unexpected signer %s", agent.FormatPublicKey(pub))
+	}
+
+	for _, c := range []struct {
+		desc      string
+		data      string
+		signature string
+		signers   []ed25519.PublicKey
+		err       string
+	}{
+		{"unknown signer", vectorManifest, vectorSignature, []ed25519.PublicKey{other}, "signed by unknown key"},
+		{"modified manifest", strings.Replace(vectorManifest, "keygen", "backup", 1), vectorSignature,
+			[]ed25519.PublicKey{signer}, "invalid signature"},
+		{"wrong namespace", vectorManifest, vectorTranscriptSignature, []ed25519.PublicKey{signer},
+			"unexpected signature namespace"},
+		{"sha256", vectorManifest, vectorSHA256Signature, []ed25519.PublicKey{signer},
+			"unsupported signature hash algorithm"},
+		{"not armored", vectorManifest, "", []ed25519.PublicKey{signer}, "not an armored ssh signature"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			_, err := VerifySignature([]byte(c.data), []byte(c.signature), c.signers)
+			if err == nil {
+				t.Fatalf("signature accepted")
+			}
+			if !strings.Contains(err.Error(), c.err) {
+				t.Errorf("unexpected error %q, expected %q", err, c.err)
+			}
+		})
+	}
+}
+
+func TestVerifyTranscriptSignatureVectors(t *testing.T) {
+	signer := vectorKey(t)
+	signatures := []byte(vectorTranscriptSignature)
+	cosigners, err := VerifyTranscriptSignatures([]byte(vectorManifest), signatures, []ed25519.PublicKey{signer})
+	if err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if len(cosigners) != 1 || !cosigners[0].Equal(signer) {
+		t.Errorf("unexpected cosigners")
+	}
+	twice := append(bytes.Clone(signatures), signatures...)
+	if _, err := VerifyTranscriptSignatures([]byte(vectorManifest), twice, nil); err == nil ||
+		!strings.Contains(err.Error(), "signed more than once") {
+		t.Errorf("unexpected error for repeated signature: %v", err)
+	}
+	if _, err := VerifyTranscriptSignatures([]byte(vectorManifest), []byte(vectorSignature), nil); err == nil {
+		t.Errorf("manifest signature accepted as transcript signature")
+	}
+}
+
+// Checks that signatures made by Sign are accepted by
+// "ssh-keygen -Y verify".
+func TestSignSSHKeygen(t *testing.T) {
+	sshKeygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen not available")
+	}
+	priv := newTestKey(t)
+	signature, err := Sign([]byte(vectorManifest), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifySignature([]byte(vectorManifest), signature,
+		[]ed25519.PublicKey{priv.Public().(ed25519.PublicKey)}); err != nil {
+		t.Fatalf("own signature rejected: %v", err)
+	}
+
+	dir := t.TempDir()
+	allowed := filepath.Join(dir, "allowed")
+	sigFile := filepath.Join(dir, "manifest.sig")
+	if err := os.WriteFile(allowed, []byte("operator "+agent.FormatPublicKey(priv.Public().(ed25519.PublicKey))+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sigFile, signature, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(sshKeygen, "-Y", "verify", "-f", allowed, "-I", "operator",
+		"-n", SignatureNamespace, "-s", sigFile)
+	cmd.Stdin = strings.NewReader(vectorManifest)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("ssh-keygen -Y verify failed: %v, output: %s", err, out)
+	}
+}
+
+func TestParse(t *testing.T) {
+	m, err := Parse([]byte(vectorManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Step != "keygen" || m.Device.Serial != 1000000 || len(m.Objects) != 1 {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != vectorManifest {
+		t.Errorf("unexpected marshalled manifest:\n%s", data)
+	}
+	for _, c := range []struct{ desc, old, new string }{
+		{"unknown field", `"step"`, `"unknown": 1, "step"`},
+		{"unsupported version", `"version": 1`, `"version": 2`},
+	} {
+		if _, err := Parse([]byte(strings.Replace(vectorManifest, c.old, c.new, 1))); err == nil {
+			t.Errorf("%s: manifest accepted", c.desc)
+		}
+	}
+}
+
+func TestDiffObjects(t *testing.T) {
+	expected := []Object{
+		{Id: 100, Type: "authentication-key", Label: "Backup authentication", Domains: "all"},
+		{Id: 500, Type: "asymmetric-key", Label: "Log server signing key", Domains: "10"},
+	}
+	if diffs := DiffObjects(expected, expected); len(diffs) != 0 {
+		t.Errorf("unexpected differences %q", diffs)
+	}
+	got := []Object{
+		{Id: 500, Type: "asymmetric-key", Label: "Log server signing key", Domains: "11"},
+		{Id: 600, Type: "asymmetric-key", Label: "Witness signing key", Domains: "11"},
+	}
+	want := []string{
+		`missing authentication-key 100 ("Backup authentication")`,
+		`asymmetric-key 500: domains is "11", expected "10"`,
+		`unexpected asymmetric-key 600 ("Witness signing key")`,
+	}
+	if diffs := DiffObjects(expected, got); strings.Join(diffs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected differences %q, expected %q", diffs, want)
+	}
+}
@@ -0,0 +1,170 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/certusone/yubihsm-go/commands"
+
+	"sigsum.org/key-mgmt/internal/agent"
+	"sigsum.org/key-mgmt/internal/hsm"
+)
+
+// A transcript of a key ceremony: the manifest of each provisioning
+// step, in order, with the device serial number, the public keys,
+// and test signatures on TestMessage. The transcript is co-signed by
+// each operator witnessing the ceremony; the armored SSHSIG
+// signatures are kept in a separate file, with ".sig" appended to
+// the name, one after the other.
+
+// Namespace of SSHSIG co-signatures on transcripts.
+const TranscriptNamespace = "transcript@key-mgmt.sigsum.org"
+
+type Transcript struct {
+	Version int `json:"version"`
+	// Free-form description, e.g., the date and place of the
+	// ceremony.
+	Ceremony string     `json:"ceremony,omitempty"`
+	Steps    []Manifest `json:"steps"`
+}
+
+// Reads a transcript file. If the file doesn't exist, an empty
+// transcript is returned.
+func ReadTranscriptFile(file string) (*Transcript, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Transcript{Version: FormatVersion, Steps: []Manifest{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t, err := ParseTranscript(data)
+	if err != nil {
+		return nil, fmt.Errorf("transcript %q: %v", file, err)
+	}
+	return t, nil
+}
+
+func ParseTranscript(data []byte) (*Transcript, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var t Transcript
+	if err := decoder.Decode(&t); err != nil {
+		return nil, fmt.Errorf("invalid transcript: %v", err)
+	}
+	if t.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported transcript version %d", t.Version)
+	}
+	return &t, nil
+}
+
+// Serializes the transcript as indented JSON.
+func (t *Transcript) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Writes a transcript file, replacing any existing file.
+func WriteTranscriptFile(file string, t *Transcript) error {
+	data, err := t.Marshal()
+	if err != nil {
+		return err
+	}
+	tmp := file + ".new"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Checks that the test signatures of each step are valid signatures
+// on TestMessage, and that a signing key with a given id has the
+// same public key in all steps, e.g., the log server's key on the
+// backups and on the signing oracles.
+func (t *Transcript) Check() error {
+	var errs []error
+	keys := make(map[uint16]*Object)
+	keyType := hsm.FormatObjectType(commands.ObjectTypeAsymmetricKey)
+	for i := range t.Steps {
+		m := &t.Steps[i]
+		report := func(err error) {
+			errs = append(errs, fmt.Errorf("step %d (%s, serial %d): %v", i+1, m.Step, m.Device.Serial, err))
+		}
+		if err := m.checkTestSignatures(); err != nil {
+			report(err)
+		}
+		for _, s := range m.TestSignatures {
+			if s.Message != TestMessage {
+				report(fmt.Errorf("test signature by key %d on unexpected message %q", s.KeyId, s.Message))
+			}
+		}
+		for j := range m.Objects {
+			o := &m.Objects[j]
+			if o.Type != keyType || len(o.PublicKey) == 0 {
+				continue
+			}
+			if first, ok := keys[o.Id]; !ok {
+				keys[o.Id] = o
+			} else if first.PublicKey != o.PublicKey {
+				report(fmt.Errorf("key %d has public key %s, but %s in an earlier step",
+					o.Id, o.PublicKey, first.PublicKey))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Co-signs the serialized transcript, returning an armored SSHSIG
+// signature.
+func SignTranscript(data []byte, signer crypto.Signer) ([]byte, error) {
+	return agent.SignSSHSIG(signer, TranscriptNamespace, data)
+}
+
+// Checks the co-signatures on the serialized transcript, a sequence
+// of armored SSHSIG signatures. Each signature must be valid, and,
+// if signers is non-nil, made by one of the signers. No operator may
+// sign twice. Returns the keys of the operators who co-signed, in
+// order.
+func VerifyTranscriptSignatures(data, signatures []byte, signers []ed25519.PublicKey) ([]ed25519.PublicKey, error) {
+	var cosigners []ed25519.PublicKey
+	for n := 1; ; n++ {
+		var block *pem.Block
+		block, signatures = pem.Decode(signatures)
+		if block == nil {
+			break
+		}
+		pub, err := agent.VerifySSHSIG(pem.EncodeToMemory(block), TranscriptNamespace, data)
+		if err != nil {
+			return nil, fmt.Errorf("signature %d: %v", n, err)
+		}
+		if signers != nil && !containsKey(signers, pub) {
+			return nil, fmt.Errorf("signature %d: signed by unknown key %s", n, agent.FormatPublicKey(pub))
+		}
+		if containsKey(cosigners, pub) {
+			return nil, fmt.Errorf("signature %d: %s signed more than once", n, agent.FormatPublicKey(pub))
+		}
+		cosigners = append(cosigners, pub)
+	}
+	if len(bytes.TrimSpace(signatures)) > 0 {
+		return nil, fmt.Errorf("invalid data after signature %d", len(cosigners))
+	}
+	return cosigners, nil
+}
+
+func containsKey(keys []ed25519.PublicKey, pub ed25519.PublicKey) bool {
+	for _, k := range keys {
+		if k.Equal(pub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package paper
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// A printable document with items. Fields that are empty are printed
+// as blanks, to be filled in by hand.
+type Document struct {
+	Title        string
+	Date         string
+	DeviceSerial string
+	BagSerial    string
+	ToolVersion  string
+	Items        []*Item
+}
+
+// Width of the QR code's quiet zone, in modules.
+const quietZone = 4
+
+func field(value string) string {
+	if len(value) == 0 {
+		return "____________________"
+	}
+	return value
+}
+
+func (d *Document) fields() [][2]string {
+	return [][2]string{
+		{"Date", field(d.Date)},
+		{"YubiHSM serial", field(d.DeviceSerial)},
+		{"Tamper-evident bag serial", field(d.BagSerial)},
+		{"Sealed by", field("")},
+		{"Tool version", field(d.ToolVersion)},
+	}
+}
+
+const instructions = `To restore, run "sigsum-hsm paper-import", and type the header line and
+the numbered lines of each item, followed by an empty line. Each line has a
+checksum; lines that are damaged or mistyped are skipped, and any set of
+lines as large as the number of data lines recovers the item. Alternatively,
+feed it the data decoded from the item's QR code.`
+
+// An item, with its text encoding, the number of lines needed to
+// recover it, and a QR code of the compact encoding, nil if the item
+// is too large.
+type renderedItem struct {
+	*Item
+	lines  []string
+	needed int
+	code   *qr.Code
+}
+
+func (d *Document) render() ([]renderedItem, error) {
+	var items []renderedItem
+	for _, item := range d.Items {
+		lines, needed, err := item.Lines()
+		if err != nil {
+			return nil, err
+		}
+		compact, err := item.Compact()
+		if err != nil {
+			return nil, err
+		}
+		// Only fails if there's too much data.
+		code, _ := qr.Encode(compact, qr.M)
+		items = append(items, renderedItem{Item: item, lines: lines, needed: needed, code: code})
+	}
+	return items, nil
+}
+
+func (item *renderedItem) description(i, n int) string {
+	return fmt.Sprintf("Item %d of %d: %s (%s, %d bytes), any %d of the %d numbered lines suffice",
+		i+1, n, item.Name, item.Type, len(item.Data), item.needed, len(item.lines)-1)
+}
+
+// Writes the document as plain text, with QR codes drawn using
+// Unicode block characters, two rows of modules per line.
+func (d *Document) WriteText(w io.Writer) error {
+	items, err := d.render()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n\n", d.Title, strings.Repeat("=", len(d.Title)))
+	for _, f := range d.fields() {
+		fmt.Fprintf(&b, "%-27s %s\n", f[0]+":", f[1])
+	}
+	fmt.Fprintf(&b, "\n%s\n", instructions)
+	for i, item := range items {
+		fmt.Fprintf(&b, "\n\f\n%s\n\n", item.description(i, len(items)))
+		for _, line := range item.lines {
+			fmt.Fprintf(&b, "    %s\n", line)
+		}
+		code := item.code
+		if code == nil {
+			continue
+		}
+		b.WriteString("\n")
+		for y := -quietZone; y < code.Size+quietZone; y += 2 {
+			b.WriteString("    ")
+			for x := -quietZone; x < code.Size+quietZone; x++ {
+				switch top, bottom := code.Black(x, y), code.Black(x, y+1); {
+				case top && bottom:
+					b.WriteString("█")
+				case top:
+					b.WriteString("▀")
+				case bottom:
+					b.WriteString("▄")
+				default:
+					b.WriteString(" ")
+				}
+			}
+			b.WriteString("\n")
+		}
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// Writes the document as a self-contained HTML page, for printing
+// from a browser, with one item per page and QR codes as inline SVG.
+func (d *Document) WriteHTML(w io.Writer) error {
+	items, err := d.render()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: sans-serif; }
+pre { font-size: 14pt; }
+td { padding: 0.3em 1em 0.3em 0; }
+.item { break-before: page; }
+svg { width: 6cm; height: 6cm; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<table>
+`, html.EscapeString(d.Title), html.EscapeString(d.Title))
+	for _, f := range d.fields() {
+		fmt.Fprintf(&b, "<tr><td>%s:</td><td>%s</td></tr>\n", html.EscapeString(f[0]), html.EscapeString(f[1]))
+	}
+	fmt.Fprintf(&b, "</table>\n<p>%s</p>\n", html.EscapeString(instructions))
+	for i, item := range items {
+		fmt.Fprintf(&b, "<div class=\"item\">\n<h2>%s</h2>\n<pre>\n", html.EscapeString(item.description(i, len(items))))
+		for _, line := range item.lines {
+			fmt.Fprintf(&b, "%s\n", html.EscapeString(line))
+		}
+		b.WriteString("</pre>\n")
+		code := item.code
+		if code == nil {
+			b.WriteString("</div>\n")
+			continue
+		}
+		size := code.Size + 2*quietZone
+		fmt.Fprintf(&b, "<svg xmlns=\"http://www.w3.org/2000/svg\" viewBox=\"0 0 %d %d\" shape-rendering=\"crispEdges\">\n", size, size)
+		fmt.Fprintf(&b, "<rect width=\"%d\" height=\"%d\" fill=\"#fff\"/>\n<path fill=\"#000\" d=\"", size, size)
+		for y := 0; y < code.Size; y++ {
+			for x := 0; x < code.Size; x++ {
+				if code.Black(x, y) {
+					fmt.Fprintf(&b, "M%d,%dh1v1h-1z", x+quietZone, y+quietZone)
+				}
+			}
+		}
+		b.WriteString("\"/>\n</svg>\n</div>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	_, err = io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,317 @@
+// Package paper implements a text encoding of secrets, e.g.,
+// passphrases and wrapped keys, for backup on paper. Each item is
+// printed as a header line followed by numbered lines, each with a
+// checksum to detect transcription errors. The lines form an erasure
+// code: any sufficiently large subset of the lines recovers the item,
+// so that damaged or mistyped lines can be skipped. Each item can also
+// be printed as a QR code, with a more compact encoding.
+package paper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"sigsum.org/key-mgmt/internal/shamir"
+)
+
+// Text encoding of an item:
+//
+//	sigsum-paper-1 NAME TYPE SIZE CHECKSUM
+//	NN XXXX XXXX XXXX XXXX CCCC
+//	...
+//
+// SIZE is the size of the item's data, in bytes, and CHECKSUM is a
+// 32-bit hash, hex encoded, of the name, type and data. The data,
+// padded with zeros, is split into data lines of lineSize bytes,
+// numbered from 1, followed by about half as many parity lines. The
+// lines are points of polynomials over GF(2^8), as in Shamir's secret
+// sharing, so that any set of lines as large as the number of data
+// lines recovers the data. Each line is encoded in base32, using
+// Crockford's alphabet, and CCCC is a 16-bit hash, hex encoded, of
+// the item's checksum, line number and line contents.
+//
+// In the compact encoding, used for QR codes, the header line is
+// instead followed by a single line with the data in base32.
+
+const (
+	tag      = "sigsum-paper-1"
+	lineSize = 10
+	// At most 255 lines, with at least a third of them parity lines.
+	MaxSize = 170 * lineSize
+
+	TypePassphrase = "passphrase"
+	TypeWrapped    = "wrapped"
+	TypePublicKey  = "public-key"
+)
+
+var encoding = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+type Item struct {
+	Name string
+	Type string
+	Data []byte
+}
+
+func hash32(data ...[]byte) uint32 {
+	h := sha256.Sum256(bytes.Join(data, nil))
+	return binary.BigEndian.Uint32(h[:4])
+}
+
+func (item *Item) checksum() uint32 {
+	return hash32([]byte("sigsum paper backup"), []byte(item.Name), []byte{0}, []byte(item.Type), []byte{0}, item.Data)
+}
+
+func lineChecksum(checksum uint32, number int, line []byte) uint16 {
+	return uint16(hash32(binary.BigEndian.AppendUint32(nil, checksum), []byte{byte(number)}, line) >> 16)
+}
+
+// Returns the number of data and parity lines for an item of the
+// given size.
+func lineCount(size int) (int, int) {
+	data := (size + lineSize - 1) / lineSize
+	return data, (data + 1) / 2
+}
+
+func (item *Item) check() error {
+	if len(item.Name) == 0 || strings.ContainsAny(item.Name, " \t\r\n") {
+		return fmt.Errorf("invalid item name %q", item.Name)
+	}
+	switch item.Type {
+	case TypePassphrase, TypeWrapped, TypePublicKey:
+	default:
+		return fmt.Errorf("invalid item type %q", item.Type)
+	}
+	if len(item.Data) == 0 || len(item.Data) > MaxSize {
+		return fmt.Errorf("invalid size of item %q, %d bytes", item.Name, len(item.Data))
+	}
+	return nil
+}
+
+func (item *Item) header() string {
+	return fmt.Sprintf("%s %s %s %d %08x", tag, item.Name, item.Type, len(item.Data), item.checksum())
+}
+
+func formatLine(number int, line []byte, checksum uint16) string {
+	s := encoding.EncodeToString(line)
+	var groups []string
+	for i := 0; i < len(s); i += 4 {
+		groups = append(groups, s[i:min(i+4, len(s))])
+	}
+	return fmt.Sprintf("%2d %s %04x", number, strings.Join(groups, " "), checksum)
+}
+
+// Returns the text encoding of the item, with one string per line,
+// and the number of lines needed to recover it.
+func (item *Item) Lines() ([]string, int, error) {
+	if err := item.check(); err != nil {
+		return nil, 0, err
+	}
+	dataLines, parityLines := lineCount(len(item.Data))
+	padded := make([]byte, dataLines*lineSize)
+	copy(padded, item.Data)
+	points := make(map[byte][]byte)
+	for i := 0; i < dataLines; i++ {
+		points[byte(i+1)] = padded[i*lineSize : (i+1)*lineSize]
+	}
+	for i := dataLines; i < dataLines+parityLines; i++ {
+		parity, err := shamir.Interpolate(points, byte(i+1))
+		if err != nil {
+			return nil, 0, err
+		}
+		points[byte(i+1)] = parity
+	}
+	checksum := item.checksum()
+	lines := []string{item.header()}
+	for i := 1; i <= dataLines+parityLines; i++ {
+		lines = append(lines, formatLine(i, points[byte(i)], lineChecksum(checksum, i, points[byte(i)])))
+	}
+	return lines, dataLines, nil
+}
+
+// Returns the compact encoding of the item, for a QR code.
+func (item *Item) Compact() (string, error) {
+	if err := item.check(); err != nil {
+		return "", err
+	}
+	return item.header() + "\n" + encoding.EncodeToString(item.Data) + "\n", nil
+}
+
+// Decodes base32, ignoring case, white space and dashes, and
+// accepting the letters O, I and L for the digits they resemble.
+func decodeBase32(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '-':
+			return -1
+		case 'o', 'O':
+			return '0'
+		case 'i', 'I', 'l', 'L':
+			return '1'
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, s)
+	return encoding.DecodeString(s)
+}
+
+// An item being read, before the data is recovered.
+type partialItem struct {
+	Item
+	size     int
+	checksum uint32
+	lines    map[byte][]byte
+	compact  []byte
+}
+
+func parseHeader(fields []string) (*partialItem, error) {
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid header line")
+	}
+	size, err := strconv.Atoi(fields[3])
+	if err != nil || size <= 0 || size > MaxSize {
+		return nil, fmt.Errorf("invalid size in header line")
+	}
+	checksum, err := strconv.ParseUint(fields[4], 16, 32)
+	if err != nil || len(fields[4]) != 8 {
+		return nil, fmt.Errorf("invalid checksum in header line")
+	}
+	return &partialItem{
+		Item:     Item{Name: fields[1], Type: fields[2]},
+		size:     size,
+		checksum: uint32(checksum),
+		lines:    make(map[byte][]byte),
+	}, nil
+}
+
+// Parses a numbered line. Returns an error if the line is invalid,
+// including if its checksum doesn't match.
+func (p *partialItem) addLine(fields []string) error {
+	if len(fields) == 1 {
+		data, err := decodeBase32(fields[0])
+		if err != nil || len(data) != p.size {
+			return fmt.Errorf("invalid compact data line")
+		}
+		p.compact = data
+		return nil
+	}
+	dataLines, parityLines := lineCount(p.size)
+	number, err := strconv.Atoi(fields[0])
+	if err != nil || number < 1 || number > dataLines+parityLines {
+		return fmt.Errorf("invalid line number %q", fields[0])
+	}
+	line, err := decodeBase32(strings.Join(fields[1:len(fields)-1], ""))
+	if err != nil || len(line) != lineSize {
+		return fmt.Errorf("invalid line %d", number)
+	}
+	checksum, err := strconv.ParseUint(fields[len(fields)-1], 16, 16)
+	if err != nil || uint16(checksum) != lineChecksum(p.checksum, number, line) {
+		return fmt.Errorf("invalid checksum on line %d", number)
+	}
+	if old, ok := p.lines[byte(number)]; ok && !bytes.Equal(old, line) {
+		return fmt.Errorf("conflicting values for line %d", number)
+	}
+	p.lines[byte(number)] = line
+	return nil
+}
+
+func (p *partialItem) recover() (*Item, error) {
+	item := p.Item
+	if p.compact != nil {
+		item.Data = p.compact
+	} else {
+		dataLines, _ := lineCount(p.size)
+		if len(p.lines) < dataLines {
+			return nil, fmt.Errorf("item %q: got %d valid lines, %d needed", p.Name, len(p.lines), dataLines)
+		}
+		// Use exactly dataLines points.
+		var numbers []int
+		for number := range p.lines {
+			numbers = append(numbers, int(number))
+		}
+		sort.Ints(numbers)
+		points := make(map[byte][]byte)
+		for _, number := range numbers[:dataLines] {
+			points[byte(number)] = p.lines[byte(number)]
+		}
+		for i := 1; i <= dataLines; i++ {
+			line, err := shamir.Interpolate(points, byte(i))
+			if err != nil {
+				return nil, err
+			}
+			item.Data = append(item.Data, line...)
+		}
+		item.Data = item.Data[:p.size]
+	}
+	if item.checksum() != p.checksum {
+		return nil, fmt.Errorf("item %q: recovered data doesn't match the checksum", p.Name)
+	}
+	return &item, item.check()
+}
+
+// Reads items, in either encoding, and recovers their data. An item
+// ends at an empty line, and text outside of items is ignored, as are
+// lines starting with '#'. Invalid lines within an item are skipped,
+// and reported using the warn function.
+func Read(r io.Reader, warn func(string)) ([]*Item, error) {
+	var items []*Item
+	var current *partialItem
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		item, err := current.recover()
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+		current = nil
+		return nil
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] == tag {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			var err error
+			if current, err = parseHeader(fields); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if err := current.addLine(fields); err != nil {
+			warn(fmt.Sprintf("item %q, input line %d: %v, skipped", current.Name, n, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -0,0 +1,196 @@
+package paper
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func testItem(t *testing.T, size int) *Item {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return &Item{Name: "test", Type: TypeWrapped, Data: data}
+}
+
+// Reads a single item, failing the test on warnings unless allowed.
+func readItem(t *testing.T, text string, allowWarnings bool) (*Item, error) {
+	t.Helper()
+	items, err := Read(strings.NewReader(text), func(msg string) {
+		if !allowWarnings {
+			t.Errorf("unexpected warning: %s", msg)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) != 1 {
+		t.Fatalf("got %d items, expected 1", len(items))
+	}
+	return items[0], nil
+}
+
+func checkItem(t *testing.T, got, want *Item) {
+	t.Helper()
+	if got.Name != want.Name || got.Type != want.Type || !bytes.Equal(got.Data, want.Data) {
+		t.Errorf("got item %q %q %x, expected %q %q %x",
+			got.Name, got.Type, got.Data, want.Name, want.Type, want.Data)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, size := range []int{1, lineSize, lineSize + 1, 55, MaxSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			item := testItem(t, size)
+			lines, needed, err := item.Lines()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dataLines, parityLines := lineCount(size)
+			if needed != dataLines || len(lines) != 1+dataLines+parityLines {
+				t.Fatalf("unexpected line count %d, %d needed", len(lines), needed)
+			}
+			got, err := readItem(t, strings.Join(lines, "\n")+"\n", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkItem(t, got, item)
+
+			compact, err := item.Compact()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err = readItem(t, compact, false); err != nil {
+				t.Fatal(err)
+			}
+			checkItem(t, got, item)
+		})
+	}
+}
+
+// Checks that the item is recovered from any set of lines as large
+// as the number of data lines, here with the missing lines at the
+// start, at the end, and spread out, and that fewer lines fail.
+func TestMissingLines(t *testing.T) {
+	item := testItem(t, 55)
+	lines, needed, err := item.Lines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbered := lines[1:]
+	missing := len(numbered) - needed
+	for _, c := range []struct {
+		desc string
+		skip func(i int) bool
+	}{
+		{"first", func(i int) bool { return i < missing }},
+		{"last", func(i int) bool { return i >= needed }},
+		{"every other", func(i int) bool { return i%2 == 1 && i < 2*missing }},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			kept := []string{lines[0]}
+			for i, line := range numbered {
+				if !c.skip(i) {
+					kept = append(kept, line)
+				}
+			}
+			if len(kept) != 1+needed {
+				t.Fatalf("internal error, kept %d lines", len(kept)-1)
+			}
+			got, err := readItem(t, strings.Join(kept, "\n"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkItem(t, got, item)
+
+			// One more missing line.
+			if _, err := readItem(t, strings.Join(kept[:len(kept)-1], "\n"), false); err == nil {
+				t.Errorf("recovered with %d lines, %d needed", needed-1, needed)
+			}
+		})
+	}
+}
+
+// Checks that a line with a transcription error is detected by its
+// checksum, reported, and skipped.
+func TestCorruptedLine(t *testing.T) {
+	item := testItem(t, 30)
+	lines, _, err := item.Lines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(lines[2])
+	// Change a base32 digit, after the line number.
+	if line[3] == 'A' {
+		line[3] = 'B'
+	} else {
+		line[3] = 'A'
+	}
+	lines[2] = string(line)
+	var warnings []string
+	items, err := Read(strings.NewReader(strings.Join(lines, "\n")), func(msg string) {
+		warnings = append(warnings, msg)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "invalid checksum on line 2") {
+		t.Errorf("unexpected warnings %q", warnings)
+	}
+	checkItem(t, items[0], item)
+}
+
+// Checks that lines are read regardless of case, and with letters
+// resembling digits.
+func TestLenientDecoding(t *testing.T) {
+	item := testItem(t, 30)
+	lines, _, err := item.Lines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacer := strings.NewReplacer("0", "O", "1", "l")
+	for i := 1; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 1; j < len(fields)-1; j++ {
+			fields[j] = replacer.Replace(strings.ToLower(fields[j]))
+		}
+		lines[i] = strings.Join(fields, " ")
+	}
+	got, err := readItem(t, strings.Join(lines, "\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkItem(t, got, item)
+}
+
+func TestHeaderChecksum(t *testing.T) {
+	item := testItem(t, 30)
+	lines, _, err := item.Lines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A different name changes the checksum of the item, so that
+	// no line matches.
+	lines[0] = strings.Replace(lines[0], " test ", " other ", 1)
+	if _, err := readItem(t, strings.Join(lines, "\n"), true); err == nil {
+		t.Errorf("item with modified header accepted")
+	}
+}
+
+func TestInvalidItem(t *testing.T) {
+	for _, item := range []*Item{
+		{Name: "", Type: TypePassphrase, Data: []byte("x")},
+		{Name: "a b", Type: TypePassphrase, Data: []byte("x")},
+		{Name: "test", Type: "unknown", Data: []byte("x")},
+		{Name: "test", Type: TypePassphrase},
+		{Name: "test", Type: TypePassphrase, Data: make([]byte, MaxSize+1)},
+	} {
+		if _, _, err := item.Lines(); err == nil {
+			t.Errorf("invalid item %q %q, %d bytes, accepted", item.Name, item.Type, len(item.Data))
+		}
+	}
+}
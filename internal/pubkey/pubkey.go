@@ -0,0 +1,102 @@
+// Package pubkey formats and parses Ed25519 public keys, in the
+// formats used by sigsum configuration, OpenSSH, and openssl and
+// yubihsm-shell.
+package pubkey
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"sigsum.org/key-mgmt/internal/agent"
+)
+
+const (
+	// Hex encoded key, as in sigsum policy and configuration files.
+	FormatHex = "hex"
+	// OpenSSH format, "ssh-ed25519 <base64>", as in authorized_keys.
+	FormatOpenSSH = "openssh"
+	// PEM encoded SubjectPublicKeyInfo, as written by openssl and
+	// yubihsm-shell.
+	FormatPEM = "pem"
+	// Base64 encoded key.
+	FormatBase64 = "base64"
+	// Hex encoded SHA-256 hash of the key, as used by sigsum to
+	// identify keys, e.g., in cosignatures and leaves.
+	FormatKeyHash = "key-hash"
+)
+
+// All supported output formats.
+var Formats = []string{FormatHex, FormatOpenSSH, FormatPEM, FormatBase64, FormatKeyHash}
+
+// Checks that the format is supported.
+func CheckFormat(format string) error {
+	for _, f := range Formats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid public key format %q, expected one of %s", format, strings.Join(Formats, ", "))
+}
+
+// Formats a public key. Except for PEM, the result is a single line;
+// there's no trailing newline.
+func Format(pub ed25519.PublicKey, format string) (string, error) {
+	switch format {
+	case FormatHex:
+		return hex.EncodeToString(pub), nil
+	case FormatOpenSSH:
+		return agent.FormatPublicKey(pub), nil
+	case FormatPEM:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), "\n"), nil
+	case FormatBase64:
+		return base64.StdEncoding.EncodeToString(pub), nil
+	case FormatKeyHash:
+		h := sha256.Sum256(pub)
+		return hex.EncodeToString(h[:]), nil
+	}
+	return "", CheckFormat(format)
+}
+
+// Parses a public key in any of the supported formats, except the
+// key hash. Surrounding white space is ignored.
+func Parse(data []byte) (ed25519.PublicKey, error) {
+	data = bytes.TrimSpace(data)
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("unexpected PEM type %q", block.Type)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("not an Ed25519 key, type %T", key)
+		}
+		return pub, nil
+	}
+	s := string(data)
+	if strings.HasPrefix(s, "ssh-") {
+		return agent.ParsePublicKey(s)
+	}
+	if len(s) == 2*ed25519.PublicKeySize {
+		if pub, err := hex.DecodeString(s); err == nil {
+			return pub, nil
+		}
+	}
+	if pub, err := base64.StdEncoding.DecodeString(s); err == nil && len(pub) == ed25519.PublicKeySize {
+		return pub, nil
+	}
+	return nil, fmt.Errorf("not an Ed25519 public key, in hex, OpenSSH, PEM or base64 format")
+}
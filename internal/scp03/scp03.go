@@ -0,0 +1,124 @@
+// Package scp03 implements the cryptographic primitives of the
+// YubiHSM secure channel, based on SCP03, see
+// https://developers.yubico.com/YubiHSM2/Concepts/Session.html
+// They are used both by the host side, in package hsm, and by the
+// simulated device.
+package scp03
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/certusone/yubihsm-go/commands"
+	"github.com/enceve/crypto/cmac"
+)
+
+const (
+	ChallengeLength = 8
+	MACLength       = 8
+	KeyLength       = 16
+
+	DeriveEnc            = 0x04
+	DeriveMAC            = 0x06
+	DeriveRMAC           = 0x07
+	DeriveCardCryptogram = 0x00
+	DeriveHostCryptogram = 0x01
+
+	// Max number of messages per session, a session must be
+	// recreated before the counter overflows.
+	MaxMessages = 10000
+)
+
+// Session keys, derived from the long term authentication key and
+// the challenges.
+type SessionKeys struct {
+	Enc, MAC, RMAC []byte
+}
+
+func cmacSum(key []byte, data ...[]byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(fmt.Sprintf("internal error, invalid aes key: %v", err))
+	}
+	mac, err := cmac.New(block)
+	if err != nil {
+		panic(fmt.Sprintf("internal error, cmac failed: %v", err))
+	}
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// The SCP03 key derivation function, with output size in bytes.
+func Derive(key []byte, constant byte, size int, hostChallenge, cardChallenge []byte) []byte {
+	var label [16]byte
+	label[11] = constant
+	binary.BigEndian.PutUint16(label[13:], uint16(8*size))
+	label[15] = 1
+	return cmacSum(key, label[:], hostChallenge, cardChallenge)[:size]
+}
+
+func DeriveSessionKeys(key authkey.AuthKey, hostChallenge, cardChallenge []byte) SessionKeys {
+	return SessionKeys{
+		Enc:  Derive(key.GetEncKey(), DeriveEnc, KeyLength, hostChallenge, cardChallenge),
+		MAC:  Derive(key.GetMacKey(), DeriveMAC, KeyLength, hostChallenge, cardChallenge),
+		RMAC: Derive(key.GetMacKey(), DeriveRMAC, KeyLength, hostChallenge, cardChallenge),
+	}
+}
+
+// Computes the MAC of a message (excluding the trailing MAC field),
+// given the chain value of the previous command.
+func MessageMAC(key, chain []byte, t commands.CommandType, sessionId uint8, data []byte) []byte {
+	var header [4]byte
+	header[0] = byte(t)
+	binary.BigEndian.PutUint16(header[1:3], uint16(1+len(data)+MACLength))
+	header[3] = sessionId
+	return cmacSum(key, chain, header[:], data)
+}
+
+func Pad(data []byte) []byte {
+	padded := append(bytes.Clone(data), 0x80)
+	for len(padded)%aes.BlockSize != 0 {
+		padded = append(padded, 0)
+	}
+	return padded
+}
+
+func Unpad(data []byte) ([]byte, error) {
+	i := bytes.LastIndexByte(data, 0x80)
+	if i < 0 || len(data)-i > aes.BlockSize {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	for _, b := range data[i+1:] {
+		if b != 0 {
+			return nil, fmt.Errorf("invalid padding")
+		}
+	}
+	return data[:i], nil
+}
+
+// Encrypts or decrypts the contents of a session message.
+func Crypt(key []byte, counter uint32, data []byte, encrypt bool) ([]byte, error) {
+	if len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted data length %d", len(data))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint32(iv[12:], counter)
+	block.Encrypt(iv[:], iv[:])
+	out := make([]byte, len(data))
+	if encrypt {
+		cipher.NewCBCEncrypter(block, iv[:]).CryptBlocks(out, data)
+	} else {
+		cipher.NewCBCDecrypter(block, iv[:]).CryptBlocks(out, data)
+	}
+	return out, nil
+}
@@ -0,0 +1,130 @@
+package scp03
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/certusone/yubihsm-go/authkey"
+	"github.com/certusone/yubihsm-go/commands"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Test vectors from RFC 4493.
+func TestCMAC(t *testing.T) {
+	key := "2b7e151628aed2a6abf7158809cf4f3c"
+	for _, table := range []struct {
+		msg string
+		mac string
+	}{
+		{"", "bb1d6929e95937287fa37d129b756746"},
+		{"6bc1bee22e409f96e93d7e117393172a", "070a16b46b4d4144f79bdd9dd04a287c"},
+		{"6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411",
+			"dfa66747de9ae63030ca32611497c827"},
+	} {
+		if got, want := cmacSum(mustDecodeHex(t, key), mustDecodeHex(t, table.msg)), mustDecodeHex(t, table.mac); !bytes.Equal(got, want) {
+			t.Errorf("cmac of %q: got %x, expected %x", table.msg, got, want)
+		}
+	}
+}
+
+// Known answers for a session using the default authentication key,
+// with session id 3, in which the host sends an echo command with
+// the data "ping". The expected values were computed independently,
+// using the AES-CMAC and AES-CBC implementations of OpenSSL, following
+// the key derivation and message formats of SCP03.
+func TestSession(t *testing.T) {
+	const sessionId = 3
+	key := authkey.NewFromPassword("password")
+	if got, want := []byte(key), mustDecodeHex(t, "090b47dbed595654901dee1cc655e420592fd483f759e29909a04c4505d2ce0a"); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected default auth key %x, expected %x", got, want)
+	}
+	hostChallenge := mustDecodeHex(t, "a0a1a2a3a4a5a6a7")
+	cardChallenge := mustDecodeHex(t, "b0b1b2b3b4b5b6b7")
+
+	keys := DeriveSessionKeys(key, hostChallenge, cardChallenge)
+	for _, table := range []struct {
+		desc string
+		got  []byte
+		want string
+	}{
+		{"S-ENC", keys.Enc, "bf19aec1fdc2584ef33e4307e23dd682"},
+		{"S-MAC", keys.MAC, "6cda8be1450d0f879c7f7859d2a99bb1"},
+		{"S-RMAC", keys.RMAC, "d7b6d86d9d3b17750ccea80a25bd9c45"},
+		{"card cryptogram", Derive(keys.MAC, DeriveCardCryptogram, ChallengeLength, hostChallenge, cardChallenge), "4be0b56fe5e11bde"},
+		{"host cryptogram", Derive(keys.MAC, DeriveHostCryptogram, ChallengeLength, hostChallenge, cardChallenge), "f8ba7baa9e362729"},
+	} {
+		if want := mustDecodeHex(t, table.want); !bytes.Equal(table.got, want) {
+			t.Errorf("unexpected %s %x, expected %x", table.desc, table.got, want)
+		}
+	}
+
+	authMAC := MessageMAC(keys.MAC, make([]byte, 16), commands.CommandTypeAuthenticateSession, sessionId,
+		mustDecodeHex(t, "f8ba7baa9e362729"))
+	if want := mustDecodeHex(t, "57bf6acd87d67b7dd089d2218ddad605"); !bytes.Equal(authMAC, want) {
+		t.Errorf("unexpected authenticate session mac %x, expected %x", authMAC, want)
+	}
+
+	msg := Pad([]byte{byte(commands.CommandTypeEcho), 0, 4, 'p', 'i', 'n', 'g'})
+	encrypted, err := Crypt(keys.Enc, 1, msg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustDecodeHex(t, "effac7a639d578b0a97a7ab91befeb93"); !bytes.Equal(encrypted, want) {
+		t.Errorf("unexpected encrypted command %x, expected %x", encrypted, want)
+	}
+	commandMAC := MessageMAC(keys.MAC, authMAC, commands.CommandTypeSessionMessage, sessionId, encrypted)
+	if want := mustDecodeHex(t, "de0e59d0baa2b6e4a885940da5263bd0"); !bytes.Equal(commandMAC, want) {
+		t.Errorf("unexpected command mac %x, expected %x", commandMAC, want)
+	}
+
+	rspEncrypted := mustDecodeHex(t, "e7ac6f64db0325fd5a38d077be6e58ff")
+	rspMAC := MessageMAC(keys.RMAC, commandMAC, commands.CommandTypeSessionMessage+commands.ResponseCommandOffset,
+		sessionId, rspEncrypted)
+	if want := mustDecodeHex(t, "35c15a6be8115c7d69ad243565358c40"); !bytes.Equal(rspMAC, want) {
+		t.Errorf("unexpected response mac %x, expected %x", rspMAC, want)
+	}
+	decrypted, err := Crypt(keys.Enc, 1, rspEncrypted, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := Unpad(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{byte(commands.CommandTypeEcho + commands.ResponseCommandOffset), 0, 4, 'p', 'i', 'n', 'g'}; !bytes.Equal(rsp, want) {
+		t.Errorf("unexpected response %x, expected %x", rsp, want)
+	}
+}
+
+func TestPad(t *testing.T) {
+	for n := 0; n < 40; n++ {
+		data := bytes.Repeat([]byte{0x80}, n)
+		padded := Pad(data)
+		if len(padded)%16 != 0 || len(padded) <= n || len(padded) > n+16 {
+			t.Errorf("invalid padding of %d bytes, got %d bytes", n, len(padded))
+		}
+		unpadded, err := Unpad(padded)
+		if err != nil {
+			t.Errorf("unpadding %d bytes failed: %v", n, err)
+		} else if !bytes.Equal(unpadded, data) {
+			t.Errorf("unpadding %d bytes, got %x", n, unpadded)
+		}
+	}
+	for _, bad := range []string{
+		"", "00000000000000000000000000000000", "80000000000000000000000000000001",
+		"8000000000000000000000000000000000",
+	} {
+		if _, err := Unpad(mustDecodeHex(t, bad)); err == nil {
+			t.Errorf("invalid padding %q not rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8),
+// for splitting the secret passphrases of the backup YubiHSMs into
+// k-of-n shares.
+package shamir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Multiplication in GF(2^8), with the AES polynomial x^8 + x^4 + x^3
+// + x + 1. Written without secret dependent branches or table
+// lookups.
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= a & -(b & 1)
+		a = (a << 1) ^ (0x1b & -(a >> 7))
+		b >>= 1
+	}
+	return p
+}
+
+// Computes the inverse as a^254.
+func gfInv(a byte) byte {
+	r := a
+	for i := 0; i < 6; i++ {
+		r = gfMul(gfMul(r, r), a)
+	}
+	return gfMul(r, r)
+}
+
+// Splits a secret into n shares, any k of which can be combined to
+// recover the secret. Share i is the value at x = i + 1 of random
+// polynomials of degree k - 1, one per byte of the secret.
+func Split(secret []byte, k, n int, rand io.Reader) ([][]byte, error) {
+	if k < 1 || n < k || n > 255 {
+		return nil, fmt.Errorf("invalid parameters %d-of-%d", k, n)
+	}
+	coefficients := make([]byte, len(secret)*(k-1))
+	if _, err := io.ReadFull(rand, coefficients); err != nil {
+		return nil, err
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		share := make([]byte, len(secret))
+		for j, s := range secret {
+			// Horner's rule.
+			var y byte
+			for c := k - 2; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[j*(k-1)+c]
+			}
+			share[j] = gfMul(y, x) ^ s
+		}
+		shares[i] = share
+	}
+	return shares, nil
+}
+
+// Recovers the secret from shares, indexed by x coordinate (1-255),
+// by Lagrange interpolation at x = 0. If fewer than k shares are
+// given, the result is unrelated to the secret.
+func Combine(shares map[byte][]byte) ([]byte, error) {
+	return Interpolate(shares, 0)
+}
+
+// Evaluates, at x, the polynomials of lowest degree through the given
+// points, indexed by x coordinate (1-255), one polynomial per byte
+// position. Since Shamir's scheme is a Reed-Solomon code, this can
+// also be used to compute and recover the symbols of an erasure code.
+func Interpolate(points map[byte][]byte, x byte) ([]byte, error) {
+	if len(points) == 0 {
+		return nil, errors.New("no shares")
+	}
+	size := -1
+	for xi, share := range points {
+		if xi == 0 {
+			return nil, errors.New("invalid share index 0")
+		}
+		if size >= 0 && len(share) != size {
+			return nil, errors.New("shares have different sizes")
+		}
+		size = len(share)
+	}
+	y := make([]byte, size)
+	for xi, share := range points {
+		// Lagrange basis polynomial for xi, evaluated at x.
+		l := byte(1)
+		for other := range points {
+			if other != xi {
+				l = gfMul(l, gfMul(other^x, gfInv(other^xi)))
+			}
+		}
+		for j, v := range share {
+			y[j] ^= gfMul(l, v)
+		}
+	}
+	return y, nil
+}
@@ -0,0 +1,164 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"math/bits"
+	"strings"
+	"testing"
+)
+
+func TestGF(t *testing.T) {
+	// Example from FIPS 197, section 4.2.
+	if got := gfMul(0x57, 0x83); got != 0xc1 {
+		t.Errorf("unexpected product 0x%02x, expected 0xc1", got)
+	}
+	for a := 1; a < 256; a++ {
+		if got := gfMul(byte(a), gfInv(byte(a))); got != 1 {
+			t.Errorf("0x%02x times its inverse is 0x%02x", a, got)
+		}
+	}
+}
+
+// Returns the shares selected by the bits of mask.
+func subset(shares [][]byte, mask int) map[byte][]byte {
+	selected := make(map[byte][]byte)
+	for i, share := range shares {
+		if mask&(1<<i) != 0 {
+			selected[byte(i+1)] = share
+		}
+	}
+	return selected
+}
+
+// Checks that each subset of k shares recovers the secret, and that
+// smaller subsets don't.
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	for _, p := range []struct{ k, n int }{{1, 1}, {1, 3}, {2, 3}, {3, 5}, {5, 5}} {
+		t.Run(fmt.Sprintf("%d-of-%d", p.k, p.n), func(t *testing.T) {
+			shares, err := Split(secret, p.k, p.n, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for mask := 1; mask < 1<<p.n; mask++ {
+				got, err := Combine(subset(shares, mask))
+				if err != nil {
+					t.Fatal(err)
+				}
+				count := bits.OnesCount(uint(mask))
+				if count >= p.k && !bytes.Equal(got, secret) {
+					t.Errorf("shares %b: recovered %q", mask, got)
+				}
+				if count < p.k && bytes.Equal(got, secret) {
+					t.Errorf("shares %b: recovered secret from %d shares", mask, count)
+				}
+			}
+		})
+	}
+}
+
+// Checks that Interpolate recovers missing points of a polynomial,
+// as used for erasure codes.
+func TestInterpolate(t *testing.T) {
+	shares, err := Split([]byte("some data"), 3, 6, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := subset(shares, 0b100101)
+	for i, share := range shares {
+		got, err := Interpolate(points, byte(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, share) {
+			t.Errorf("point %d: got %x, expected %x", i+1, got, share)
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	for _, p := range []struct{ k, n int }{{0, 1}, {3, 2}, {2, 256}} {
+		if _, err := Split([]byte("secret"), p.k, p.n, rand.Reader); err == nil {
+			t.Errorf("%d-of-%d accepted", p.k, p.n)
+		}
+	}
+}
+
+func TestShareRoundTrip(t *testing.T) {
+	secret := []byte("passphrase")
+	shares, err := SplitSecret(secret, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed []*Share
+	for _, s := range shares {
+		line := s.String()
+		p, err := ParseShare(" " + strings.ToUpper(line) + "\n")
+		if err != nil {
+			t.Fatalf("parsing %q failed: %v", line, err)
+		}
+		if p.String() != line {
+			t.Errorf("round trip of %q gave %q", line, p.String())
+		}
+		parsed = append(parsed, p)
+	}
+	for _, pair := range [][]*Share{parsed[:2], parsed[1:], {parsed[2], parsed[0]}} {
+		got, err := CombineShares(pair)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("recovered %q, expected %q", got, secret)
+		}
+	}
+}
+
+// Checks that changing any single character of a share is detected
+// by the checksum.
+func TestShareChecksum(t *testing.T) {
+	shares, err := SplitSecret([]byte("passphrase"), 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := shares[0].String()
+	for i := range line {
+		for _, c := range "0123456789abcdef-sz" {
+			if byte(c) == line[i] {
+				continue
+			}
+			corrupted := line[:i] + string(c) + line[i+1:]
+			if _, err := ParseShare(corrupted); err == nil {
+				t.Errorf("corrupted share %q accepted", corrupted)
+			}
+		}
+	}
+}
+
+func TestCombineSharesInvalid(t *testing.T) {
+	shares, err := SplitSecret([]byte("passphrase"), 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := SplitSecret([]byte("passphrase"), 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicting := *shares[0]
+	conflicting.Value = bytes.Repeat([]byte{0}, len(conflicting.Value))
+	for _, c := range []struct {
+		desc   string
+		shares []*Share
+	}{
+		{"no shares", nil},
+		{"too few shares", shares[:1]},
+		{"duplicate share", []*Share{shares[0], shares[0]}},
+		{"different sets", []*Share{shares[0], other[1]}},
+		{"conflicting values", []*Share{shares[0], &conflicting, shares[1]}},
+	} {
+		if _, err := CombineShares(c.shares); err == nil {
+			t.Errorf("%s: combine succeeded", c.desc)
+		}
+	}
+}
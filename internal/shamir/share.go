@@ -0,0 +1,153 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Text encoding of a share, for storage in a file or on paper:
+//
+//	sss1-SET-K-N-INDEX-VALUE-CHECKSUM
+//
+// SET is a random 32-bit identifier, the same for all shares of a
+// secret, to prevent combining shares of different secrets.
+// CHECKSUM is a 32-bit hash of the rest of the line, to detect
+// transcription errors. SET, VALUE and CHECKSUM are hex encoded.
+//
+// Fewer than K shares give no information about the secret; in
+// particular, there's no hash of the secret in the shares. Hence
+// the recovered secret can't be checked here: if a share has a valid
+// checksum and the right SET, but a wrong value, e.g., a forged
+// share, the result is a different secret. It must be checked when it is
+// used, e.g., by authenticating to a YubiHSM with a recovered
+// passphrase.
+
+const shareTag = "sss1"
+
+type Share struct {
+	Set       uint32
+	Threshold int
+	Count     int
+	Index     int
+	Value     []byte
+}
+
+func hash32(data ...[]byte) uint32 {
+	h := sha256.Sum256(bytes.Join(data, nil))
+	return binary.BigEndian.Uint32(h[:4])
+}
+
+func (s *Share) String() string {
+	prefix := fmt.Sprintf("%s-%08x-%d-%d-%d-%x", shareTag,
+		s.Set, s.Threshold, s.Count, s.Index, s.Value)
+	return fmt.Sprintf("%s-%08x", prefix, hash32([]byte(prefix)))
+}
+
+func parseHex32(s string) (uint32, error) {
+	if len(s) != 8 {
+		return 0, fmt.Errorf("invalid length")
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	return uint32(v), err
+}
+
+// Parses a share. Surrounding white space is ignored, and hex digits
+// may be upper or lower case.
+func ParseShare(line string) (*Share, error) {
+	line = strings.ToLower(strings.TrimSpace(line))
+	i := strings.LastIndexByte(line, '-')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid share %q", line)
+	}
+	checksum, err := parseHex32(line[i+1:])
+	if err != nil || checksum != hash32([]byte(line[:i])) {
+		return nil, fmt.Errorf("invalid share checksum, %q", line)
+	}
+	fields := strings.Split(line[:i], "-")
+	if len(fields) != 6 || fields[0] != shareTag {
+		return nil, fmt.Errorf("invalid share format, %q", line)
+	}
+	var s Share
+	if s.Set, err = parseHex32(fields[1]); err != nil {
+		return nil, fmt.Errorf("invalid share set, %q", line)
+	}
+	if s.Threshold, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, fmt.Errorf("invalid share threshold, %q", line)
+	}
+	if s.Count, err = strconv.Atoi(fields[3]); err != nil {
+		return nil, fmt.Errorf("invalid share count, %q", line)
+	}
+	if s.Index, err = strconv.Atoi(fields[4]); err != nil {
+		return nil, fmt.Errorf("invalid share index, %q", line)
+	}
+	if s.Threshold < 1 || s.Count < s.Threshold || s.Count > 255 || s.Index < 1 || s.Index > s.Count {
+		return nil, fmt.Errorf("invalid share parameters, %q", line)
+	}
+	if s.Value, err = hex.DecodeString(fields[5]); err != nil || len(s.Value) == 0 {
+		return nil, fmt.Errorf("invalid share value, %q", line)
+	}
+	return &s, nil
+}
+
+// Splits a secret into n shares, any k of which can recover it.
+func SplitSecret(secret []byte, k, n int) ([]*Share, error) {
+	values, err := Split(secret, k, n, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var setBytes [4]byte
+	if _, err := rand.Read(setBytes[:]); err != nil {
+		return nil, err
+	}
+	set := binary.BigEndian.Uint32(setBytes[:])
+
+	shares := make([]*Share, n)
+	for i, value := range values {
+		shares[i] = &Share{
+			Set:       set,
+			Threshold: k,
+			Count:     n,
+			Index:     i + 1,
+			Value:     value,
+		}
+	}
+	return shares, nil
+}
+
+// Recovers a secret from shares. The shares must belong to the same
+// set, and at least the threshold number of distinct shares is
+// required. The recovered secret is not checked, see the comment on
+// the share format.
+func CombineShares(shares []*Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no shares")
+	}
+	first := shares[0]
+	values := make(map[byte][]byte)
+	for _, s := range shares {
+		if s.Set != first.Set || s.Threshold != first.Threshold ||
+			s.Count != first.Count {
+			return nil, fmt.Errorf("share %d doesn't belong to the same set as share %d", s.Index, first.Index)
+		}
+		if s.Index < 1 || s.Index > 255 {
+			return nil, fmt.Errorf("invalid share index %d", s.Index)
+		}
+		if v, ok := values[byte(s.Index)]; ok {
+			if !bytes.Equal(v, s.Value) {
+				return nil, fmt.Errorf("conflicting values for share %d", s.Index)
+			}
+			continue
+		}
+		values[byte(s.Index)] = s.Value
+	}
+	if len(values) < first.Threshold {
+		return nil, fmt.Errorf("got %d distinct shares, %d needed", len(values), first.Threshold)
+	}
+	return Combine(values)
+}
@@ -0,0 +1,35 @@
+// Minimal program to encrypt stdin with age, to a newly generated
+// X25519 identity, which is written to the file given as argument.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"filippo.io/age"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatal("usage: age-encrypt IDENTITY-FILE < plaintext > ciphertext")
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(os.Args[1], []byte(fmt.Sprintln(identity)), 0600); err != nil {
+		log.Fatal(err)
+	}
+	w, err := age.Encrypt(os.Stdout, identity.Recipient())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := io.Copy(w, os.Stdin); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
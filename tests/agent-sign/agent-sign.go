@@ -0,0 +1,48 @@
+// Minimal program to sign stdin, as is, using the key held by the
+// ssh-agent at $SSH_AUTH_SOCK. The signature is written to stdout,
+// base64 encoded.
+package main
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"sigsum.org/key-mgmt/internal/agent"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatal("usage: agent-sign PUBLIC-KEY-FILE < message > signature")
+	}
+	data, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	pub, err := agent.ParsePublicKey(string(data))
+	if err != nil {
+		log.Fatal(err)
+	}
+	msg, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	signer, err := agent.NewClientSigner(conn, pub)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sig, err := signer.Sign(nil, msg, crypto.Hash(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(sig))
+}
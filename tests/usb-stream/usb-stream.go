@@ -0,0 +1,87 @@
+// Minimal program to exercise the usb message framing, by talking
+// to a device stand-in process over a pipe. Starts the command, opens
+// a device using its stdin and stdout, prints the serial number,
+// and signs a few messages concurrently.
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/pborman/getopt/v2"
+
+	"sigsum.org/key-mgmt/internal/hsm"
+)
+
+func main() {
+	var auth hsm.CredentialSource
+	keyId := uint16(0)
+	set := getopt.New()
+	set.SetParameters("cmd ...")
+	set.FlagLong(&auth.File, "auth-file", 'a', "file with yubihsm auth-id:passphrase").Mandatory()
+	set.FlagLong(&keyId, "key-id", 'i', "yubihsm key id").Mandatory()
+
+	if err := set.Getopt(os.Args, nil); err != nil {
+		log.Fatal(err)
+	}
+	if len(set.Args()) == 0 {
+		log.Fatal("No command given")
+	}
+	credentials, err := auth.Read()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmd := exec.Command(set.Args()[0], set.Args()[1:]...)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+	device, err := hsm.OpenDevice(hsm.NewStreamConnector(r, w),
+		credentials.AuthKeyId, credentials.Key, 4, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	info, err := device.DeviceInfo()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("serial=%d\n", info.SerialNumber)
+
+	signer, err := hsm.NewYubiHSMSigner(device, keyId)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(msg []byte) {
+			defer wg.Done()
+			signature, err := signer.Sign(nil, msg, nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !ed25519.Verify(signer.Public().(ed25519.PublicKey), msg, signature) {
+				log.Fatal("invalid signature")
+			}
+		}([]byte(fmt.Sprintf("msg %d", i)))
+	}
+	wg.Wait()
+	signer.Close()
+
+	w.Close()
+	if err := cmd.Wait(); err != nil {
+		log.Fatal(err)
+	}
+}